@@ -0,0 +1,364 @@
+package main
+
+import (
+	"cmp"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	apiSortDate = "date"
+	apiSortName = "name"
+
+	apiOrderAsc  = "asc"
+	apiOrderDesc = "desc"
+
+	apiDefaultLimit = 50
+	apiMaxLimit     = 1000
+)
+
+// APIImage is the representation of an image returned by the API.
+// Its fields must be kept backward compatible.
+type APIImage struct {
+	Key           string    `json:"key"`
+	S3Key         string    `json:"s3_key"`
+	Bucket        string    `json:"bucket"`
+	Type          string    `json:"type"`
+	Group         string    `json:"group"`
+	Name          string    `json:"name"`
+	Date          time.Time `json:"date"`
+	Size          int64     `json:"size"`
+	Geonames      string    `json:"geonames"`
+	FeaturesClass string    `json:"features_class"`
+	FeaturesCount int       `json:"features_count"`
+	ImageURL      string    `json:"image_url"`
+	InfosURL      string    `json:"infos_url"`
+}
+
+// APIImagesPage is a page of the images list. NextCursor is empty on the last page.
+type APIImagesPage struct {
+	Images     []APIImage `json:"images"`
+	Total      int        `json:"total"`
+	NextCursor string     `json:"next_cursor"`
+}
+
+// imagesQuery holds the options of a request to the images list.
+type imagesQuery struct {
+	types         []string
+	groups        []string
+	from, to      time.Time
+	geoname       string
+	featuresClass string
+	sort          string
+	order         string
+	limit         int
+	cursor        *imagesCursor
+}
+
+// imagesCursor points to the last image of a page.
+// It holds the sort options, so that it can't be used with other ones.
+type imagesCursor struct {
+	Sort  string `json:"s"`
+	Order string `json:"o"`
+	Date  int64  `json:"d,omitempty"`
+	Name  string `json:"n,omitempty"`
+	Key   string `json:"k"`
+}
+
+func (cursor imagesCursor) encode() string {
+	data, _ := json.Marshal(cursor) //nolint:errchkjson
+
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeImagesCursor(raw string) (*imagesCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(raw)
+	if err != nil {
+		return nil, errors.New("invalid cursor")
+	}
+
+	var cursor imagesCursor
+
+	if err = json.Unmarshal(data, &cursor); err != nil {
+		return nil, errors.New("invalid cursor")
+	}
+
+	return &cursor, nil
+}
+
+// splitQueryValues returns the values of the given query parameter,
+// which can be repeated or hold comma-separated values.
+func splitQueryValues(values url.Values, key string) []string {
+	var result []string
+
+	for _, value := range values[key] {
+		for _, v := range strings.Split(value, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				result = append(result, v)
+			}
+		}
+	}
+
+	return result
+}
+
+func parseImagesQuery(values url.Values) (imagesQuery, error) {
+	query := imagesQuery{
+		types:         splitQueryValues(values, "type"),
+		groups:        splitQueryValues(values, "group"),
+		geoname:       strings.ToLower(values.Get("geoname")),
+		featuresClass: values.Get("features_class"),
+		sort:          cmp.Or(values.Get("sort"), apiSortDate),
+		order:         values.Get("order"),
+		limit:         apiDefaultLimit,
+	}
+
+	var err error
+
+	if from := values.Get("from"); from != "" {
+		if query.from, err = time.Parse(time.RFC3339, from); err != nil {
+			return imagesQuery{}, fmt.Errorf("invalid 'from' date, expected RFC 3339: %w", err)
+		}
+	}
+
+	if to := values.Get("to"); to != "" {
+		if query.to, err = time.Parse(time.RFC3339, to); err != nil {
+			return imagesQuery{}, fmt.Errorf("invalid 'to' date, expected RFC 3339: %w", err)
+		}
+	}
+
+	switch query.sort {
+	case apiSortDate:
+		// the most recent images first by default, as displayed by the viewer
+		query.order = cmp.Or(query.order, apiOrderDesc)
+	case apiSortName:
+		query.order = cmp.Or(query.order, apiOrderAsc)
+	default:
+		return imagesQuery{}, fmt.Errorf("invalid sort %q, expected %q or %q", query.sort, apiSortDate, apiSortName)
+	}
+
+	if query.order != apiOrderAsc && query.order != apiOrderDesc {
+		return imagesQuery{}, fmt.Errorf("invalid order %q, expected %q or %q", query.order, apiOrderAsc, apiOrderDesc)
+	}
+
+	if limit := values.Get("limit"); limit != "" {
+		query.limit, err = strconv.Atoi(limit)
+		if err != nil || query.limit < 1 || query.limit > apiMaxLimit {
+			return imagesQuery{}, fmt.Errorf("invalid limit, expected a number between 1 and %d", apiMaxLimit)
+		}
+	}
+
+	if cursor := values.Get("cursor"); cursor != "" {
+		if query.cursor, err = decodeImagesCursor(cursor); err != nil {
+			return imagesQuery{}, err
+		}
+
+		if query.cursor.Sort != query.sort || query.cursor.Order != query.order {
+			return imagesQuery{}, errors.New("the cursor was created with other sort options")
+		}
+	}
+
+	return query, nil
+}
+
+func (query imagesQuery) matches(img APIImage) bool {
+	if len(query.types) > 0 && !slices.Contains(query.types, img.Type) {
+		return false
+	}
+
+	if len(query.groups) > 0 && !slices.Contains(query.groups, img.Group) {
+		return false
+	}
+
+	if !query.from.IsZero() && img.Date.Before(query.from) {
+		return false
+	}
+
+	if !query.to.IsZero() && img.Date.After(query.to) {
+		return false
+	}
+
+	if query.geoname != "" && !strings.Contains(strings.ToLower(img.Geonames), query.geoname) {
+		return false
+	}
+
+	if query.featuresClass != "" && !strings.EqualFold(img.FeaturesClass, query.featuresClass) {
+		return false
+	}
+
+	return true
+}
+
+// compare orders the images according to the sort options of the query, the key being used as a tiebreaker.
+func (query imagesQuery) compare(a, b imagesCursor) int {
+	var result int
+
+	if query.sort == apiSortName {
+		result = cmp.Compare(a.Name, b.Name)
+	} else {
+		result = cmp.Compare(a.Date, b.Date)
+	}
+
+	if result == 0 {
+		result = cmp.Compare(a.Key, b.Key)
+	}
+
+	if query.order == apiOrderDesc {
+		return -result
+	}
+
+	return result
+}
+
+func (query imagesQuery) cursorOf(img APIImage) imagesCursor {
+	return imagesCursor{
+		Sort:  query.sort,
+		Order: query.order,
+		Date:  img.Date.UnixNano(),
+		Name:  img.Name,
+		Key:   img.Key,
+	}
+}
+
+func newAPIImage(img S3Image) APIImage {
+	apiImg := APIImage{
+		Key:      img.FormattedKey,
+		S3Key:    img.S3Key,
+		Name:     getGeoname(img.FormattedKey),
+		Date:     img.LastModified,
+		Size:     img.Size,
+		ImageURL: config.BasePath + "/image/" + img.FormattedKey,
+		InfosURL: config.BasePath + "/infos/" + img.FormattedKey,
+	}
+
+	if img.Type != nil {
+		apiImg.Bucket = img.Type.getBucket().name()
+		apiImg.Type = img.Type.Name
+		apiImg.Group = img.Type.group
+	}
+
+	if img.AssociatedGeonames != nil {
+		apiImg.Geonames = img.AssociatedGeonames.format()
+	}
+
+	if img.AssociatedFeatures != nil {
+		apiImg.FeaturesClass = img.AssociatedFeatures.Class
+		apiImg.FeaturesCount = img.AssociatedFeatures.Count
+	}
+
+	return apiImg
+}
+
+// matchingImages returns the images of the main cache visible to the identity and matching the query,
+// sorted according to its sort options.
+func matchingImages(identity *Identity, query imagesQuery) []APIImage {
+	images := make([]APIImage, 0)
+
+	for _, img := range identity.visibleImages(mainCache.snapshot()) {
+		if apiImg := newAPIImage(img); query.matches(apiImg) {
+			images = append(images, apiImg)
+		}
+	}
+
+	slices.SortFunc(images, func(a, b APIImage) int {
+		return query.compare(query.cursorOf(a), query.cursorOf(b))
+	})
+
+	return images
+}
+
+// listImages returns the page of the images of the main cache visible to the identity and matching the query.
+func listImages(identity *Identity, query imagesQuery) APIImagesPage {
+	images := matchingImages(identity, query)
+	page := APIImagesPage{Total: len(images)}
+
+	if query.cursor != nil {
+		start, _ := slices.BinarySearchFunc(images, *query.cursor, func(img APIImage, cursor imagesCursor) int {
+			return query.compare(query.cursorOf(img), cursor)
+		})
+		// the image the cursor points to was on the previous page
+		if start < len(images) && images[start].Key == query.cursor.Key {
+			start++
+		}
+
+		images = images[start:]
+	}
+
+	if len(images) > query.limit {
+		images = images[:query.limit]
+		page.NextCursor = query.cursorOf(images[len(images)-1]).encode()
+	}
+
+	page.Images = images
+
+	return page
+}
+
+// apiImagesHandler lists the images of the cache.
+//
+// Query parameters:
+//   - type, group: only keep the images of the given types or groups (repeated or comma-separated)
+//   - from, to: only keep the images modified in this range (RFC 3339 dates)
+//   - geoname: only keep the images whose geonames contain this text (case-insensitive)
+//   - features_class: only keep the images whose features have this class
+//   - sort: 'date' (default) or 'name', order: 'asc' or 'desc'
+//   - limit: the size of the page, cursor: the next_cursor of the previous page
+func apiImagesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		prettier(w, "Method not allowed", nil, http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	query, err := parseImagesQuery(r.URL.Query())
+	if err != nil {
+		prettier(w, err.Error(), nil, http.StatusBadRequest)
+
+		return
+	}
+
+	prettier(w, "Images", listImages(identityFromRequest(r), query), http.StatusOK)
+}
+
+// expirationsHandler lists the next images to be removed from the cache,
+// among the ones of the groups the user can administrate.
+// The number of results can be limited with the 'limit' query parameter.
+func expirationsHandler(w http.ResponseWriter, r *http.Request) {
+	var limit int
+
+	if rawLimit := r.URL.Query().Get("limit"); rawLimit != "" {
+		var err error
+
+		limit, err = strconv.Atoi(rawLimit)
+		if err != nil || limit < 0 {
+			prettier(w, "Invalid limit", nil, http.StatusBadRequest)
+
+			return
+		}
+	}
+
+	identity := identityFromRequest(r)
+	expirations := expiryScheduler.upcoming(0)
+
+	if !identity.isAdmin() {
+		expirations = slices.DeleteFunc(expirations, func(expiration Expiration) bool {
+			imgType := inferImageType(strings.ReplaceAll(expiration.ImgKey, "@", "/"))
+
+			return imgType == nil || !identity.canAdministrateGroup(imgType.group)
+		})
+	}
+
+	if limit > 0 && len(expirations) > limit {
+		expirations = expirations[:limit]
+	}
+
+	prettier(w, "Upcoming expirations", expirations, http.StatusOK)
+}
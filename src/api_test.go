@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestImagesCursorEncoding(t *testing.T) {
+	cursors := []imagesCursor{
+		{Sort: apiSortDate, Order: apiOrderDesc, Date: time.Date(2024, 1, 1, 0, 0, 0, 1, time.UTC).UnixNano(), Key: "my-prefix@TYPE1@DIR_a@preview.jpg"},
+		{Sort: apiSortName, Order: apiOrderAsc, Name: "Île-de-France, \"Paris\" & co/+=", Key: "key"},
+		{Sort: apiSortDate, Order: apiOrderAsc},
+	}
+
+	for _, cursor := range cursors {
+		encoded := cursor.encode()
+		if _, err := url.ParseQuery("cursor=" + encoded); err != nil || url.QueryEscape(encoded) != encoded {
+			t.Errorf("cursor %q is not safe in a query string", encoded)
+		}
+
+		decoded, err := decodeImagesCursor(encoded)
+		if err != nil {
+			t.Fatalf("failed to decode cursor %q: %v", encoded, err)
+		}
+
+		if *decoded != cursor {
+			t.Errorf("expected %+v, got %+v", cursor, *decoded)
+		}
+	}
+
+	for _, raw := range []string{"not base64!", base64.RawURLEncoding.EncodeToString([]byte("not json")), "eyJzIjoi"} {
+		if _, err := decodeImagesCursor(raw); err == nil {
+			t.Errorf("expected cursor %q to be invalid", raw)
+		}
+	}
+}
+
+func TestParseImagesQueryCursor(t *testing.T) {
+	dateDesc := imagesCursor{Sort: apiSortDate, Order: apiOrderDesc, Key: "key"}.encode()
+
+	tests := []struct {
+		query string
+		err   bool
+	}{
+		{query: "cursor=" + dateDesc},
+		{query: "sort=date&order=desc&cursor=" + dateDesc},
+		{query: "order=asc&cursor=" + dateDesc, err: true},
+		{query: "sort=name&cursor=" + dateDesc, err: true},
+		{query: "cursor=invalid", err: true},
+	}
+
+	for _, test := range tests {
+		values, _ := url.ParseQuery(test.query)
+
+		if _, err := parseImagesQuery(values); (err != nil) != test.err {
+			t.Errorf("%q: expected error %t, got %v", test.query, test.err, err)
+		}
+	}
+}
+
+// TestListImagesPages goes through all the pages of the images list, following the cursors.
+func TestListImagesPages(t *testing.T) {
+	previousCache := mainCache
+	mainCache = newImageCache(t.TempDir())
+
+	t.Cleanup(func() { mainCache = previousCache })
+
+	date := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// several images share a date, so that they are ordered by key
+	for i := range 7 {
+		mainCache.addImage(ObjectInfo{Key: fmt.Sprintf("my-prefix/TYPE1/DIR_%d/preview.jpg", (i*3)%7), LastModified: date.Add(time.Duration(i/2) * time.Hour)})
+	}
+
+	for _, options := range []string{"sort=date&order=desc", "sort=date&order=asc", "sort=name&order=asc", "sort=name&order=desc"} {
+		for _, limit := range []int{1, 2, 3, 7, 10} {
+			t.Run(fmt.Sprintf("%s&limit=%d", options, limit), func(t *testing.T) {
+				values, _ := url.ParseQuery(fmt.Sprintf("%s&limit=%d", options, limit))
+
+				query, err := parseImagesQuery(values)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				all := make([]string, 0)
+				for _, img := range listImages(nil, imagesQuery{sort: query.sort, order: query.order, limit: apiMaxLimit}).Images {
+					all = append(all, img.Key)
+				}
+
+				if len(all) != 7 {
+					t.Fatalf("expected 7 images, got %d", len(all))
+				}
+
+				paged := make([]string, 0)
+
+				for pages := 0; ; pages++ {
+					if pages > len(all) {
+						t.Fatal("the pages never end")
+					}
+
+					page := listImages(nil, query)
+					if page.Total != len(all) || len(page.Images) > limit {
+						t.Fatalf("unexpected page: total %d, %d images", page.Total, len(page.Images))
+					}
+
+					for _, img := range page.Images {
+						paged = append(paged, img.Key)
+					}
+
+					if page.NextCursor == "" {
+						break
+					}
+
+					values.Set("cursor", page.NextCursor)
+
+					if query, err = parseImagesQuery(values); err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				if !slices.Equal(paged, all) {
+					t.Errorf("expected the pages to hold %v, got %v", all, paged)
+				}
+			})
+		}
+	}
+}
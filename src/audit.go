@@ -0,0 +1,460 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	auditReload        = "reload"
+	auditImageDownload = "image_download"
+	auditFileDownload  = "file_download"
+	auditQuery         = "audit_query"
+	auditExport        = "export"
+	auditLogin         = "login"
+
+	auditResultSuccess = "success"
+	auditResultDenied  = "denied"
+	auditResultFailure = "failure"
+
+	auditDefaultLimit = 1000
+	auditMaxLimit     = 10000
+	// auditMaxLineSize bounds the size of the entries read back from the files
+	auditMaxLineSize = 64 * 1024
+)
+
+// auditCredentialParameters are the query parameters holding credentials, which are left out of the audited targets.
+var auditCredentialParameters = []string{"access_token"} //nolint:gochecknoglobals
+
+// AuditEntry records an action of a user.
+type AuditEntry struct {
+	Time       time.Time `json:"time"`
+	User       string    `json:"user"`
+	Provider   string    `json:"provider,omitempty"`
+	RemoteAddr string    `json:"remote_addr"`
+	Action     string    `json:"action"`
+	Target     string    `json:"target,omitempty"`
+	Result     string    `json:"result"`
+	Status     int       `json:"status"`
+}
+
+// AuditEntries is the response of the audit query endpoint.
+// Truncated is set when more entries match the query than the limit.
+type AuditEntries struct {
+	Entries   []AuditEntry `json:"entries"`
+	Truncated bool         `json:"truncated"`
+}
+
+// AuditLog appends the entries to a JSON lines file,
+// which is rotated once it reaches the configured size.
+// A nil audit log records nothing.
+type AuditLog struct {
+	mutex      sync.Mutex
+	filePath   string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+	closed     bool
+}
+
+func openAuditLog(auditConfig AuditConfig) (*AuditLog, error) {
+	if !auditConfig.Enabled {
+		return nil, nil //nolint:nilnil
+	}
+
+	audit := &AuditLog{
+		filePath:   auditConfig.FilePath,
+		maxSize:    int64(auditConfig.MaxFileSizeMB) * 1024 * 1024,
+		maxBackups: auditConfig.MaxBackups,
+	}
+
+	if err := audit.open(); err != nil {
+		return nil, err
+	}
+
+	return audit, nil
+}
+
+func (audit *AuditLog) open() error {
+	file, err := os.OpenFile(audit.filePath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+
+	audit.file = file
+	audit.size = info.Size()
+
+	return nil
+}
+
+func (audit *AuditLog) backupPath(n int) string {
+	return audit.filePath + "." + strconv.Itoa(n)
+}
+
+// rotate renames the current file to the first backup, shifting the previous ones,
+// and opens a new file. The oldest backup is removed.
+func (audit *AuditLog) rotate() error {
+	if err := audit.file.Close(); err != nil {
+		printWarn("Failed to close audit log: ", err)
+	}
+
+	_ = os.Remove(audit.backupPath(audit.maxBackups))
+
+	for n := audit.maxBackups - 1; n > 0; n-- {
+		if err := os.Rename(audit.backupPath(n), audit.backupPath(n+1)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			printWarn("Failed to rotate audit log: ", err)
+		}
+	}
+
+	if audit.maxBackups > 0 {
+		if err := os.Rename(audit.filePath, audit.backupPath(1)); err != nil {
+			printWarn("Failed to rotate audit log: ", err)
+		}
+	} else {
+		_ = os.Remove(audit.filePath)
+	}
+
+	return audit.open()
+}
+
+func (audit *AuditLog) record(entry AuditEntry) {
+	if audit == nil {
+		return
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		printError(fmt.Errorf("failed to marshal audit entry: %w", err), false)
+
+		return
+	}
+
+	line = append(line, '\n')
+
+	audit.mutex.Lock()
+	defer audit.mutex.Unlock()
+
+	if audit.closed {
+		return
+	}
+
+	if audit.file == nil {
+		// a previous rotation failed, the file is opened again
+		if err = audit.open(); err != nil {
+			printError(err, false)
+
+			return
+		}
+	}
+
+	if audit.size > 0 && audit.size+int64(len(line)) > audit.maxSize {
+		if err = audit.rotate(); err != nil {
+			audit.file = nil
+			printError(err, false)
+
+			return
+		}
+	}
+
+	n, err := audit.file.Write(line)
+	audit.size += int64(n)
+
+	if err != nil {
+		printError(fmt.Errorf("failed to write audit entry: %w", err), false)
+	}
+}
+
+// close closes the file, the entries recorded afterward are dropped.
+func (audit *AuditLog) close() {
+	if audit == nil {
+		return
+	}
+
+	audit.mutex.Lock()
+	defer audit.mutex.Unlock()
+
+	audit.closed = true
+
+	if audit.file != nil {
+		if err := audit.file.Close(); err != nil {
+			printError(fmt.Errorf("failed to close audit log: %w", err), false)
+		}
+
+		audit.file = nil
+	}
+}
+
+// recordRequest records the action done by the request, with the status of its response.
+func (audit *AuditLog) recordRequest(r *http.Request, action, target string, status int) {
+	if audit == nil {
+		return
+	}
+
+	entry := AuditEntry{
+		Time:       time.Now().UTC(),
+		RemoteAddr: r.RemoteAddr,
+		Action:     action,
+		Target:     target,
+		Status:     status,
+	}
+
+	if identity := identityFromRequest(r); identity != nil {
+		entry.User = identity.Name
+		entry.Provider = identity.Provider
+	}
+
+	switch {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		entry.Result = auditResultDenied
+	case status >= http.StatusBadRequest:
+		entry.Result = auditResultFailure
+	default:
+		entry.Result = auditResultSuccess
+	}
+
+	audit.record(entry)
+}
+
+// recordFailedLogin records a request rejected because of invalid credentials,
+// along with the username it was sent with, if any.
+func (audit *AuditLog) recordFailedLogin(r *http.Request) {
+	if audit == nil {
+		return
+	}
+
+	username, _, _ := r.BasicAuth()
+
+	audit.record(AuditEntry{
+		Time:       time.Now().UTC(),
+		User:       username,
+		RemoteAddr: r.RemoteAddr,
+		Action:     auditLogin,
+		Target:     r.URL.Path,
+		Result:     auditResultDenied,
+		Status:     http.StatusUnauthorized,
+	})
+}
+
+// statusRecorder keeps the status code of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (recorder *statusRecorder) WriteHeader(status int) {
+	if recorder.status == 0 {
+		recorder.status = status
+	}
+
+	recorder.ResponseWriter.WriteHeader(status)
+}
+
+func (recorder *statusRecorder) Write(data []byte) (int, error) {
+	if recorder.status == 0 {
+		recorder.status = http.StatusOK
+	}
+
+	return recorder.ResponseWriter.Write(data) //nolint:wrapcheck
+}
+
+// audited records the requests handled by next, the target being given by the target function.
+func audited(action string, target func(r *http.Request) string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if auditLog == nil {
+			next(w, r)
+
+			return
+		}
+
+		recorder := &statusRecorder{ResponseWriter: w}
+		next(recorder, r)
+
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+
+		auditLog.recordRequest(r, action, target(r), recorder.status)
+	}
+}
+
+// pathTarget returns a target function giving the path of the request after the prefix.
+func pathTarget(prefix string) func(r *http.Request) string {
+	return func(r *http.Request) string {
+		return strings.TrimPrefix(r.URL.Path, prefix)
+	}
+}
+
+// queryTarget returns the query of the request, without the parameters holding credentials.
+func queryTarget(r *http.Request) string {
+	values := r.URL.Query()
+	for _, parameter := range auditCredentialParameters {
+		values.Del(parameter)
+	}
+
+	return values.Encode()
+}
+
+// openFiles opens the rotated files and the current one, from the oldest to the most recent.
+// They are opened while the log is locked, so that they are not rotated in between,
+// and can then be read without blocking the recording of the entries.
+func (audit *AuditLog) openFiles() ([]*os.File, error) {
+	audit.mutex.Lock()
+	defer audit.mutex.Unlock()
+
+	paths := make([]string, 0, audit.maxBackups+1)
+	for n := audit.maxBackups; n > 0; n-- {
+		paths = append(paths, audit.backupPath(n))
+	}
+
+	paths = append(paths, audit.filePath)
+	files := make([]*os.File, 0, len(paths))
+
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+
+			for _, file := range files {
+				_ = file.Close()
+			}
+
+			return nil, fmt.Errorf("failed to read audit log: %w", err)
+		}
+
+		files = append(files, file)
+	}
+
+	return files, nil
+}
+
+// query returns the entries recorded between from and to (when they are not zero),
+// from the oldest to the most recent, within the given limit.
+func (audit *AuditLog) query(from, to time.Time, user, action string, limit int) (AuditEntries, error) {
+	result := AuditEntries{Entries: make([]AuditEntry, 0)}
+
+	files, err := audit.openFiles()
+	if err != nil {
+		return AuditEntries{}, err
+	}
+
+	defer func() {
+		for _, file := range files {
+			_ = file.Close()
+		}
+	}()
+
+	for _, file := range files {
+		path := file.Name()
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 0, 4096), auditMaxLineSize)
+
+		for scanner.Scan() {
+			var entry AuditEntry
+
+			if err = json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+				printWarn("Ignoring invalid audit entry in ", path, ": ", err)
+
+				continue
+			}
+
+			if (!from.IsZero() && entry.Time.Before(from)) || (!to.IsZero() && entry.Time.After(to)) ||
+				(user != "" && entry.User != user) || (action != "" && entry.Action != action) {
+				continue
+			}
+
+			if len(result.Entries) == limit {
+				result.Truncated = true
+
+				break
+			}
+
+			result.Entries = append(result.Entries, entry)
+		}
+
+		if err = scanner.Err(); err != nil {
+			return AuditEntries{}, fmt.Errorf("failed to read audit log %s: %w", path, err)
+		}
+
+		if result.Truncated {
+			break
+		}
+	}
+
+	return result, nil
+}
+
+// auditHandler returns the audit entries, from the oldest to the most recent.
+//
+// Query parameters:
+//   - from, to: only keep the entries recorded in this range (RFC 3339 dates)
+//   - user, action: only keep the entries of this user or action
+//   - limit: the maximum number of entries, the range must be narrowed when the result is truncated
+func auditHandler(w http.ResponseWriter, r *http.Request) {
+	if auditLog == nil {
+		prettier(w, "Audit log disabled", nil, http.StatusNotFound)
+
+		return
+	}
+
+	values := r.URL.Query()
+
+	var (
+		from, to time.Time
+		err      error
+	)
+
+	if rawFrom := values.Get("from"); rawFrom != "" {
+		if from, err = time.Parse(time.RFC3339, rawFrom); err != nil {
+			prettier(w, "Invalid 'from' date, expected RFC 3339", nil, http.StatusBadRequest)
+
+			return
+		}
+	}
+
+	if rawTo := values.Get("to"); rawTo != "" {
+		if to, err = time.Parse(time.RFC3339, rawTo); err != nil {
+			prettier(w, "Invalid 'to' date, expected RFC 3339", nil, http.StatusBadRequest)
+
+			return
+		}
+	}
+
+	limit := auditDefaultLimit
+
+	if rawLimit := values.Get("limit"); rawLimit != "" {
+		limit, err = strconv.Atoi(rawLimit)
+		if err != nil || limit < 1 || limit > auditMaxLimit {
+			prettier(w, fmt.Sprintf("Invalid limit, expected a number between 1 and %d", auditMaxLimit), nil, http.StatusBadRequest)
+
+			return
+		}
+	}
+
+	entries, err := auditLog.query(from, to, values.Get("user"), values.Get("action"), limit)
+	if err != nil {
+		printError(err, false)
+		prettier(w, "Failed to read the audit log", nil, http.StatusInternalServerError)
+
+		return
+	}
+
+	prettier(w, "Audit entries", entries, http.StatusOK)
+}
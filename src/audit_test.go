@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestAuditLogRotation(t *testing.T) {
+	date := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	entryOf := func(i int) AuditEntry {
+		return AuditEntry{Time: date.Add(time.Duration(i) * time.Second), User: fmt.Sprintf("user%d", i), Action: auditFileDownload, Result: auditResultSuccess, Status: 200}
+	}
+
+	line, _ := json.Marshal(entryOf(0))
+	lineSize := int64(len(line) + 1)
+
+	tests := []struct {
+		name       string
+		maxBackups int
+		// expected holds the users of the entries of each file, from the current one to the oldest backup
+		expected [][]string
+	}{
+		{name: "no backup", maxBackups: 0, expected: [][]string{{"user8", "user9"}}},
+		{name: "one backup", maxBackups: 1, expected: [][]string{{"user8", "user9"}, {"user6", "user7"}}},
+		{
+			name: "oldest backups removed", maxBackups: 2,
+			expected: [][]string{{"user8", "user9"}, {"user6", "user7"}, {"user4", "user5"}},
+		},
+		{
+			name: "all kept", maxBackups: 10,
+			expected: [][]string{{"user8", "user9"}, {"user6", "user7"}, {"user4", "user5"}, {"user2", "user3"}, {"user0", "user1"}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// every file holds 2 entries
+			audit := &AuditLog{filePath: filepath.Join(t.TempDir(), "audit.log"), maxSize: 2 * lineSize, maxBackups: test.maxBackups}
+			if err := audit.open(); err != nil {
+				t.Fatal(err)
+			}
+
+			defer audit.close()
+
+			for i := range 10 {
+				audit.record(entryOf(i))
+			}
+
+			paths := []string{audit.filePath}
+			for n := 1; n <= test.maxBackups; n++ {
+				paths = append(paths, audit.backupPath(n))
+			}
+
+			var all []string
+
+			for i, path := range paths {
+				content, err := os.ReadFile(path)
+				if i >= len(test.expected) {
+					if err == nil {
+						t.Errorf("expected %s not to exist", filepath.Base(path))
+					}
+
+					continue
+				}
+
+				if int64(len(content)) > audit.maxSize {
+					t.Errorf("%s is larger than the maximum size: %d bytes", filepath.Base(path), len(content))
+				}
+
+				var users []string
+
+				for _, line := range bytes.Split(bytes.TrimSuffix(content, []byte("\n")), []byte("\n")) {
+					var entry AuditEntry
+					if err := json.Unmarshal(line, &entry); err != nil {
+						t.Fatalf("invalid entry %q in %s: %v", line, filepath.Base(path), err)
+					}
+
+					users = append(users, entry.User)
+				}
+
+				if !slices.Equal(users, test.expected[i]) {
+					t.Errorf("expected %s to hold %v, got %v", filepath.Base(path), test.expected[i], users)
+				}
+
+				all = slices.Concat(test.expected[i], all)
+			}
+
+			// the entries are read back from the oldest file to the current one
+			entries, err := audit.query(time.Time{}, time.Time{}, "", "", auditMaxLimit)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var users []string
+			for _, entry := range entries.Entries {
+				users = append(users, entry.User)
+			}
+
+			if !slices.Equal(users, all) || entries.Truncated {
+				t.Errorf("expected the query to return %v, got %v (truncated %t)", all, users, entries.Truncated)
+			}
+		})
+	}
+}
+
+func TestAuditLogQuery(t *testing.T) {
+	audit := &AuditLog{filePath: filepath.Join(t.TempDir(), "audit.log"), maxSize: 1024, maxBackups: 3}
+	if err := audit.open(); err != nil {
+		t.Fatal(err)
+	}
+
+	defer audit.close()
+
+	date := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for i := range 20 {
+		audit.record(AuditEntry{
+			Time:   date.Add(time.Duration(i) * time.Minute),
+			User:   []string{"alice", "bob"}[i%2],
+			Action: []string{auditFileDownload, auditReload, auditLogin}[i%3],
+			Result: auditResultSuccess,
+		})
+	}
+
+	tests := []struct {
+		name      string
+		from, to  time.Time
+		user      string
+		action    string
+		limit     int
+		count     int
+		truncated bool
+	}{
+		{name: "all", limit: auditMaxLimit, count: 20},
+		{name: "by user", user: "alice", limit: auditMaxLimit, count: 10},
+		{name: "by action", action: auditLogin, limit: auditMaxLimit, count: 6},
+		{name: "by user and action", user: "bob", action: auditFileDownload, limit: auditMaxLimit, count: 3},
+		{name: "by date", from: date.Add(5 * time.Minute), to: date.Add(9 * time.Minute), limit: auditMaxLimit, count: 5},
+		{name: "truncated", limit: 7, count: 7, truncated: true},
+		{name: "exactly the limit", user: "alice", limit: 10, count: 10},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			entries, err := audit.query(test.from, test.to, test.user, test.action, test.limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(entries.Entries) != test.count || entries.Truncated != test.truncated {
+				t.Errorf("expected %d entries (truncated %t), got %d (truncated %t)", test.count, test.truncated, len(entries.Entries), entries.Truncated)
+			}
+
+			for i := 1; i < len(entries.Entries); i++ {
+				if entries.Entries[i].Time.Before(entries.Entries[i-1].Time) {
+					t.Fatalf("entries not sorted from the oldest: %v before %v", entries.Entries[i-1].Time, entries.Entries[i].Time)
+				}
+			}
+		})
+	}
+}
+
+func TestQueryTarget(t *testing.T) {
+	tests := []struct {
+		url      string
+		expected string
+	}{
+		{url: "/api/v1/audit?user=bob", expected: "user=bob"},
+		{url: "/api/v1/audit?user=bob&access_token=secret", expected: "user=bob"},
+		{url: "/api/v1/audit?access_token=secret&access_token=other", expected: ""},
+		{url: "/api/v1/audit", expected: ""},
+	}
+
+	for _, test := range tests {
+		if target := queryTarget(httptest.NewRequest(http.MethodGet, test.url, nil)); target != test.expected {
+			t.Errorf("%s: expected the target %q, got %q", test.url, test.expected, target)
+		}
+	}
+}
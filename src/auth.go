@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	authProviderBasic = "basic"
+	authProviderToken = "token"
+	authProviderJWT   = "jwt"
+)
+
+var (
+	errInvalidCredentials = errors.New("invalid credentials")
+	errNoCredentials      = errors.New("no credentials provided")
+)
+
+// Identity is the authenticated user of a request.
+type Identity struct {
+	Name     string
+	Provider string
+	Roles    []string
+	// Claims holds the claims of the JWT the user was authenticated with
+	Claims jwt.MapClaims
+
+	permissions permissions
+}
+
+type identityContextKey struct{}
+
+// identityFromRequest returns the identity of the user who sent the request,
+// or nil if the authentication is disabled.
+func identityFromRequest(r *http.Request) *Identity {
+	identity, _ := r.Context().Value(identityContextKey{}).(*Identity)
+
+	return identity
+}
+
+// authProvider authenticates the requests holding a kind of credentials.
+type authProvider interface {
+	// authenticate returns nil and no error if the request doesn't hold credentials the provider can check.
+	authenticate(r *http.Request) (*Identity, error)
+}
+
+// Authenticator checks the credentials of the requests against the configured providers.
+type Authenticator struct {
+	realm     string
+	providers []authProvider
+	// roles holds the configured roles, indexed by name
+	roles map[string]AuthRole
+}
+
+func newAuthenticator(authConfig AuthConfig) (*Authenticator, error) {
+	auth := &Authenticator{realm: authConfig.Realm, roles: make(map[string]AuthRole, len(authConfig.Roles))}
+
+	if !authConfig.Enabled {
+		return auth, nil
+	}
+
+	for _, role := range authConfig.Roles {
+		auth.roles[role.Name] = role
+	}
+
+	if len(authConfig.Users) > 0 {
+		// the password of the unknown users is compared to a dummy hash,
+		// so that they can't be told apart from the known ones by the response time
+		dummyHash, err := bcrypt.GenerateFromPassword([]byte("dummy"), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize basic authentication: %w", err)
+		}
+
+		provider := basicAuthProvider{users: make(map[string]AuthUser, len(authConfig.Users)), dummyHash: dummyHash}
+		for _, user := range authConfig.Users {
+			provider.users[user.Username] = user
+		}
+
+		auth.providers = append(auth.providers, provider)
+	}
+
+	if len(authConfig.APITokens) > 0 {
+		provider := tokenAuthProvider{tokens: make(map[[sha256.Size]byte]APIToken, len(authConfig.APITokens))}
+		for _, token := range authConfig.APITokens {
+			provider.tokens[sha256.Sum256([]byte(token.Token))] = token
+		}
+
+		auth.providers = append(auth.providers, provider)
+	}
+
+	if authConfig.JWT.JWKSFile != "" {
+		keys, err := loadJWKS(authConfig.JWT.JWKSFile)
+		if err != nil {
+			return nil, err
+		}
+
+		auth.providers = append(auth.providers, jwtAuthProvider{keys: keys, config: authConfig.JWT})
+	}
+
+	return auth, nil
+}
+
+func (auth *Authenticator) enabled() bool {
+	return len(auth.providers) > 0
+}
+
+func (auth *Authenticator) authenticate(r *http.Request) (*Identity, error) {
+	for _, provider := range auth.providers {
+		identity, err := provider.authenticate(r)
+		if err != nil || identity != nil {
+			return identity, err
+		}
+	}
+
+	// credentials none of the providers accepts, like an unknown API token
+	if r.Header.Get("Authorization") != "" || bearerToken(r) != "" {
+		return nil, fmt.Errorf("unknown or unsupported credentials: %w", errInvalidCredentials)
+	}
+
+	return nil, errNoCredentials
+}
+
+// middleware rejects the requests that are not authenticated, except the health checks,
+// which are used by the orchestrators, and are only authenticated when they hold valid credentials.
+// The requests sent with invalid credentials are audited as failed logins.
+// The identity of the user, along with the permissions granted by its roles,
+// is stored in the context of the authenticated requests.
+func (auth *Authenticator) middleware(next http.Handler) http.Handler {
+	if !auth.enabled() {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity, err := auth.authenticate(r)
+
+		if r.URL.Path == "/health" || r.URL.Path == "/livez" || r.URL.Path == "/readyz" {
+			if err == nil {
+				identity.permissions = resolvePermissions(auth.roles, identity.Roles)
+				r = r.WithContext(context.WithValue(r.Context(), identityContextKey{}, identity))
+			}
+
+			next.ServeHTTP(w, r)
+
+			return
+		}
+
+		if err != nil {
+			printDebug(fmt.Sprintf("Rejected request to %s from %s: %v", r.URL.Path, r.RemoteAddr, err))
+
+			if errors.Is(err, errInvalidCredentials) {
+				auditLog.recordFailedLogin(r)
+			}
+
+			w.Header().Add("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", auth.realm))
+			w.Header().Add("WWW-Authenticate", fmt.Sprintf("Bearer realm=%q", auth.realm))
+			prettier(w, "Unauthorized", nil, http.StatusUnauthorized)
+
+			return
+		}
+
+		identity.permissions = resolvePermissions(auth.roles, identity.Roles)
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityContextKey{}, identity)))
+	})
+}
+
+// bearerToken returns the bearer token of the request.
+// As the browsers can't set the headers of the WebSocket and EventSource requests,
+// the token of the events streams can also be given with the 'access_token' query parameter.
+// It isn't accepted on the other routes, where it would end up in the logs, the history and the referrers.
+func bearerToken(r *http.Request) string {
+	if header := r.Header.Get("Authorization"); header != "" {
+		if scheme, token, found := strings.Cut(header, " "); found && strings.EqualFold(scheme, "Bearer") {
+			return strings.TrimSpace(token)
+		}
+
+		return ""
+	}
+
+	if r.URL.Path != "/ws" && r.URL.Path != "/events" {
+		return ""
+	}
+
+	return r.URL.Query().Get("access_token")
+}
+
+// printPasswordHash prints the bcrypt hash of the password read from the first line of the reader.
+func printPasswordHash(reader io.Reader) error {
+	password, err := bufio.NewReader(reader).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("failed to read password: %w", err)
+	}
+
+	password = strings.TrimRight(password, "\r\n")
+	if password == "" {
+		return errors.New("empty password")
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("failed to hash password: %w", err)
+	}
+
+	fmt.Println(string(hash)) //nolint:forbidigo
+
+	return nil
+}
+
+type basicAuthProvider struct {
+	// users is indexed by username
+	users     map[string]AuthUser
+	dummyHash []byte
+}
+
+func (provider basicAuthProvider) authenticate(r *http.Request) (*Identity, error) {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, nil //nolint:nilnil
+	}
+
+	hash := provider.dummyHash
+
+	user, found := provider.users[username]
+	if found {
+		hash = []byte(user.PasswordHash)
+	}
+
+	if err := bcrypt.CompareHashAndPassword(hash, []byte(password)); err != nil || !found {
+		return nil, fmt.Errorf("user %q: %w", username, errInvalidCredentials)
+	}
+
+	return &Identity{Name: username, Provider: authProviderBasic, Roles: user.Roles}, nil
+}
+
+type tokenAuthProvider struct {
+	// tokens is indexed by the hash of the tokens
+	tokens map[[sha256.Size]byte]APIToken
+}
+
+func (provider tokenAuthProvider) authenticate(r *http.Request) (*Identity, error) {
+	token := bearerToken(r)
+	if token == "" {
+		return nil, nil //nolint:nilnil
+	}
+
+	hash := sha256.Sum256([]byte(token))
+
+	for tokenHash, apiToken := range provider.tokens {
+		if subtle.ConstantTimeCompare(hash[:], tokenHash[:]) == 1 {
+			return &Identity{Name: apiToken.Name, Provider: authProviderToken, Roles: apiToken.Roles}, nil
+		}
+	}
+
+	// the token may be a JWT checked by another provider
+	return nil, nil //nolint:nilnil
+}
+
+type jwtAuthProvider struct {
+	keys   map[string]crypto.PublicKey
+	config JWTConfig
+}
+
+func (provider jwtAuthProvider) authenticate(r *http.Request) (*Identity, error) {
+	rawToken := bearerToken(r)
+	if rawToken == "" {
+		return nil, nil //nolint:nilnil
+	}
+
+	options := []jwt.ParserOption{
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}),
+		jwt.WithExpirationRequired(),
+	}
+
+	if provider.config.Issuer != "" {
+		options = append(options, jwt.WithIssuer(provider.config.Issuer))
+	}
+
+	if provider.config.Audience != "" {
+		options = append(options, jwt.WithAudience(provider.config.Audience))
+	}
+
+	claims := jwt.MapClaims{}
+
+	_, err := jwt.ParseWithClaims(rawToken, claims, provider.keyFunc, options...)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errInvalidCredentials, err)
+	}
+
+	name, _ := claims[provider.config.UsernameClaim].(string)
+	if name == "" {
+		return nil, fmt.Errorf("%w: no %q claim in token", errInvalidCredentials, provider.config.UsernameClaim)
+	}
+
+	return &Identity{Name: name, Provider: authProviderJWT, Roles: rolesFromClaim(claims[provider.config.RolesClaim]), Claims: claims}, nil
+}
+
+// rolesFromClaim returns the role names held by the claim, which can be a single name or a list of names.
+func rolesFromClaim(claim any) []string {
+	switch value := claim.(type) {
+	case string:
+		return []string{value}
+	case []any:
+		roles := make([]string, 0, len(value))
+
+		for _, role := range value {
+			if name, ok := role.(string); ok {
+				roles = append(roles, name)
+			}
+		}
+
+		return roles
+	default:
+		return nil
+	}
+}
+
+func (provider jwtAuthProvider) keyFunc(token *jwt.Token) (any, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	if key, found := provider.keys[kid]; found {
+		return key, nil
+	}
+
+	// a token without key id can be checked when there is only one key
+	if kid == "" && len(provider.keys) == 1 {
+		for _, key := range provider.keys {
+			return key, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unknown key %q", kid)
+}
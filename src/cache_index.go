@@ -0,0 +1,408 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+const cacheIndexFilename = "index.db"
+
+const (
+	fileKindGeonames     = "geonames"
+	fileKindLocalization = "localization"
+	fileKindFeatures     = "features"
+	fileKindAdditional   = "additional"
+)
+
+//nolint:gochecknoglobals
+var (
+	indexFilesBucket = []byte("files")
+	indexLinksBucket = []byte("links")
+	indexPinsBucket  = []byte("pins")
+	// indexEvictedBucket holds the last modification date of the evicted images, by S3 key
+	indexEvictedBucket = []byte("evicted")
+)
+
+// CacheIndex persists the content of the caches on disk,
+// so that their state can be restored after a restart.
+type CacheIndex struct {
+	db *bbolt.DB
+}
+
+// indexedImage is the persisted form of an S3Image.
+type indexedImage struct {
+	S3Key        string    `json:"s3Key"`
+	ETag         string    `json:"etag"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"lastModified"`
+	Expiry       time.Time `json:"expiry"`
+}
+
+// indexedFile is the persisted form of a metadata file,
+// holding its parsed content according to its kind.
+type indexedFile struct {
+	Kind         string        `json:"kind"`
+	TargetImg    string        `json:"targetImg"`
+	ETag         string        `json:"etag"`
+	LastModified time.Time     `json:"lastModified"`
+	Geonames     *Geonames     `json:"geonames,omitempty"`
+	Localization *Localization `json:"localization,omitempty"`
+	Features     *Features     `json:"features,omitempty"`
+}
+
+func openCacheIndex(baseCacheDir string) (*CacheIndex, error) {
+	err := os.MkdirAll(baseCacheDir, 0750)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cache directory: %w", err)
+	}
+
+	db, err := bbolt.Open(filepath.Join(baseCacheDir, cacheIndexFilename), 0600, &bbolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open cache index: %w", err)
+	}
+
+	err = db.Update(func(tx *bbolt.Tx) error {
+		for _, name := range [][]byte{[]byte(mainCacheDirName), []byte(thumbnailsCacheDirName), indexFilesBucket, indexLinksBucket, indexPinsBucket, indexEvictedBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err //nolint:wrapcheck
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		_ = db.Close()
+
+		return nil, fmt.Errorf("failed to initialize cache index: %w", err)
+	}
+
+	return &CacheIndex{db: db}, nil
+}
+
+func (index *CacheIndex) put(bucket []byte, key string, value any) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		printError(fmt.Errorf("failed to marshal cache index entry %q: %w", key, err), false)
+
+		return
+	}
+
+	err = index.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(bucket).Put([]byte(key), data) //nolint:wrapcheck
+	})
+	if err != nil {
+		printError(fmt.Errorf("failed to write cache index entry %q: %w", key, err), false)
+	}
+}
+
+func (index *CacheIndex) delete(bucket []byte, key string) {
+	err := index.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(bucket).Delete([]byte(key)) //nolint:wrapcheck
+	})
+	if err != nil {
+		printError(fmt.Errorf("failed to delete cache index entry %q: %w", key, err), false)
+	}
+}
+
+// forEach calls fn with every entry of the bucket. The entries for which fn returns false are deleted.
+func forEach[T any](index *CacheIndex, bucket []byte, fn func(key string, value T) (keep bool)) {
+	err := index.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(bucket)
+
+		var obsoleteKeys [][]byte
+
+		err := b.ForEach(func(k, v []byte) error {
+			var value T
+
+			if err := json.Unmarshal(v, &value); err != nil {
+				printWarn(fmt.Sprintf("Discarding invalid cache index entry %q: %v", k, err))
+
+				obsoleteKeys = append(obsoleteKeys, k)
+
+				return nil
+			}
+
+			if !fn(string(k), value) {
+				obsoleteKeys = append(obsoleteKeys, k)
+			}
+
+			return nil
+		})
+		if err != nil {
+			return err //nolint:wrapcheck
+		}
+
+		for _, k := range obsoleteKeys {
+			if err := b.Delete(k); err != nil {
+				return err //nolint:wrapcheck
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		printError(fmt.Errorf("failed to read cache index: %w", err), false)
+	}
+}
+
+func (index *CacheIndex) putImage(cache *ImageCache, img S3Image, expiry time.Time) {
+	index.put([]byte(cache.name), img.FormattedKey, indexedImage{
+		S3Key:        img.S3Key,
+		ETag:         img.ETag,
+		Size:         img.Size,
+		LastModified: img.LastModified,
+		Expiry:       expiry,
+	})
+}
+
+func (index *CacheIndex) deleteImage(cache *ImageCache, formattedKey string) {
+	index.delete([]byte(cache.name), formattedKey)
+}
+
+func (index *CacheIndex) putFile(formattedFilename string, file indexedFile) {
+	index.put(indexFilesBucket, formattedFilename, file)
+}
+
+func (index *CacheIndex) deleteFile(formattedFilename string) {
+	index.delete(indexFilesBucket, formattedFilename)
+}
+
+func (index *CacheIndex) putLinks(dir string, links []string) {
+	index.put(indexLinksBucket, dir, links)
+}
+
+func (index *CacheIndex) deleteLinks(dir string) {
+	index.delete(indexLinksBucket, dir)
+}
+
+// putPin persists the pin of the image of the main cache, with the time it was pinned.
+func (index *CacheIndex) putPin(formattedKey string) {
+	index.put(indexPinsBucket, formattedKey, time.Now())
+}
+
+func (index *CacheIndex) deletePin(formattedKey string) {
+	index.delete(indexPinsBucket, formattedKey)
+}
+
+func (index *CacheIndex) putEvicted(s3Key string, lastModified time.Time) {
+	index.put(indexEvictedBucket, s3Key, lastModified)
+}
+
+func (index *CacheIndex) deleteEvicted(s3Key string) {
+	index.delete(indexEvictedBucket, s3Key)
+}
+
+// contains returns whether the given file of the cache is indexed, as an image or as a metadata file.
+func (index *CacheIndex) contains(cacheName, formattedFilename string) bool {
+	var found bool
+
+	_ = index.db.View(func(tx *bbolt.Tx) error {
+		found = tx.Bucket([]byte(cacheName)).Get([]byte(formattedFilename)) != nil ||
+			tx.Bucket(indexFilesBucket).Get([]byte(formattedFilename)) != nil
+
+		return nil
+	})
+
+	return found
+}
+
+// fileETag returns the ETag of the S3 object of the given metadata file, or an empty string if it is unknown.
+func (index *CacheIndex) fileETag(formattedFilename string) string {
+	var file indexedFile
+
+	_ = index.db.View(func(tx *bbolt.Tx) error {
+		if data := tx.Bucket(indexFilesBucket).Get([]byte(formattedFilename)); data != nil {
+			_ = json.Unmarshal(data, &file)
+		}
+
+		return nil
+	})
+
+	return file.ETag
+}
+
+// clear removes all the entries of the index, except the pins.
+func (index *CacheIndex) clear() error {
+	return index.db.Update(func(tx *bbolt.Tx) error { //nolint:wrapcheck
+		for _, name := range [][]byte{[]byte(mainCacheDirName), []byte(thumbnailsCacheDirName), indexFilesBucket, indexLinksBucket, indexEvictedBucket} {
+			if err := tx.DeleteBucket(name); err != nil {
+				return err //nolint:wrapcheck
+			}
+
+			if _, err := tx.CreateBucket(name); err != nil {
+				return err //nolint:wrapcheck
+			}
+		}
+
+		return nil
+	})
+}
+
+func (index *CacheIndex) close() error {
+	return index.db.Close() //nolint:wrapcheck
+}
+
+// restoreImages completes the images found on disk with their indexed state,
+// and schedules their expiration. The images whose deadline has passed are removed,
+// along with the ones whose size doesn't match the indexed one, as they are corrupted.
+func (index *CacheIndex) restoreImages(cache *ImageCache) {
+	indexed := make(map[string]indexedImage)
+
+	forEach(index, []byte(cache.name), func(formattedKey string, img indexedImage) bool {
+		indexed[formattedKey] = img
+
+		return true
+	})
+
+	for _, img := range cache.snapshot() {
+		// the images that were on disk before the index existed expire according to their date
+		expiry := img.LastModified.Add(retentionPeriodOf(img.S3Key))
+
+		if entry, found := indexed[img.FormattedKey]; found {
+			delete(indexed, img.FormattedKey)
+
+			if entry.Size != img.Size {
+				printWarn(fmt.Sprintf("Removing corrupted image from cache: %s has %d bytes instead of %d", img.FormattedKey, img.Size, entry.Size))
+				removeCachedImage(cache, img.FormattedKey)
+
+				continue
+			}
+
+			img.ETag = entry.ETag
+			expiry = entry.Expiry
+		}
+
+		if time.Now().After(expiry) {
+			printDebug("Removing expired image from cache: ", img.FormattedKey)
+			removeCachedImage(cache, img.FormattedKey)
+
+			continue
+		}
+
+		cache.updateImage(img)
+		index.putImage(cache, img, expiry)
+		expiryScheduler.schedule(cache, img.FormattedKey, expiry)
+	}
+
+	// the remaining entries don't have their file on disk anymore
+	for formattedKey := range indexed {
+		index.deleteImage(cache, formattedKey)
+	}
+}
+
+// restoreFiles restores the metadata files caches and the product links.
+// It must be called after the images of the main cache have been restored,
+// since the files expire along with their image.
+func (index *CacheIndex) restoreFiles() {
+	forEach(index, indexFilesBucket, func(formattedFilename string, file indexedFile) bool {
+		if _, imgFound := mainCache.findImageByKey(file.TargetImg); !imgFound {
+			deleteFileFromCache(formattedFilename)
+
+			return false
+		}
+
+		if _, err := os.Stat(filepath.Join(config.mainCacheDir, formattedFilename)); err != nil {
+			return false
+		}
+
+		switch file.Kind {
+		case fileKindGeonames:
+			if file.Geonames == nil {
+				return false
+			}
+
+			geonames := *file.Geonames
+			geonames.lastUpdate = file.LastModified
+
+			mainCache.modifyImage(file.TargetImg, func(img *S3Image) {
+				img.AssociatedGeonames = &geonames
+			})
+
+			geonamesCacheMutex.Lock()
+			geonamesCache[formattedFilename] = geonames
+			geonamesCacheMutex.Unlock()
+		case fileKindLocalization:
+			if file.Localization == nil {
+				return false
+			}
+
+			localization := *file.Localization
+			localization.lastUpdate = file.LastModified
+
+			mainCache.modifyImage(file.TargetImg, func(img *S3Image) {
+				img.AssociatedLocalization = &localization
+			})
+
+			if img, found := mainCache.findImageByKey(file.TargetImg); found {
+				spatialIndex.update(img)
+			}
+
+			localizationCacheMutex.Lock()
+			localizationCache[formattedFilename] = localization
+			localizationCacheMutex.Unlock()
+		case fileKindFeatures:
+			if file.Features == nil {
+				return false
+			}
+
+			features := *file.Features
+			features.lastUpdate = file.LastModified
+
+			mainCache.modifyImage(file.TargetImg, func(img *S3Image) {
+				img.AssociatedFeatures = &features
+			})
+
+			featuresCacheMutex.Lock()
+			featuresCache[formattedFilename] = features
+			featuresCacheMutex.Unlock()
+		case fileKindAdditional:
+			additionalProductFilesCacheMutex.Lock()
+			additionalProductFilesCache[formattedFilename] = file.LastModified
+			additionalProductFilesCacheMutex.Unlock()
+		default:
+			return false
+		}
+
+		return true
+	})
+
+	forEach(index, indexLinksBucket, func(dir string, links []string) bool {
+		if imgType := inferImageType(dir); imgType == nil {
+			return false
+		}
+
+		fullProductLinksCacheMutex.Lock()
+		fullProductLinksCache[dir] = links
+		fullProductLinksCacheMutex.Unlock()
+
+		return true
+	})
+}
+
+// restorePins restores the pins of the images of the main cache.
+// It must be called after the images of the main cache have been restored.
+func (index *CacheIndex) restorePins() {
+	forEach(index, indexPinsBucket, func(formattedKey string, _ time.Time) bool {
+		if _, imgFound := mainCache.findImageByKey(formattedKey); !imgFound {
+			return false
+		}
+
+		diskQuota.pin(formattedKey)
+
+		return true
+	})
+}
+
+// restoreEvicted restores the evicted images, so that they are not downloaded again.
+func (index *CacheIndex) restoreEvicted() {
+	forEach(index, indexEvictedBucket, func(s3Key string, lastModified time.Time) bool {
+		diskQuota.restoreEvicted(s3Key, lastModified)
+
+		return true
+	})
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	encodingZstd = "zstd"
+	encodingGzip = "gzip"
+)
+
+//nolint:gochecknoglobals
+var (
+	gzipWriters = sync.Pool{New: func() any { return gzip.NewWriter(io.Discard) }}
+	zstdWriters = sync.Pool{New: func() any {
+		encoder, _ := zstd.NewWriter(io.Discard, zstd.WithEncoderConcurrency(1), zstd.WithLowerEncoderMem(true))
+
+		return encoder
+	}}
+)
+
+// negotiateEncoding returns the preferred encoding among the ones accepted by the client,
+// zstd being preferred over gzip when both have the same weight. It returns an empty string if none is accepted.
+func negotiateEncoding(acceptEncoding string) string {
+	weights := make(map[string]float64)
+
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		weight := 1.0
+
+		if q, found := strings.CutPrefix(strings.TrimSpace(params), "q="); found {
+			var err error
+			if weight, err = strconv.ParseFloat(q, 64); err != nil {
+				continue
+			}
+		}
+
+		weights[strings.ToLower(strings.TrimSpace(coding))] = weight
+	}
+
+	weightOf := func(coding string) float64 {
+		if weight, found := weights[coding]; found {
+			return weight
+		}
+
+		return weights["*"]
+	}
+
+	best, bestWeight := "", 0.0
+
+	for _, coding := range []string{encodingZstd, encodingGzip} {
+		if weight := weightOf(coding); weight > bestWeight {
+			best, bestWeight = coding, weight
+		}
+	}
+
+	return best
+}
+
+func isJSON(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+
+	return err == nil && (mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"))
+}
+
+// compressWriter compresses the JSON responses with the negotiated encoding.
+// The other responses, the partial ones and the ones already encoded are written as they are.
+type compressWriter struct {
+	http.ResponseWriter
+	// encoding is empty when the client doesn't accept any compression
+	encoding    string
+	encoder     io.WriteCloser
+	wroteHeader bool
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.wroteHeader {
+		return
+	}
+
+	cw.wroteHeader = true
+	header := cw.Header()
+
+	if !isJSON(header.Get("Content-Type")) || header.Get("Content-Encoding") != "" {
+		cw.ResponseWriter.WriteHeader(status)
+
+		return
+	}
+
+	header.Add("Vary", "Accept-Encoding")
+
+	if cw.encoding != "" && status == http.StatusOK {
+		header.Set("Content-Encoding", cw.encoding)
+		header.Del("Content-Length")
+
+		// the compressed content isn't byte-for-byte identical to the one the ETag was computed for
+		if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			header.Set("ETag", "W/"+etag)
+		}
+
+		switch cw.encoding {
+		case encodingZstd:
+			encoder := zstdWriters.Get().(*zstd.Encoder) //nolint:forcetypeassert
+			encoder.Reset(cw.ResponseWriter)
+			cw.encoder = encoder
+		case encodingGzip:
+			encoder := gzipWriters.Get().(*gzip.Writer) //nolint:forcetypeassert
+			encoder.Reset(cw.ResponseWriter)
+			cw.encoder = encoder
+		}
+	}
+
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *compressWriter) Write(data []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+
+	if cw.encoder != nil {
+		return cw.encoder.Write(data) //nolint:wrapcheck
+	}
+
+	return cw.ResponseWriter.Write(data) //nolint:wrapcheck
+}
+
+func (cw *compressWriter) Flush() {
+	if flusher, ok := cw.encoder.(interface{ Flush() error }); ok {
+		_ = flusher.Flush()
+	}
+
+	if flusher, ok := cw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap gives access to the underlying writer to http.ResponseController.
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// close ends the compressed stream, and puts the encoder back in its pool.
+func (cw *compressWriter) close() {
+	if cw.encoder == nil {
+		return
+	}
+
+	if err := cw.encoder.Close(); err != nil {
+		printDebug("Failed to end compressed response: ", err)
+	}
+
+	switch encoder := cw.encoder.(type) {
+	case *zstd.Encoder:
+		encoder.Reset(io.Discard)
+		zstdWriters.Put(encoder)
+	case *gzip.Writer:
+		encoder.Reset(io.Discard)
+		gzipWriters.Put(encoder)
+	}
+
+	cw.encoder = nil
+}
+
+// compressed compresses the JSON responses of next with gzip or zstd, according to the Accept-Encoding header.
+// The responses to the HEAD and range requests are not compressed, so that they match the uncompressed content.
+func compressed(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cw := &compressWriter{ResponseWriter: w}
+
+		if r.Method != http.MethodHead && r.Header.Get("Range") == "" {
+			cw.encoding = negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		}
+
+		defer cw.close()
+
+		next.ServeHTTP(cw, r)
+	})
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"cmp"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		acceptEncoding string
+		expected       string
+	}{
+		{acceptEncoding: "", expected: ""},
+		{acceptEncoding: "identity", expected: ""},
+		{acceptEncoding: "br", expected: ""},
+		{acceptEncoding: "gzip", expected: encodingGzip},
+		{acceptEncoding: "zstd", expected: encodingZstd},
+		{acceptEncoding: "gzip, deflate, br, zstd", expected: encodingZstd},
+		{acceptEncoding: "GZIP", expected: encodingGzip},
+		{acceptEncoding: "gzip;q=1.0, zstd;q=0.5", expected: encodingGzip},
+		{acceptEncoding: "gzip;q=0.5, zstd;q=0.5", expected: encodingZstd},
+		{acceptEncoding: "gzip ; q=0.8 , zstd ; q=0.9", expected: encodingZstd},
+		{acceptEncoding: "zstd;q=0, gzip", expected: encodingGzip},
+		{acceptEncoding: "gzip;q=0, zstd;q=0", expected: ""},
+		{acceptEncoding: "*", expected: encodingZstd},
+		{acceptEncoding: "*;q=0.5, zstd;q=0.1", expected: encodingGzip},
+		{acceptEncoding: "*, zstd;q=0", expected: encodingGzip},
+		{acceptEncoding: "*;q=0", expected: ""},
+		{acceptEncoding: "gzip;q=invalid", expected: ""},
+		{acceptEncoding: "zstd;q=invalid, gzip", expected: encodingGzip},
+	}
+
+	for _, test := range tests {
+		if encoding := negotiateEncoding(test.acceptEncoding); encoding != test.expected {
+			t.Errorf("%q: expected %q, got %q", test.acceptEncoding, test.expected, encoding)
+		}
+	}
+}
+
+func TestCompressed(t *testing.T) {
+	body := `{"message":"Images","data":` + strings.Repeat(`{"key":"my-prefix@TYPE1@DIR_a@preview.jpg"},`, 100) + `{}}`
+
+	tests := []struct {
+		name           string
+		method         string
+		acceptEncoding string
+		rangeHeader    string
+		contentType    string
+		status         int
+		encoding       string
+	}{
+		{name: "zstd", acceptEncoding: "gzip, zstd", contentType: "application/json", status: http.StatusOK, encoding: encodingZstd},
+		{name: "gzip", acceptEncoding: "gzip", contentType: "application/json; charset=utf-8", status: http.StatusOK, encoding: encodingGzip},
+		{name: "JSON suffix", acceptEncoding: "gzip", contentType: "application/geo+json", status: http.StatusOK, encoding: encodingGzip},
+		{name: "not accepted", contentType: "application/json", status: http.StatusOK},
+		{name: "not JSON", acceptEncoding: "gzip", contentType: "image/jpeg", status: http.StatusOK},
+		{name: "HEAD request", method: http.MethodHead, acceptEncoding: "gzip", contentType: "application/json", status: http.StatusOK},
+		{name: "range request", acceptEncoding: "gzip", rangeHeader: "bytes=0-9", contentType: "application/json", status: http.StatusOK},
+		{name: "error", acceptEncoding: "gzip", contentType: "application/json", status: http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			handler := compressed(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.Header().Set("Content-Type", test.contentType)
+				w.Header().Set("ETag", `"etag"`)
+				w.WriteHeader(test.status)
+				_, _ = io.WriteString(w, body)
+			}))
+
+			r := httptest.NewRequest(cmp.Or(test.method, http.MethodGet), "/api/v1/images", nil)
+			r.Header.Set("Accept-Encoding", test.acceptEncoding)
+
+			if test.rangeHeader != "" {
+				r.Header.Set("Range", test.rangeHeader)
+			}
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if encoding := w.Header().Get("Content-Encoding"); encoding != test.encoding {
+				t.Fatalf("expected the encoding %q, got %q", test.encoding, encoding)
+			}
+
+			var reader io.Reader = w.Body
+
+			switch test.encoding {
+			case encodingGzip:
+				gzipReader, err := gzip.NewReader(w.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				reader = gzipReader
+			case encodingZstd:
+				zstdReader, err := zstd.NewReader(w.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				defer zstdReader.Close()
+
+				reader = zstdReader
+			}
+
+			decoded, err := io.ReadAll(reader)
+			if err != nil || string(decoded) != body {
+				t.Errorf("the response body was altered (%v)", err)
+			}
+
+			if etag := w.Header().Get("ETag"); (test.encoding != "") != (etag == `W/"etag"`) {
+				t.Errorf("unexpected ETag %s", etag)
+			}
+		})
+	}
+}
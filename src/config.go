@@ -4,14 +4,17 @@ import (
 	_ "embed"
 	"errors"
 	"fmt"
+	"net/url"
 	"os"
 	"path/filepath"
 	"reflect"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
 
+	"golang.org/x/crypto/bcrypt"
 	"gopkg.in/yaml.v3"
 )
 
@@ -20,25 +23,72 @@ const (
 	thumbnailsCacheDirName = "thumbnails"
 )
 
+const (
+	backendS3    = "s3"
+	backendLocal = "local"
+)
+
 //go:embed resources/example_config.yml
 var defaultConfigFile string
 
 // S3Config is the directly related part of the global config.
 type S3Config struct {
+	// Backend is either backendS3 or backendLocal
+	Backend    string `yaml:"backend"`
+	LocalDir   string `yaml:"localDir"`
 	EndPoint   string `yaml:"endPoint"`
 	BucketName string `yaml:"bucketName"`
-	// KeyPrefix    string `yaml:"keyPrefix"`
+	// KeyPrefix restricts the listing and the notifications to the keys starting with it
+	KeyPrefix    string `yaml:"keyPrefix"`
 	AccessID     string `yaml:"accessId"`
 	AccessSecret string `yaml:"accessSecret"`
 	UseSSL       bool   `yaml:"useSSL"`
 }
 
+// BucketConfig is a source of images, with its own storage and image groups.
+type BucketConfig struct {
+	S3Config    `yaml:",inline"`
+	ImageGroups []ImageGroup `yaml:"imageGroups"`
+	imageTypes  []ImageType
+	store       ObjectStore
+	health      *bucketHealth
+}
+
+// name is used to identify the bucket in the logs and in the error messages.
+func (bucket *BucketConfig) name() string {
+	if bucket.Backend == backendLocal {
+		return bucket.LocalDir
+	}
+
+	return bucket.BucketName
+}
+
 type ImageType struct {
 	Name          string `json:"name"          yaml:"name"`
 	DisplayName   string `json:"displayName"   yaml:"displayName"`
 	ProductPrefix string `json:"productPrefix" yaml:"productPrefix"`
 	ProductRegexp string `json:"productRegexp" yaml:"productRegexp"`
-	productRegexp *regexp.Regexp
+	// RetentionPeriod overrides the global retention period for the images of this type
+	RetentionPeriod time.Duration `json:"retentionPeriod" yaml:"retentionPeriod"`
+	productRegexp   *regexp.Regexp
+	// group is the name of the group of the type
+	group string
+	// bucket is the index of the bucket of the type in config.Buckets
+	bucket int
+}
+
+// getBucket returns the bucket the images of this type are fetched from.
+func (imgType *ImageType) getBucket() *BucketConfig {
+	return &config.Buckets[imgType.bucket]
+}
+
+// getRetentionPeriod returns how long the images of this type are kept in the cache.
+func (imgType *ImageType) getRetentionPeriod() time.Duration {
+	if imgType.RetentionPeriod > 0 {
+		return imgType.RetentionPeriod
+	}
+
+	return config.RetentionPeriod
 }
 
 type ImageGroup struct {
@@ -46,8 +96,66 @@ type ImageGroup struct {
 	Types     []ImageType `yaml:"types"`
 }
 
+// AuthConfig configures the authentication of the web server clients.
+// The users, API tokens and JWT providers can be combined.
+type AuthConfig struct {
+	Enabled   bool       `yaml:"enabled"`
+	Realm     string     `yaml:"realm"`
+	Roles     []AuthRole `yaml:"roles"`
+	Users     []AuthUser `yaml:"users"`
+	APITokens []APIToken `yaml:"apiTokens"`
+	JWT       JWTConfig  `yaml:"jwt"`
+	// AllowedOrigins are the origins of the pages, besides the server itself, allowed to open a WebSocket
+	AllowedOrigins []string `yaml:"allowedOrigins"`
+}
+
+// AuditConfig configures the audit log of the administrative and data-access actions.
+type AuditConfig struct {
+	Enabled  bool   `yaml:"enabled"`
+	FilePath string `yaml:"filePath"`
+	// the file is rotated once it reaches MaxFileSizeMB, and the MaxBackups last rotated files are kept
+	MaxFileSizeMB int `yaml:"maxFileSizeMB"`
+	MaxBackups    int `yaml:"maxBackups"`
+}
+
+// AuthRole grants the rights to see the images of some groups, or to administrate them.
+// When no role is defined, all the authenticated users are administrators.
+type AuthRole struct {
+	Name string `yaml:"name"`
+	// Groups holds the names of the image groups, or allGroups
+	Groups []string `yaml:"groups"`
+	Admin  bool     `yaml:"admin"`
+}
+
+// AuthUser is a user authenticated with HTTP basic authentication.
+type AuthUser struct {
+	Username string `yaml:"username"`
+	// PasswordHash is the bcrypt hash of the password
+	PasswordHash string   `yaml:"passwordHash"`
+	Roles        []string `yaml:"roles"`
+}
+
+// APIToken is a static token sent as a bearer token.
+type APIToken struct {
+	Name  string   `yaml:"name"`
+	Token string   `yaml:"token"`
+	Roles []string `yaml:"roles"`
+}
+
+// JWTConfig configures the validation of the JWT sent as bearer tokens.
+type JWTConfig struct {
+	JWKSFile      string `yaml:"jwksFile"`
+	Issuer        string `yaml:"issuer"`
+	Audience      string `yaml:"audience"`
+	UsernameClaim string `yaml:"usernameClaim"`
+	// RolesClaim is the claim holding the names of the roles of the user
+	RolesClaim string `yaml:"rolesClaim"`
+}
+
 type Config struct {
-	S3 S3Config `yaml:"s3"`
+	// S3 and ImageGroups can be used instead of Buckets when there is only one bucket.
+	S3      S3Config       `yaml:"s3"`
+	Buckets []BucketConfig `yaml:"buckets"`
 
 	BasePath                     string `yaml:"basePath"`
 	WindowTitle                  string `yaml:"windowTitle"`
@@ -76,34 +184,63 @@ type Config struct {
 	HTTPTrace     bool                   `yaml:"httpTrace"`
 	ExitOnS3Error bool                   `yaml:"exitOnS3Error"`
 
-	BaseCacheDir          string `yaml:"cacheDir"`
-	mainCacheDir          string
-	thumbnailsCacheDir    string
-	RetentionPeriod       time.Duration `yaml:"retentionPeriod"`
-	MaxImagesDisplayCount int           `yaml:"maxImagesDisplayCount"`
-	PollingMode           bool          `yaml:"pollingMode"`
-	PollingPeriod         time.Duration `yaml:"pollingPeriod"`
-	WebServerPort         uint16        `yaml:"webServerPort"`
+	BaseCacheDir       string `yaml:"cacheDir"`
+	mainCacheDir       string
+	thumbnailsCacheDir string
+	RetentionPeriod    time.Duration `yaml:"retentionPeriod"`
+	// the least recently served images are evicted from the caches exceeding their maximum size, 0 meaning no limit
+	MainCacheMaxSizeMB       int64         `yaml:"mainCacheMaxSizeMB"`
+	ThumbnailsCacheMaxSizeMB int64         `yaml:"thumbnailsCacheMaxSizeMB"`
+	DownloadWorkers          int           `yaml:"downloadWorkers"`
+	DownloadRetries          int           `yaml:"downloadRetries"`
+	DownloadRetryDelay       time.Duration `yaml:"downloadRetryDelay"`
+	MaxImagesDisplayCount    int           `yaml:"maxImagesDisplayCount"`
+	PollingMode              bool          `yaml:"pollingMode"`
+	PollingPeriod            time.Duration `yaml:"pollingPeriod"`
+	// ShutdownTimeout is the time given to the downloads and to the requests to complete on shutdown
+	ShutdownTimeout time.Duration `yaml:"shutdownTimeout"`
+	EventBufferSize int           `yaml:"eventBufferSize"`
+	WebServerPort   uint16        `yaml:"webServerPort"`
+
+	Auth  AuthConfig  `yaml:"auth"`
+	Audit AuditConfig `yaml:"audit"`
 }
 
 var defaultConfig = Config{ //nolint:gochecknoglobals
 	S3: S3Config{
-		UseSSL: false,
+		Backend: backendS3,
+		UseSSL:  false,
 	},
 
 	BasePath:    "",
 	WindowTitle: "S3 Image Viewer",
 
-	LogLevel:      levelInfo,
-	ColorLogs:     false,
-	JSONLogFormat: false,
-	JSONLogFields: map[string]interface{}{},
-	HTTPTrace:     false,
-	ExitOnS3Error: false,
-	BaseCacheDir:  filepath.Join(os.TempDir(), defaultTempDirName),
-	PollingMode:   false,
-	PollingPeriod: 10 * time.Second,
-	WebServerPort: 9999,
+	LogLevel:           levelInfo,
+	ColorLogs:          false,
+	JSONLogFormat:      false,
+	JSONLogFields:      map[string]interface{}{},
+	HTTPTrace:          false,
+	ExitOnS3Error:      false,
+	BaseCacheDir:       filepath.Join(os.TempDir(), defaultTempDirName),
+	DownloadWorkers:    4,
+	DownloadRetries:    3,
+	DownloadRetryDelay: time.Second,
+	PollingMode:        false,
+	PollingPeriod:      10 * time.Second,
+	ShutdownTimeout:    30 * time.Second,
+	EventBufferSize:    256,
+	WebServerPort:      9999,
+	Auth: AuthConfig{
+		Realm: "S3 Image Server",
+		JWT: JWTConfig{
+			UsernameClaim: "sub",
+			RolesClaim:    "roles",
+		},
+	},
+	Audit: AuditConfig{
+		MaxFileSizeMB: 100,
+		MaxBackups:    10,
+	},
 }
 
 func (config *Config) loadDefaults() {
@@ -120,6 +257,12 @@ func (config *Config) loadDefaults() {
 		fieldValue := f.Interface()
 
 		switch fieldName {
+		case "Buckets":
+			for b := range config.Buckets {
+				if config.Buckets[b].Backend == "" {
+					config.Buckets[b].Backend = defaultConfig.S3.Backend
+				}
+			}
 		case "S3":
 		/*s3Config := fieldValue.(S3Config)
 		if s3Config.UseSSL == false {
@@ -141,60 +284,199 @@ func (config *Config) loadDefaults() {
 			if fieldValue.(string) == "" { //nolint: forcetypeassert
 				config.BaseCacheDir = defaultConfig.BaseCacheDir
 			}
+		case "DownloadWorkers":
+			if fieldValue.(int) < 1 { //nolint: forcetypeassert
+				config.DownloadWorkers = defaultConfig.DownloadWorkers
+			}
+		case "DownloadRetries":
+			if fieldValue.(int) < 0 { //nolint: forcetypeassert
+				config.DownloadRetries = defaultConfig.DownloadRetries
+			}
+		case "DownloadRetryDelay":
+			if fieldValue.(time.Duration) <= 0 { //nolint: forcetypeassert
+				config.DownloadRetryDelay = defaultConfig.DownloadRetryDelay
+			}
+		case "ShutdownTimeout":
+			if fieldValue.(time.Duration) <= 0 { //nolint: forcetypeassert
+				config.ShutdownTimeout = defaultConfig.ShutdownTimeout
+			}
+		case "EventBufferSize":
+			if fieldValue.(int) < 1 { //nolint: forcetypeassert
+				config.EventBufferSize = defaultConfig.EventBufferSize
+			}
 		case "WebServerPort":
 			if fieldValue.(uint16) == 0 { //nolint: forcetypeassert
 				config.WebServerPort = defaultConfig.WebServerPort
 			}
+		case "Auth":
+			if config.Auth.Realm == "" {
+				config.Auth.Realm = defaultConfig.Auth.Realm
+			}
+
+			if config.Auth.JWT.UsernameClaim == "" {
+				config.Auth.JWT.UsernameClaim = defaultConfig.Auth.JWT.UsernameClaim
+			}
+
+			if config.Auth.JWT.RolesClaim == "" {
+				config.Auth.JWT.RolesClaim = defaultConfig.Auth.JWT.RolesClaim
+			}
+		case "Audit":
+			if config.Audit.MaxFileSizeMB < 1 {
+				config.Audit.MaxFileSizeMB = defaultConfig.Audit.MaxFileSizeMB
+			}
+
+			if config.Audit.MaxBackups < 0 {
+				config.Audit.MaxBackups = defaultConfig.Audit.MaxBackups
+			}
 		}
 	}
 }
 
-func (config *Config) checkValidity() (ok bool, errs []string) {
-	if config.S3.EndPoint == "" {
-		errs = append(errs, "no s3 endpoint provided")
+func (bucket *BucketConfig) checkValidity(idx int) (errs []string) {
+	suffix := " for bucket n°" + strconv.Itoa(idx)
+
+	switch bucket.Backend {
+	case backendS3:
+		if bucket.EndPoint == "" {
+			errs = append(errs, "no s3 endpoint provided"+suffix)
+		}
+
+		if bucket.BucketName == "" {
+			errs = append(errs, "no s3 bucket name provided"+suffix)
+		}
+
+		if bucket.AccessID == "" {
+			errs = append(errs, "no s3 access id provided"+suffix)
+		}
+
+		if bucket.AccessSecret == "" {
+			errs = append(errs, "no s3 access secret provided"+suffix)
+		}
+	case backendLocal:
+		if bucket.LocalDir == "" {
+			errs = append(errs, "no local directory provided"+suffix)
+		}
+	default:
+		errs = append(errs, "invalid storage backend '"+bucket.Backend+"'"+suffix)
 	}
 
-	if config.S3.BucketName == "" {
-		errs = append(errs, "no s3 bucket name provided")
+	if len(bucket.ImageGroups) == 0 {
+		errs = append(errs, "no image group provided"+suffix)
 	}
 
-	if config.S3.AccessID == "" {
-		errs = append(errs, "no s3 access id provided")
+	return errs
+}
+
+func (auth *AuthConfig) checkValidity(groups []ImageGroup) (errs []string) {
+	if len(auth.Users) == 0 && len(auth.APITokens) == 0 && auth.JWT.JWKSFile == "" {
+		errs = append(errs, "authentication enabled without users, API tokens nor JWKS file")
 	}
 
-	if config.S3.AccessSecret == "" {
-		errs = append(errs, "no s3 access secret provided")
+	roles := make(map[string]struct{}, len(auth.Roles))
+
+	for i, role := range auth.Roles {
+		if role.Name == "" {
+			errs = append(errs, "no name provided for auth role n°"+strconv.Itoa(i))
+		} else if _, exists := roles[role.Name]; exists {
+			errs = append(errs, "auth role '"+role.Name+"' is defined multiple times")
+		}
+
+		roles[role.Name] = struct{}{}
+
+		for _, group := range role.Groups {
+			if group != allGroups && !slices.ContainsFunc(groups, func(g ImageGroup) bool { return g.GroupName == group }) {
+				errs = append(errs, "unknown image group '"+group+"' in auth role '"+role.Name+"'")
+			}
+		}
 	}
 
-	if len(config.ImageGroups) == 0 {
-		errs = append(errs, "no image group provided")
+	checkRoles := func(owner string, names []string) {
+		for _, name := range names {
+			if _, exists := roles[name]; !exists {
+				errs = append(errs, "unknown auth role '"+name+"' for "+owner)
+			}
+		}
 	}
 
-	imageTypes := make(map[string]struct{})
-	imagePaths := make(map[string]struct{})
+	for i, user := range auth.Users {
+		if user.Username == "" {
+			errs = append(errs, "no username provided for auth user n°"+strconv.Itoa(i))
+		}
 
-	for i, group := range config.ImageGroups {
-		if group.GroupName == "" {
-			errs = append(errs, "no name provided for group n°"+strconv.Itoa(i))
-			continue
+		if _, err := bcrypt.Cost([]byte(user.PasswordHash)); err != nil {
+			errs = append(errs, "invalid bcrypt password hash for auth user '"+user.Username+"'")
 		}
 
-		if len(group.Types) == 0 {
-			errs = append(errs, "no image type provided in group "+group.GroupName)
-			continue
+		checkRoles("auth user '"+user.Username+"'", user.Roles)
+	}
+
+	for i, token := range auth.APITokens {
+		if token.Name == "" || token.Token == "" {
+			errs = append(errs, "no name or token provided for API token n°"+strconv.Itoa(i))
+		}
+
+		checkRoles("API token '"+token.Name+"'", token.Roles)
+	}
+
+	for _, origin := range auth.AllowedOrigins {
+		if u, err := url.Parse(origin); err != nil || u.Scheme == "" || u.Host == "" || strings.TrimSuffix(u.Path, "/") != "" {
+			errs = append(errs, "invalid allowed origin '"+origin+"', expected scheme://host[:port]")
 		}
+	}
+
+	return errs
+}
 
-		for _, imageType := range group.Types {
-			if _, exists := imageTypes[imageType.Name]; exists {
-				errs = append(errs, "image type '"+imageType.Name+"' is present in multiple groups")
-			} else {
-				imageTypes[imageType.Name] = struct{}{}
+func (config *Config) checkValidity() (ok bool, errs []string) {
+	if len(config.Buckets) == 0 {
+		errs = append(errs, "no bucket provided")
+	}
+
+	// the image types and the cached files are not namespaced by bucket:
+	// the type names and the product prefixes are unique across all the buckets, mapped to the index of their bucket
+	imageTypes := make(map[string]int)
+	imagePaths := make(map[string]int)
+
+	for b, bucket := range config.Buckets {
+		errs = append(errs, bucket.checkValidity(b)...)
+
+		for i, group := range bucket.ImageGroups {
+			if group.GroupName == "" {
+				errs = append(errs, "no name provided for group n°"+strconv.Itoa(i)+" of bucket n°"+strconv.Itoa(b))
+				continue
+			}
+
+			if len(group.Types) == 0 {
+				errs = append(errs, "no image type provided in group "+group.GroupName)
+				continue
 			}
 
-			if _, exists := imagePaths[imageType.ProductPrefix]; exists {
-				errs = append(errs, "image path '"+imageType.ProductPrefix+"' is present in multiple groups")
-			} else {
-				imagePaths[imageType.ProductPrefix] = struct{}{}
+			for _, imageType := range group.Types {
+				if other, exists := imageTypes[imageType.Name]; !exists {
+					imageTypes[imageType.Name] = b
+				} else if other == b {
+					errs = append(errs, "image type '"+imageType.Name+"' is present in multiple groups")
+				} else {
+					errs = append(errs, "image type '"+imageType.Name+"' is present in buckets n°"+strconv.Itoa(other)+" and n°"+strconv.Itoa(b)+
+						", the image types must have distinct names across the buckets")
+				}
+
+				if other, exists := imagePaths[imageType.ProductPrefix]; !exists {
+					imagePaths[imageType.ProductPrefix] = b
+				} else if other == b {
+					errs = append(errs, "image path '"+imageType.ProductPrefix+"' is present in multiple groups")
+				} else {
+					errs = append(errs, "image path '"+imageType.ProductPrefix+"' is present in buckets n°"+strconv.Itoa(other)+" and n°"+strconv.Itoa(b)+
+						", the cached images are not separated by bucket so the product prefixes must be distinct across the buckets")
+				}
+
+				if !strings.HasPrefix(imageType.ProductPrefix, bucket.KeyPrefix) {
+					errs = append(errs, "image path '"+imageType.ProductPrefix+"' does not start with the key prefix of its bucket")
+				}
+
+				if imageType.RetentionPeriod < 0 {
+					errs = append(errs, "invalid retention period for image type '"+imageType.Name+"'")
+				}
 			}
 		}
 	}
@@ -211,10 +493,27 @@ func (config *Config) checkValidity() (ok bool, errs []string) {
 		errs = append(errs, "no retention period provided")
 	}
 
+	if config.MainCacheMaxSizeMB < 0 || config.ThumbnailsCacheMaxSizeMB < 0 {
+		errs = append(errs, "invalid maximum cache size")
+	}
+
 	if config.PollingMode && config.PollingPeriod == 0 {
 		errs = append(errs, "no polling period provided")
 	}
 
+	if config.Auth.Enabled {
+		var groups []ImageGroup
+		for _, bucket := range config.Buckets {
+			groups = append(groups, bucket.ImageGroups...)
+		}
+
+		errs = append(errs, config.Auth.checkValidity(groups)...)
+	}
+
+	if config.Audit.Enabled && config.Audit.FilePath == "" {
+		errs = append(errs, "no file path provided for the audit log")
+	}
+
 	return len(errs) == 0, errs
 }
 
@@ -235,6 +534,12 @@ func loadConfigFromFile(filePath string) (Config, error) {
 		return Config{}, err //nolint:wrapcheck
 	}
 
+	if len(cfg.Buckets) == 0 {
+		cfg.Buckets = []BucketConfig{{S3Config: cfg.S3, ImageGroups: cfg.ImageGroups}}
+	} else if cfg.S3 != (S3Config{}) || len(cfg.ImageGroups) > 0 {
+		return Config{}, errors.New("s3 and imageGroups can't be used along with buckets")
+	}
+
 	cfg.LogLevel = strings.ToLower(cfg.LogLevel)
 	cfg.loadDefaults()
 
@@ -257,20 +562,32 @@ func loadConfigFromFile(filePath string) (Config, error) {
 		}
 	}
 
-	for _, group := range cfg.ImageGroups {
-		for i := range group.Types {
-			imgType := group.Types[i]
-			if imgType.ProductRegexp == "" {
-				return Config{}, fmt.Errorf("no product regexp provided for type %q of group %q", imgType.Name, group.GroupName)
-			}
+	// the image groups of all the buckets are gathered to be displayed together
+	cfg.ImageGroups = nil
 
-			imgType.productRegexp, err = regexp.Compile(imgType.ProductRegexp)
-			if err != nil {
-				return Config{}, fmt.Errorf("invalid product regexp for type %q of group %q: %w", imgType.Name, group.GroupName, err)
-			}
+	for b := range cfg.Buckets {
+		bucket := &cfg.Buckets[b]
 
-			cfg.imageTypes = append(cfg.imageTypes, imgType)
+		for _, group := range bucket.ImageGroups {
+			for i := range group.Types {
+				imgType := group.Types[i]
+				if imgType.ProductRegexp == "" {
+					return Config{}, fmt.Errorf("no product regexp provided for type %q of group %q", imgType.Name, group.GroupName)
+				}
+
+				imgType.productRegexp, err = regexp.Compile(imgType.ProductRegexp)
+				if err != nil {
+					return Config{}, fmt.Errorf("invalid product regexp for type %q of group %q: %w", imgType.Name, group.GroupName, err)
+				}
+
+				imgType.group = group.GroupName
+				imgType.bucket = b
+				bucket.imageTypes = append(bucket.imageTypes, imgType)
+				cfg.imageTypes = append(cfg.imageTypes, imgType)
+			}
 		}
+
+		cfg.ImageGroups = append(cfg.ImageGroups, bucket.ImageGroups...)
 	}
 
 	cfg.mainCacheDir = filepath.Join(cfg.BaseCacheDir, mainCacheDirName)
@@ -280,9 +597,13 @@ func loadConfigFromFile(filePath string) (Config, error) {
 }
 
 func (config *Config) String() string {
-	result := "S3:\n"
-	s3 := config.S3
-	result += fmt.Sprintf("\tendPoint: %s\n\tbucketName: %s\n\taccessId: %s\n\taccessSecret: %s\n", s3.EndPoint, s3.BucketName, s3.AccessID, s3.AccessSecret)
+	result := "buckets:\n"
+	for _, bucket := range config.Buckets {
+		result += fmt.Sprintf("\tbackend: %s\n\tlocalDir: %s\n", bucket.Backend, bucket.LocalDir)
+		result += fmt.Sprintf("\tendPoint: %s\n\tbucketName: %s\n\tkeyPrefix: %s\n\taccessId: %s\n\taccessSecret: %s\n", bucket.EndPoint, bucket.BucketName, bucket.KeyPrefix, bucket.AccessID, bucket.AccessSecret)
+		result += "\timageGroups: " + joinStructs(bucket.ImageGroups, ", ", false) + "\n"
+	}
+
 	result += "basePath: " + config.BasePath + "\n"
 	result += "windowTitle: " + config.WindowTitle + "\n"
 	result += "scaleInitialPercentage: " + strconv.FormatUint(uint64(config.ScaleInitialPercentage), 10) + "\n"
@@ -297,9 +618,12 @@ func (config *Config) String() string {
 	result += "fullProductProtocol: " + config.FullProductProtocol + "\n"
 	result += "fullProductRootUrl: " + config.FullProductRootURL + "\n"
 	result += "fullProductSignedUrl: " + strconv.FormatBool(config.FullProductSignedURL) + "\n"
-	result += "imageGroups: " + joinStructs(config.ImageGroups, ", ", false) + "\n"
 	result += fmt.Sprintf("logLevel: %s\ncolorLogs: %v\njsonLogFormat: %v\njsonLogFields: %v\nhttpTrace: %v\nexitOnS3Error: %v\n", config.LogLevel, config.ColorLogs, config.JSONLogFormat, config.JSONLogFields, config.HTTPTrace, config.ExitOnS3Error)
-	result += fmt.Sprintf("cacheDir: %s\nretentionPeriod: %v\nmaxImagesDisplayCount: %d\npollingMode: %v\npollingPeriod: %v\nwebServerPort: %d\n", config.mainCacheDir, config.RetentionPeriod, config.MaxImagesDisplayCount, config.PollingMode, config.PollingPeriod, config.WebServerPort)
+	result += fmt.Sprintf("mainCacheMaxSizeMB: %d\nthumbnailsCacheMaxSizeMB: %d\n", config.MainCacheMaxSizeMB, config.ThumbnailsCacheMaxSizeMB)
+	result += fmt.Sprintf("downloadWorkers: %d\ndownloadRetries: %d\ndownloadRetryDelay: %v\n", config.DownloadWorkers, config.DownloadRetries, config.DownloadRetryDelay)
+	result += fmt.Sprintf("cacheDir: %s\nretentionPeriod: %v\nmaxImagesDisplayCount: %d\npollingMode: %v\npollingPeriod: %v\nshutdownTimeout: %v\neventBufferSize: %d\nwebServerPort: %d\n", config.mainCacheDir, config.RetentionPeriod, config.MaxImagesDisplayCount, config.PollingMode, config.PollingPeriod, config.ShutdownTimeout, config.EventBufferSize, config.WebServerPort)
+	result += fmt.Sprintf("auth: enabled: %v, realm: %s, roles: %d, users: %d, apiTokens: %d, jwksFile: %s, allowedOrigins: %v\n", config.Auth.Enabled, config.Auth.Realm, len(config.Auth.Roles), len(config.Auth.Users), len(config.Auth.APITokens), config.Auth.JWT.JWKSFile, config.Auth.AllowedOrigins)
+	result += fmt.Sprintf("audit: enabled: %v, filePath: %s, maxFileSizeMB: %d, maxBackups: %d\n", config.Audit.Enabled, config.Audit.FilePath, config.Audit.MaxFileSizeMB, config.Audit.MaxBackups)
 
 	return result
 }
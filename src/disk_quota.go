@@ -0,0 +1,422 @@
+package main
+
+import (
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CacheUsage is the disk usage of a cache directory, as reported by the API.
+type CacheUsage struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+	// MaxSize is 0 when the size of the cache is not limited
+	MaxSize   int64  `json:"max_size"`
+	Size      int64  `json:"size"`
+	Files     int    `json:"files"`
+	Images    int    `json:"images"`
+	Pinned    int    `json:"pinned"`
+	Evictions uint64 `json:"evictions"`
+}
+
+// cachedFile is a file of a cache directory, lastUsed being the time it was downloaded or last served.
+type cachedFile struct {
+	size     int64
+	lastUsed time.Time
+}
+
+// cacheUsage tracks the files of a cache directory.
+type cacheUsage struct {
+	name      string
+	maxSize   int64
+	size      int64
+	files     map[string]*cachedFile
+	evictions uint64
+}
+
+func (usage *cacheUsage) overQuota() bool {
+	return usage.maxSize > 0 && usage.size > usage.maxSize
+}
+
+// evictionCandidate is an image that can be evicted, with its last use.
+type evictionCandidate struct {
+	img      S3Image
+	lastUsed time.Time
+}
+
+// DiskQuota bounds the disk usage of the cache directories: once a cache exceeds its maximum size,
+// its least recently served images are evicted, along with the metadata files of their product.
+// The pinned images are never evicted, they are only removed at the end of their retention period.
+type DiskQuota struct {
+	mutex  sync.Mutex
+	usages map[string]*cacheUsage
+	// pinned holds the formatted keys of the pinned images of the main cache
+	pinned map[string]struct{}
+	// evicted holds the last modification date of the evicted images by S3 key,
+	// so that they are not downloaded again by the next polls, nor after a restart
+	evicted map[string]time.Time
+	// wakeup is notified when a cache exceeds its maximum size
+	wakeup    chan struct{}
+	eventChan chan event
+}
+
+func newDiskQuota(eventChan chan event) *DiskQuota {
+	quota := &DiskQuota{
+		usages:    make(map[string]*cacheUsage),
+		pinned:    make(map[string]struct{}),
+		evicted:   make(map[string]time.Time),
+		wakeup:    make(chan struct{}, 1),
+		eventChan: eventChan,
+	}
+
+	for name, maxSizeMB := range map[string]int64{
+		mainCacheDirName:       config.MainCacheMaxSizeMB,
+		thumbnailsCacheDirName: config.ThumbnailsCacheMaxSizeMB,
+	} {
+		quota.usages[name] = &cacheUsage{name: name, maxSize: maxSizeMB * 1024 * 1024, files: make(map[string]*cachedFile)}
+	}
+
+	return quota
+}
+
+func (quota *DiskQuota) notify() {
+	select {
+	case quota.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// fileAdded records the file written in the cache directory, replacing the previous one having the same name.
+func (quota *DiskQuota) fileAdded(dir, filename string, size int64, lastUsed time.Time) {
+	quota.mutex.Lock()
+	defer quota.mutex.Unlock()
+
+	usage, found := quota.usages[filepath.Base(dir)]
+	if !found {
+		return
+	}
+
+	if file, found := usage.files[filename]; found {
+		usage.size -= file.size
+	}
+
+	usage.files[filename] = &cachedFile{size: size, lastUsed: lastUsed}
+	usage.size += size
+
+	if usage.overQuota() {
+		quota.notify()
+	}
+}
+
+func (quota *DiskQuota) fileRemoved(dir, filename string) {
+	quota.mutex.Lock()
+	defer quota.mutex.Unlock()
+
+	usage, found := quota.usages[filepath.Base(dir)]
+	if !found {
+		return
+	}
+
+	if file, found := usage.files[filename]; found {
+		usage.size -= file.size
+		delete(usage.files, filename)
+	}
+}
+
+// served marks the file of the cache directory as recently used.
+func (quota *DiskQuota) served(dir, filename string) {
+	quota.mutex.Lock()
+	defer quota.mutex.Unlock()
+
+	if usage, found := quota.usages[filepath.Base(dir)]; found {
+		if file, found := usage.files[filename]; found {
+			file.lastUsed = time.Now()
+		}
+	}
+}
+
+// clear forgets the files of the caches and the evicted images, the pins are kept.
+func (quota *DiskQuota) clear() {
+	quota.mutex.Lock()
+	defer quota.mutex.Unlock()
+
+	for _, usage := range quota.usages {
+		usage.size = 0
+		usage.files = make(map[string]*cachedFile)
+	}
+
+	quota.evicted = make(map[string]time.Time)
+}
+
+func (quota *DiskQuota) pin(formattedKey string) {
+	quota.mutex.Lock()
+	quota.pinned[formattedKey] = struct{}{}
+	quota.mutex.Unlock()
+}
+
+// unpin removes the pin of the image, and returns whether it was pinned.
+func (quota *DiskQuota) unpin(formattedKey string) bool {
+	quota.mutex.Lock()
+	defer quota.mutex.Unlock()
+
+	_, found := quota.pinned[formattedKey]
+	delete(quota.pinned, formattedKey)
+
+	// the image may exceed the quota, now that it can be evicted
+	quota.notify()
+
+	return found
+}
+
+// pins returns the formatted keys of the pinned images, sorted.
+func (quota *DiskQuota) pins() []string {
+	quota.mutex.Lock()
+	pins := make([]string, 0, len(quota.pinned))
+
+	for formattedKey := range quota.pinned {
+		pins = append(pins, formattedKey)
+	}
+	quota.mutex.Unlock()
+
+	slices.Sort(pins)
+
+	return pins
+}
+
+// wasEvicted returns whether the object is an image that was evicted, and hasn't been modified since.
+func (quota *DiskQuota) wasEvicted(obj ObjectInfo) bool {
+	quota.mutex.Lock()
+	defer quota.mutex.Unlock()
+
+	lastModified, found := quota.evicted[obj.Key]
+
+	return found && lastModified.Equal(obj.LastModified)
+}
+
+func (quota *DiskQuota) restoreEvicted(s3Key string, lastModified time.Time) {
+	quota.mutex.Lock()
+	quota.evicted[s3Key] = lastModified
+	quota.mutex.Unlock()
+}
+
+// pruneEvicted forgets the evicted images that would have expired by now.
+func (quota *DiskQuota) pruneEvicted() {
+	var pruned []string
+
+	quota.mutex.Lock()
+	for s3Key, lastModified := range quota.evicted {
+		if lastModified.Add(retentionPeriodOf(s3Key)).Before(time.Now()) {
+			delete(quota.evicted, s3Key)
+			pruned = append(pruned, s3Key)
+		}
+	}
+	quota.mutex.Unlock()
+
+	for _, s3Key := range pruned {
+		cacheIndex.deleteEvicted(s3Key)
+	}
+}
+
+// evictionCandidates returns the images of the cache that can be evicted, from the least recently used.
+// In the main cache, the metadata files of the product of an image are evicted along with it.
+// The quota must be locked.
+func (quota *DiskQuota) evictionCandidates(usage *cacheUsage, images []S3Image) []evictionCandidate {
+	groupOf := func(filename string) string {
+		if usage.name == mainCacheDirName {
+			return filename[:strings.LastIndex(filename, "@")+1]
+		}
+
+		return filename
+	}
+
+	// the last use of an image is the last use of any of the files removed along with it
+	lastUses := make(map[string]time.Time)
+
+	for filename, file := range usage.files {
+		if group := groupOf(filename); file.lastUsed.After(lastUses[group]) {
+			lastUses[group] = file.lastUsed
+		}
+	}
+
+	candidates := make([]evictionCandidate, 0, len(images))
+
+	for _, img := range images {
+		if _, pinned := quota.pinned[img.FormattedKey]; pinned && usage.name == mainCacheDirName {
+			continue
+		}
+
+		if lastUsed, found := lastUses[groupOf(img.FormattedKey)]; found {
+			candidates = append(candidates, evictionCandidate{img: img, lastUsed: lastUsed})
+		}
+	}
+
+	slices.SortFunc(candidates, func(a, b evictionCandidate) int {
+		return a.lastUsed.Compare(b.lastUsed)
+	})
+
+	return candidates
+}
+
+// enforce evicts the least recently used images of the cache until it fits its maximum size.
+func (quota *DiskQuota) enforce(cache *ImageCache) {
+	images := cache.snapshot()
+
+	quota.mutex.Lock()
+	usage := quota.usages[cache.name]
+
+	if !usage.overQuota() {
+		quota.mutex.Unlock()
+
+		return
+	}
+
+	candidates := quota.evictionCandidates(usage, images)
+	quota.mutex.Unlock()
+
+	for _, candidate := range candidates {
+		quota.mutex.Lock()
+		overQuota := usage.overQuota()
+		quota.mutex.Unlock()
+
+		if !overQuota {
+			return
+		}
+
+		quota.evict(cache, candidate.img)
+	}
+
+	quota.mutex.Lock()
+	overQuota := usage.overQuota()
+	quota.mutex.Unlock()
+
+	if overQuota {
+		printWarn("The ", cache.name, " cache exceeds its maximum size, but its remaining images are pinned")
+	}
+}
+
+func (quota *DiskQuota) evict(cache *ImageCache, img S3Image) {
+	printDebug("Evicting image ", img.FormattedKey, " from the ", cache.name, " cache")
+
+	quota.mutex.Lock()
+	quota.usages[cache.name].evictions++
+
+	if cache == mainCache {
+		quota.evicted[img.S3Key] = img.LastModified
+	}
+	quota.mutex.Unlock()
+
+	if cache == mainCache {
+		cacheIndex.putEvicted(img.S3Key, img.LastModified)
+	}
+
+	cacheEvictionsTotal.WithLabelValues(cache.name).Inc()
+	expiryScheduler.cancel(cache, img.FormattedKey)
+	removeCachedImage(cache, img.FormattedKey)
+
+	if cache == mainCache && quota.eventChan != nil {
+		quota.eventChan <- event{EventType: eventRemove, EventObj: EventObject{ImgKey: img.FormattedKey}, source: "diskQuota"}
+	}
+}
+
+// run evicts the images of the caches exceeding their maximum size, whenever files are added. It never returns.
+func (quota *DiskQuota) run() {
+	for {
+		quota.enforce(mainCache)
+		quota.enforce(thumbnailsCache)
+		quota.pruneEvicted()
+
+		<-quota.wakeup
+	}
+}
+
+// usage returns the disk usage of the caches.
+func (quota *DiskQuota) usage() []CacheUsage {
+	result := make([]CacheUsage, 0, 2)
+
+	for _, cache := range []*ImageCache{mainCache, thumbnailsCache} {
+		images := cache.count()
+
+		quota.mutex.Lock()
+		usage := quota.usages[cache.name]
+		cacheUsage := CacheUsage{
+			Name:      cache.name,
+			Path:      cache.pathOnDisk,
+			MaxSize:   usage.maxSize,
+			Size:      usage.size,
+			Files:     len(usage.files),
+			Images:    images,
+			Evictions: usage.evictions,
+		}
+
+		if cache == mainCache {
+			cacheUsage.Pinned = len(quota.pinned)
+		}
+		quota.mutex.Unlock()
+
+		result = append(result, cacheUsage)
+	}
+
+	return result
+}
+
+// cacheUsageHandler reports the disk usage of the caches.
+func cacheUsageHandler(w http.ResponseWriter, _ *http.Request) {
+	prettier(w, "Cache usage", diskQuota.usage(), http.StatusOK)
+}
+
+// pinsHandler lists the pinned images (GET /api/v1/cache/pins/), pins an image (PUT /api/v1/cache/pins/<img_key>)
+// or unpins it (DELETE /api/v1/cache/pins/<img_key>).
+// The users can only see and change the pins of the images of the groups they administrate.
+func pinsHandler(w http.ResponseWriter, r *http.Request) {
+	identity := identityFromRequest(r)
+	imgKey := strings.TrimPrefix(r.URL.Path, "/api/v1/cache/pins/")
+
+	if imgKey == "" {
+		if r.Method != http.MethodGet {
+			prettier(w, "Method not allowed", nil, http.StatusMethodNotAllowed)
+
+			return
+		}
+
+		pins := slices.DeleteFunc(diskQuota.pins(), func(formattedKey string) bool {
+			imgType := inferImageType(formattedKey)
+
+			return imgType == nil || !identity.canAdministrateGroup(imgType.group)
+		})
+
+		prettier(w, "Pinned images", pins, http.StatusOK)
+
+		return
+	}
+
+	img, found := mainCache.findImageByKey(imgKey)
+	if !found || img.Type == nil || !identity.canViewType(img.Type) {
+		prettier(w, "Image not found !", nil, http.StatusNotFound)
+
+		return
+	}
+
+	if !identity.canAdministrateGroup(img.Type.group) {
+		prettier(w, "Forbidden", nil, http.StatusForbidden)
+
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		diskQuota.pin(img.FormattedKey)
+		cacheIndex.putPin(img.FormattedKey)
+		prettier(w, "Image pinned", nil, http.StatusOK)
+	case http.MethodDelete:
+		if diskQuota.unpin(img.FormattedKey) {
+			cacheIndex.deletePin(img.FormattedKey)
+		}
+
+		prettier(w, "Image unpinned", nil, http.StatusOK)
+	default:
+		prettier(w, "Method not allowed", nil, http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"  //nolint:gosec
+	"crypto/sha1" //nolint:gosec
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// downloadTempSuffix ends the names of the files being downloaded, before they are renamed into place.
+const downloadTempSuffix = ".part"
+
+// minioTempSuffix ends the names of the partial files left by the previous versions, which used FGetObject.
+const minioTempSuffix = ".part.minio"
+
+var errCorruptedDownload = errors.New("corrupted download")
+
+// md5ETagRegexp matches the ETags of the objects uploaded in a single part.
+// They are the MD5 of the object content, unless the object is encrypted on the server side,
+// where they look the same but are computed otherwise.
+var md5ETagRegexp = regexp.MustCompile(`^[0-9a-fA-F]{32}$`)
+
+// checksumVerifier checks the content of an object against the checksum announced by its store.
+type checksumVerifier struct {
+	algorithm string
+	hash      hash.Hash
+	expected  []byte
+}
+
+// newChecksumVerifier returns the verifier of the strongest checksum of the object,
+// or nil if the object has none that can be verified.
+func newChecksumVerifier(info ObjectInfo) *checksumVerifier {
+	s3Checksums := []struct {
+		algorithm string
+		value     string
+		newHash   func() hash.Hash
+	}{
+		{"SHA256", info.ChecksumSHA256, sha256.New},
+		{"CRC32C", info.ChecksumCRC32C, func() hash.Hash { return crc32.New(crc32.MakeTable(crc32.Castagnoli)) }},
+		{"SHA1", info.ChecksumSHA1, sha1.New},
+		{"CRC32", info.ChecksumCRC32, func() hash.Hash { return crc32.NewIEEE() }},
+	}
+
+	for _, checksum := range s3Checksums {
+		// the checksums of the multipart uploads are checksums of the checksums of their parts
+		if checksum.value == "" || strings.Contains(checksum.value, "-") {
+			continue
+		}
+
+		expected, err := base64.StdEncoding.DecodeString(checksum.value)
+		if err != nil {
+			continue
+		}
+
+		return &checksumVerifier{algorithm: checksum.algorithm, hash: checksum.newHash(), expected: expected}
+	}
+
+	etag := strings.Trim(info.ETag, `"`)
+	if !info.Encrypted && md5ETagRegexp.MatchString(etag) {
+		expected, _ := hex.DecodeString(etag)
+
+		return &checksumVerifier{algorithm: "MD5", hash: md5.New(), expected: expected} //nolint:gosec
+	}
+
+	return nil
+}
+
+func (verifier *checksumVerifier) verify() error {
+	if actual := verifier.hash.Sum(nil); !bytes.Equal(actual, verifier.expected) {
+		return fmt.Errorf("%w: %s checksum mismatch, expected %x, got %x", errCorruptedDownload, verifier.algorithm, verifier.expected, actual)
+	}
+
+	return nil
+}
+
+// downloadFile downloads the object to a temporary file next to the given path,
+// and renames it into place once its size and checksum have been verified,
+// so that the file at the given path is never partially written.
+func downloadFile(ctx context.Context, store ObjectStore, objKey, filePath string) error {
+	body, info, err := store.OpenObject(ctx, objKey)
+	if err != nil {
+		return err //nolint:wrapcheck
+	}
+
+	defer body.Close()
+
+	tmpFile, err := os.CreateTemp(filepath.Dir(filePath), "."+filepath.Base(filePath)+".*"+downloadTempSuffix)
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+
+	tmpPath := tmpFile.Name()
+
+	renamed := false
+	defer func() {
+		if !renamed {
+			_ = os.Remove(tmpPath)
+		}
+	}()
+
+	var writer io.Writer = tmpFile
+
+	verifier := newChecksumVerifier(info)
+	if verifier != nil {
+		writer = io.MultiWriter(tmpFile, verifier.hash)
+	}
+
+	size, err := io.Copy(writer, body)
+	if err == nil {
+		// CreateTemp restricts the file to its owner, the cached files are readable as before
+		err = tmpFile.Chmod(0o644) //nolint:gosec
+	}
+
+	if err == nil {
+		// the content must be on disk before the file is renamed, in case of crash
+		err = tmpFile.Sync()
+	}
+
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to write %q: %w", objKey, err)
+	}
+
+	if info.Size >= 0 && size != info.Size {
+		s3ChecksumMismatches.Inc()
+
+		return fmt.Errorf("%w: %q has %d bytes instead of %d", errCorruptedDownload, objKey, size, info.Size)
+	}
+
+	if verifier != nil {
+		if err = verifier.verify(); err != nil {
+			s3ChecksumMismatches.Inc()
+
+			return fmt.Errorf("%q: %w", objKey, err)
+		}
+	}
+
+	// the cached file is served with the date of the S3 object as Last-Modified
+	if !info.LastModified.IsZero() {
+		if err = os.Chtimes(tmpPath, info.LastModified, info.LastModified); err != nil {
+			return fmt.Errorf("failed to date %q: %w", objKey, err)
+		}
+	}
+
+	if err = os.Rename(tmpPath, filePath); err != nil {
+		return fmt.Errorf("failed to move %q into place: %w", objKey, err)
+	}
+
+	renamed = true
+
+	return nil
+}
+
+// isTempDownload returns whether the file is a partial download.
+func isTempDownload(filename string) bool {
+	return strings.HasSuffix(filename, downloadTempSuffix) || strings.HasSuffix(filename, minioTempSuffix)
+}
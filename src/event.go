@@ -37,6 +37,8 @@ type EventFeatures struct {
 }
 
 type event struct {
+	// ID is the sequence number of the event, set by the hub when it is broadcast
+	ID        uint64 `json:"event_id"`
 	EventType string `json:"event_type"`
 	EventObj  any    `json:"event_obj"`
 	EventDate string `json:"event_date"`
@@ -0,0 +1,44 @@
+package main
+
+// eventRing is a fixed-size circular buffer holding the last messages broadcast by the hub.
+type eventRing struct {
+	messages []hubMessage
+	// start is the index of the oldest message
+	start int
+	count int
+}
+
+func newEventRing(size int) *eventRing {
+	return &eventRing{messages: make([]hubMessage, max(size, 1))}
+}
+
+// push adds the message to the buffer, overwriting the oldest one when it is full.
+func (ring *eventRing) push(msg hubMessage) {
+	if ring.count < len(ring.messages) {
+		ring.messages[(ring.start+ring.count)%len(ring.messages)] = msg
+		ring.count++
+
+		return
+	}
+
+	ring.messages[ring.start] = msg
+	ring.start = (ring.start + 1) % len(ring.messages)
+}
+
+// since returns the messages following the one with the given id, the oldest first.
+// It returns false if some of them have already been overwritten.
+func (ring *eventRing) since(id uint64) ([]hubMessage, bool) {
+	if ring.count == 0 || ring.messages[ring.start].id > id+1 {
+		return nil, false
+	}
+
+	var result []hubMessage
+
+	for i := range ring.count {
+		if msg := ring.messages[(ring.start+i)%len(ring.messages)]; msg.id > id {
+			result = append(result, msg)
+		}
+	}
+
+	return result, true
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestEventRingSince(t *testing.T) {
+	tests := []struct {
+		name     string
+		size     int
+		pushed   []uint64
+		since    uint64
+		expected []uint64
+		ok       bool
+	}{
+		{name: "empty", size: 3, pushed: nil, since: 0, ok: false},
+		{name: "up to date", size: 3, pushed: []uint64{1, 2}, since: 2, expected: nil, ok: true},
+		{name: "missed some", size: 3, pushed: []uint64{1, 2, 3}, since: 1, expected: []uint64{2, 3}, ok: true},
+		{name: "missed all", size: 3, pushed: []uint64{1, 2, 3}, since: 0, expected: []uint64{1, 2, 3}, ok: true},
+		{name: "wrapped", size: 3, pushed: []uint64{1, 2, 3, 4, 5}, since: 3, expected: []uint64{4, 5}, ok: true},
+		{name: "oldest kept", size: 3, pushed: []uint64{1, 2, 3, 4, 5}, since: 2, expected: []uint64{3, 4, 5}, ok: true},
+		{name: "overwritten", size: 3, pushed: []uint64{1, 2, 3, 4, 5}, since: 1, ok: false},
+		{name: "wrapped several times", size: 2, pushed: []uint64{10, 11, 12, 13, 14, 15, 16}, since: 14, expected: []uint64{15, 16}, ok: true},
+		{name: "size of one", size: 1, pushed: []uint64{1, 2}, since: 1, expected: []uint64{2}, ok: true},
+		{name: "size of zero keeps one", size: 0, pushed: []uint64{1, 2}, since: 1, expected: []uint64{2}, ok: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ring := newEventRing(test.size)
+			for _, id := range test.pushed {
+				ring.push(hubMessage{id: id})
+			}
+
+			messages, ok := ring.since(test.since)
+			if ok != test.ok {
+				t.Fatalf("expected ok to be %t", test.ok)
+			}
+
+			var ids []uint64
+			for _, msg := range messages {
+				ids = append(ids, msg.id)
+			}
+
+			if !slices.Equal(ids, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, ids)
+			}
+		})
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"container/heap"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Expiration describes an image that will be removed from the cache at the given deadline.
+type Expiration struct {
+	Cache    string    `json:"cache"`
+	ImgKey   string    `json:"img_key"`
+	Deadline time.Time `json:"deadline"`
+}
+
+type expiryEntry struct {
+	cache        *ImageCache
+	formattedKey string
+	deadline     time.Time
+	index        int // index of the entry in the heap, maintained by expiryHeap
+}
+
+// expiryHeap is a min-heap of entries ordered by deadline, implementing heap.Interface.
+type expiryHeap []*expiryEntry
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].deadline.Before(h[j].deadline) }
+
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *expiryHeap) Push(x any) {
+	entry := x.(*expiryEntry) //nolint:forcetypeassert
+	entry.index = len(*h)
+	*h = append(*h, entry)
+}
+
+func (h *expiryHeap) Pop() any {
+	old := *h
+	entry := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+
+	return entry
+}
+
+// ExpiryScheduler removes the images from the caches once their retention period is over.
+// A single goroutine waits for the closest deadline, instead of having one timer per file.
+type ExpiryScheduler struct {
+	mutex   sync.Mutex
+	entries expiryHeap
+	byKey   map[string]*expiryEntry
+	// wakeup is notified when the closest deadline changes
+	wakeup    chan struct{}
+	eventChan chan event
+}
+
+func newExpiryScheduler(eventChan chan event) *ExpiryScheduler {
+	return &ExpiryScheduler{
+		byKey:     make(map[string]*expiryEntry),
+		wakeup:    make(chan struct{}, 1),
+		eventChan: eventChan,
+	}
+}
+
+func expiryID(cache *ImageCache, formattedKey string) string {
+	return cache.name + "/" + formattedKey
+}
+
+// schedule sets the deadline of the given image, replacing the previous one if any.
+func (scheduler *ExpiryScheduler) schedule(cache *ImageCache, formattedKey string, deadline time.Time) {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+
+	id := expiryID(cache, formattedKey)
+
+	if entry, found := scheduler.byKey[id]; found {
+		entry.deadline = deadline
+		heap.Fix(&scheduler.entries, entry.index)
+	} else {
+		entry = &expiryEntry{cache: cache, formattedKey: formattedKey, deadline: deadline}
+		heap.Push(&scheduler.entries, entry)
+		scheduler.byKey[id] = entry
+	}
+
+	select {
+	case scheduler.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// cancel removes the deadline of the given image, if any.
+func (scheduler *ExpiryScheduler) cancel(cache *ImageCache, formattedKey string) {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+
+	id := expiryID(cache, formattedKey)
+
+	if entry, found := scheduler.byKey[id]; found {
+		heap.Remove(&scheduler.entries, entry.index)
+		delete(scheduler.byKey, id)
+	}
+}
+
+// clear removes all the deadlines.
+func (scheduler *ExpiryScheduler) clear() {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+
+	scheduler.entries = nil
+	scheduler.byKey = make(map[string]*expiryEntry)
+}
+
+// upcoming returns the next expirations, sorted by deadline.
+// If limit is positive, at most limit expirations are returned.
+func (scheduler *ExpiryScheduler) upcoming(limit int) []Expiration {
+	scheduler.mutex.Lock()
+	expirations := make([]Expiration, len(scheduler.entries))
+
+	for i, entry := range scheduler.entries {
+		expirations[i] = Expiration{Cache: entry.cache.name, ImgKey: entry.formattedKey, Deadline: entry.deadline}
+	}
+	scheduler.mutex.Unlock()
+
+	slices.SortFunc(expirations, func(a, b Expiration) int {
+		return a.Deadline.Compare(b.Deadline)
+	})
+
+	if limit > 0 && len(expirations) > limit {
+		expirations = expirations[:limit]
+	}
+
+	return expirations
+}
+
+// popExpired removes and returns the entries whose deadline has passed,
+// and the duration until the next deadline.
+func (scheduler *ExpiryScheduler) popExpired() (expired []*expiryEntry, next time.Duration) {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+
+	now := time.Now()
+
+	for len(scheduler.entries) > 0 && !scheduler.entries[0].deadline.After(now) {
+		entry := heap.Pop(&scheduler.entries).(*expiryEntry) //nolint:forcetypeassert
+		delete(scheduler.byKey, expiryID(entry.cache, entry.formattedKey))
+		expired = append(expired, entry)
+	}
+
+	next = time.Hour
+	if len(scheduler.entries) > 0 {
+		next = scheduler.entries[0].deadline.Sub(now)
+	}
+
+	return expired, next
+}
+
+// run removes the images as their deadlines are reached. It never returns.
+func (scheduler *ExpiryScheduler) run() {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	for {
+		expired, next := scheduler.popExpired()
+
+		for _, entry := range expired {
+			printDebug("Image ", entry.formattedKey, " expired")
+			expirationsTotal.WithLabelValues(entry.cache.name).Inc()
+			removeCachedImage(entry.cache, entry.formattedKey)
+
+			if entry.cache == mainCache && scheduler.eventChan != nil {
+				scheduler.eventChan <- event{EventType: eventRemove, EventObj: EventObject{ImgKey: entry.formattedKey}, source: "expiryScheduler"}
+			}
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+
+		timer.Reset(next)
+
+		select {
+		case <-timer.C:
+		case <-scheduler.wakeup:
+		}
+	}
+}
+
+// removeCachedImage removes the image from the cache, along with its resized variants, its footprint
+// and the metadata files of its product when it belongs to the main cache.
+func removeCachedImage(cache *ImageCache, formattedKey string) {
+	cache.deleteImage(formattedKey)
+	deleteFileFromDir(cache.pathOnDisk, formattedKey)
+	cacheIndex.deleteImage(cache, formattedKey)
+
+	if cache != mainCache {
+		return
+	}
+
+	if diskQuota.unpin(formattedKey) {
+		cacheIndex.deletePin(formattedKey)
+	}
+
+	removeResizedVariants(formattedKey)
+	spatialIndex.remove(formattedKey)
+
+	formattedDir := formattedKey[:strings.LastIndex(formattedKey, "@")+1]
+	productDir := strings.ReplaceAll(strings.TrimSuffix(formattedDir, "@"), "@", "/")
+
+	// all the caches are locked together, so that the product is never seen partially removed
+	geonamesCacheMutex.Lock()
+	localizationCacheMutex.Lock()
+	featuresCacheMutex.Lock()
+	fullProductLinksCacheMutex.Lock()
+	additionalProductFilesCacheMutex.Lock()
+
+	files := deleteKeysWithPrefix(geonamesCache, formattedDir)
+	files = append(files, deleteKeysWithPrefix(localizationCache, formattedDir)...)
+	files = append(files, deleteKeysWithPrefix(featuresCache, formattedDir)...)
+	files = append(files, deleteKeysWithPrefix(additionalProductFilesCache, formattedDir)...)
+	_, hadLinks := fullProductLinksCache[productDir]
+	delete(fullProductLinksCache, productDir)
+
+	additionalProductFilesCacheMutex.Unlock()
+	fullProductLinksCacheMutex.Unlock()
+	featuresCacheMutex.Unlock()
+	localizationCacheMutex.Unlock()
+	geonamesCacheMutex.Unlock()
+
+	for _, formattedFilename := range files {
+		deleteFileFromCache(formattedFilename)
+		cacheIndex.deleteFile(formattedFilename)
+	}
+
+	if hadLinks {
+		cacheIndex.deleteLinks(productDir)
+	}
+}
+
+// deleteKeysWithPrefix removes the entries whose key starts with the given prefix, and returns their keys.
+func deleteKeysWithPrefix[V any](m map[string]V, prefix string) []string {
+	var keys []string
+
+	for key := range m {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+			delete(m, key)
+		}
+	}
+
+	return keys
+}
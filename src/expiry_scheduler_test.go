@@ -0,0 +1,132 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+// expiryOperation schedules the image key at the given offset from now, or cancels its deadline.
+type expiryOperation struct {
+	key    string
+	offset time.Duration
+	cancel bool
+}
+
+func TestExpirySchedulerUpcoming(t *testing.T) {
+	tests := []struct {
+		name       string
+		operations []expiryOperation
+		limit      int
+		expected   []string
+	}{
+		{
+			name:       "sorted by deadline",
+			operations: []expiryOperation{{key: "c", offset: 3 * time.Hour}, {key: "a", offset: time.Hour}, {key: "b", offset: 2 * time.Hour}},
+			expected:   []string{"a", "b", "c"},
+		},
+		{
+			name:       "limited",
+			operations: []expiryOperation{{key: "c", offset: 3 * time.Hour}, {key: "a", offset: time.Hour}, {key: "b", offset: 2 * time.Hour}},
+			limit:      2,
+			expected:   []string{"a", "b"},
+		},
+		{
+			name: "rescheduled later",
+			operations: []expiryOperation{
+				{key: "a", offset: time.Hour}, {key: "b", offset: 2 * time.Hour}, {key: "a", offset: 3 * time.Hour},
+			},
+			expected: []string{"b", "a"},
+		},
+		{
+			name: "rescheduled earlier",
+			operations: []expiryOperation{
+				{key: "a", offset: time.Hour}, {key: "b", offset: 2 * time.Hour}, {key: "b", offset: time.Minute},
+			},
+			expected: []string{"b", "a"},
+		},
+		{
+			name: "cancelled",
+			operations: []expiryOperation{
+				{key: "a", offset: time.Hour}, {key: "b", offset: 2 * time.Hour}, {key: "c", offset: 3 * time.Hour},
+				{key: "a", cancel: true}, {key: "unknown", cancel: true},
+			},
+			expected: []string{"b", "c"},
+		},
+		{
+			name: "cancelled then scheduled again",
+			operations: []expiryOperation{
+				{key: "a", offset: time.Hour}, {key: "b", offset: 2 * time.Hour}, {key: "a", cancel: true}, {key: "a", offset: 3 * time.Hour},
+			},
+			expected: []string{"b", "a"},
+		},
+	}
+
+	cache := &ImageCache{name: "main"}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			scheduler := newExpiryScheduler(nil)
+			now := time.Now()
+
+			for _, operation := range test.operations {
+				if operation.cancel {
+					scheduler.cancel(cache, operation.key)
+				} else {
+					scheduler.schedule(cache, operation.key, now.Add(operation.offset))
+				}
+			}
+
+			keys := make([]string, 0)
+			for _, expiration := range scheduler.upcoming(test.limit) {
+				keys = append(keys, expiration.ImgKey)
+			}
+
+			if !slices.Equal(keys, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, keys)
+			}
+		})
+	}
+}
+
+func TestExpirySchedulerPopExpired(t *testing.T) {
+	images, thumbnails := &ImageCache{name: "main"}, &ImageCache{name: "thumbnails"}
+	scheduler := newExpiryScheduler(nil)
+	now := time.Now()
+
+	scheduler.schedule(images, "a", now.Add(-time.Minute))
+	scheduler.schedule(images, "b", now.Add(-time.Hour))
+	scheduler.schedule(images, "c", now.Add(time.Hour))
+	scheduler.schedule(thumbnails, "a", now.Add(2*time.Hour))
+	// the same key in another cache has its own deadline
+	scheduler.schedule(thumbnails, "b", now.Add(-time.Second))
+
+	expired, next := scheduler.popExpired()
+
+	ids := make([]string, 0, len(expired))
+	for _, entry := range expired {
+		ids = append(ids, expiryID(entry.cache, entry.formattedKey))
+	}
+
+	if expected := []string{"main/b", "main/a", "thumbnails/b"}; !slices.Equal(ids, expected) {
+		t.Errorf("expected %v to be expired, got %v", expected, ids)
+	}
+
+	if next <= 59*time.Minute || next > time.Hour {
+		t.Errorf("expected the next deadline in about an hour, got %v", next)
+	}
+
+	if expired, _ = scheduler.popExpired(); len(expired) > 0 {
+		t.Errorf("expected the expired entries to be removed, got %d again", len(expired))
+	}
+
+	if upcoming := scheduler.upcoming(0); len(upcoming) != 2 {
+		t.Errorf("expected 2 upcoming expirations, got %v", upcoming)
+	}
+
+	scheduler.clear()
+
+	if expired, next = scheduler.popExpired(); len(expired) > 0 || next != time.Hour {
+		t.Errorf("expected no deadline after clearing, got %d expired entries and the next one in %v", len(expired), next)
+	}
+}
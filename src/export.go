@@ -0,0 +1,415 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"cmp"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	exportKML        = "kml"
+	exportKMZ        = "kmz"
+	exportGeoPackage = "gpkg"
+
+	// kmzPreviewWidth is the width of the previews embedded in the KMZ exports
+	kmzPreviewWidth = 1024
+	// maxKMZPreviews bounds the number of previews resized for a KMZ export, the larger exports are rejected
+	maxKMZPreviews = 100
+)
+
+// exportedProduct is an image exported with its footprint, when it has a valid localization,
+// and the absolute links of its files, so that the export can be opened outside the viewer.
+type exportedProduct struct {
+	img       S3Image
+	api       APIImage
+	footprint Footprint
+	located   bool
+	links     []string
+}
+
+// exportedProducts returns the images of the main cache visible to the user of the request and matching the query,
+// sorted according to its sort options. The pagination options are ignored, every matching image is exported.
+func exportedProducts(r *http.Request, query imagesQuery) []exportedProduct {
+	origin := requestOrigin(r)
+	absolute := func(link string) string {
+		if strings.HasPrefix(link, "/") {
+			return origin + link
+		}
+
+		return link
+	}
+
+	products := make([]exportedProduct, 0)
+
+	for _, apiImg := range matchingImages(identityFromRequest(r), query) {
+		img, found := mainCache.findImageByKey(apiImg.Key)
+		if !found {
+			continue
+		}
+
+		apiImg.ImageURL, apiImg.InfosURL = absolute(apiImg.ImageURL), absolute(apiImg.InfosURL)
+		product := exportedProduct{img: img, api: apiImg}
+		product.footprint, product.located = footprintOf(img)
+
+		fullProductLinksCacheMutex.Lock()
+		links := slices.Clone(fullProductLinksCache[productDirOf(img.S3Key)])
+		fullProductLinksCacheMutex.Unlock()
+
+		for _, link := range links {
+			product.links = append(product.links, absolute(link))
+		}
+
+		products = append(products, product)
+	}
+
+	return products
+}
+
+// formatCoordinate formats a longitude or a latitude without losing precision.
+func formatCoordinate(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+// kmlData is a field of the extended data of a placemark.
+type kmlData struct {
+	Name  string
+	Value string
+}
+
+// kmlOverlay is the preview of a product, drawn on the ground between the corners of its localization.
+type kmlOverlay struct {
+	Href string
+	// Coordinates are the corners counterclockwise from the lower left one, as expected by gx:LatLonQuad
+	Coordinates string
+}
+
+// kmlPlacemark is the footprint of a product, with its overlay.
+type kmlPlacemark struct {
+	Name        string
+	Description string
+	Date        string
+	Data        []kmlData
+	// Polygons are the coordinates of the rings of the footprint, none if the product isn't located
+	Polygons []string
+	Overlay  *kmlOverlay
+}
+
+// kmlDescription describes the product in HTML, as displayed in the balloons of the GIS tools.
+func kmlDescription(product exportedProduct) string {
+	var description strings.Builder
+
+	if product.api.Geonames != "" {
+		description.WriteString("<p>")
+
+		for i, line := range strings.Split(strings.TrimRight(product.api.Geonames, "\n"), "\n") {
+			if i > 0 {
+				description.WriteString("<br/>")
+			}
+
+			indent := len(line) - len(strings.TrimLeft(line, " "))
+			description.WriteString(strings.Repeat("&nbsp;", indent) + html.EscapeString(strings.TrimSpace(line)))
+		}
+
+		description.WriteString("</p>")
+	}
+
+	if product.api.FeaturesClass != "" {
+		fmt.Fprintf(&description, "<p>%s: %d</p>", html.EscapeString(product.api.FeaturesClass), product.api.FeaturesCount)
+	}
+
+	description.WriteString("<ul>")
+
+	for _, link := range append([]string{product.api.ImageURL, product.api.InfosURL}, product.links...) {
+		fmt.Fprintf(&description, `<li><a href="%s">%s</a></li>`, html.EscapeString(link), html.EscapeString(link))
+	}
+
+	description.WriteString("</ul>")
+
+	return description.String()
+}
+
+// newKMLPlacemark describes the product, its overlay being the preview at the given href (none if it is empty).
+func newKMLPlacemark(product exportedProduct, previewHref string) kmlPlacemark {
+	placemark := kmlPlacemark{
+		Name:        cmp.Or(product.api.Name, product.api.Key),
+		Description: kmlDescription(product),
+		Date:        product.api.Date.UTC().Format(time.RFC3339),
+		Data: []kmlData{
+			{Name: "key", Value: product.api.Key},
+			{Name: "s3_key", Value: product.api.S3Key},
+			{Name: "bucket", Value: product.api.Bucket},
+			{Name: "type", Value: product.api.Type},
+			{Name: "group", Value: product.api.Group},
+			{Name: "size", Value: strconv.FormatInt(product.api.Size, 10)},
+			{Name: "geonames", Value: product.api.Geonames},
+			{Name: "features_class", Value: product.api.FeaturesClass},
+			{Name: "features_count", Value: strconv.Itoa(product.api.FeaturesCount)},
+			{Name: "image_url", Value: product.api.ImageURL},
+			{Name: "infos_url", Value: product.api.InfosURL},
+			{Name: "links", Value: strings.Join(product.links, "\n")},
+		},
+	}
+
+	if !product.located {
+		return placemark
+	}
+
+	for _, ring := range product.footprint.Polygons {
+		positions := make([]string, len(ring))
+		for i, position := range ring {
+			positions[i] = formatCoordinate(position[0]) + "," + formatCoordinate(position[1])
+		}
+
+		placemark.Polygons = append(placemark.Polygons, strings.Join(positions, " "))
+	}
+
+	if previewHref != "" {
+		corner := product.img.AssociatedLocalization.Corner
+		corners := make([]string, 0, 4)
+
+		for _, point := range []Point{corner.LowerLeft, corner.LowerRight, corner.UpperRight, corner.UpperLeft} {
+			corners = append(corners, formatCoordinate(point.Coordinates.Lon)+","+formatCoordinate(point.Coordinates.Lat))
+		}
+
+		placemark.Overlay = &kmlOverlay{Href: previewHref, Coordinates: strings.Join(corners, " ")}
+	}
+
+	return placemark
+}
+
+// writeKML writes the KML document of the placemarks.
+func writeKML(w io.Writer, placemarks []kmlPlacemark) error {
+	tmpl, err := getKMLExportTemplate()
+	if err != nil {
+		return err
+	}
+
+	err = tmpl.Execute(w, map[string]any{
+		"Name":     config.WindowTitle,
+		"Products": placemarks,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to execute KML export template: %w", err)
+	}
+
+	return nil
+}
+
+// kmzPreview is a preview embedded in a KMZ export.
+type kmzPreview struct {
+	// name is the name of the file in the archive, file the resized variant in the main cache,
+	// kept open so that it is still read whole if it is evicted from the cache before the archive is written
+	name string
+	file *os.File
+}
+
+// embedPreview resizes the preview of the product to be embedded in a KMZ export.
+func embedPreview(product exportedProduct) (kmzPreview, error) {
+	variant, err := resizedVariant(product.img, resizeSpec{width: kmzPreviewWidth, fit: fitContain})
+	if err != nil {
+		return kmzPreview{}, err
+	}
+
+	diskQuota.served(config.mainCacheDir, variant)
+	filePath := filepath.Join(config.mainCacheDir, variant)
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return kmzPreview{}, fmt.Errorf("failed to open resized preview: %w", err)
+	}
+
+	// the JPEG previews are resized to JPEG, the other ones to PNG
+	extension := ".png"
+	if contentType, err := getFileContentType(file); err == nil && contentType == "image/jpeg" {
+		extension = ".jpg"
+	}
+
+	return kmzPreview{name: "previews/" + product.img.FormattedKey + extension, file: file}, nil
+}
+
+// closePreviews closes the files of the previews embedded in a KMZ export.
+func closePreviews(previews []kmzPreview) {
+	for _, preview := range previews {
+		_ = preview.file.Close()
+	}
+}
+
+// writeKMZ writes a KMZ archive holding the KML document and the previews of the products,
+// to be opened without access to the server.
+func writeKMZ(w io.Writer, document []byte, previews []kmzPreview) error {
+	archive := zip.NewWriter(w)
+
+	// the GIS tools open the first KML document of the archive
+	entry, err := archive.CreateHeader(&zip.FileHeader{Name: "doc.kml", Method: zip.Deflate, Modified: time.Now()})
+	if err != nil {
+		return fmt.Errorf("failed to create KML document: %w", err)
+	}
+
+	if _, err = entry.Write(document); err != nil {
+		return fmt.Errorf("failed to write KML document: %w", err)
+	}
+
+	for _, preview := range previews {
+		// the previews are already compressed
+		entry, err = archive.CreateHeader(&zip.FileHeader{Name: preview.name, Method: zip.Store, Modified: time.Now()})
+		if err != nil {
+			return fmt.Errorf("failed to create preview %q: %w", preview.name, err)
+		}
+
+		if _, err = io.Copy(entry, preview.file); err != nil {
+			return fmt.Errorf("failed to write preview %q: %w", preview.name, err)
+		}
+	}
+
+	if err = archive.Close(); err != nil {
+		return fmt.Errorf("failed to close KMZ archive: %w", err)
+	}
+
+	return nil
+}
+
+// exportDocument builds the KML document of the products and the previews embedded along with it,
+// which are only loaded from the server when embed isn't set. The previews must be closed by the caller.
+func exportDocument(products []exportedProduct, embed bool) ([]byte, []kmzPreview, error) {
+	placemarks := make([]kmlPlacemark, 0, len(products))
+	previews := make([]kmzPreview, 0)
+
+	for _, product := range products {
+		href := fmt.Sprintf("%s?w=%d", product.api.ImageURL, kmzPreviewWidth)
+
+		if embed && product.located {
+			preview, err := embedPreview(product)
+			if err != nil {
+				printWarn(fmt.Sprintf("Preview of %q left out of the export: %v", product.img.FormattedKey, err))
+
+				href = ""
+			} else {
+				previews = append(previews, preview)
+				href = preview.name
+			}
+		}
+
+		placemarks = append(placemarks, newKMLPlacemark(product, href))
+	}
+
+	var document bytes.Buffer
+	if err := writeKML(&document, placemarks); err != nil {
+		closePreviews(previews)
+
+		return nil, nil, err
+	}
+
+	return document.Bytes(), previews, nil
+}
+
+// countLocated returns the number of products having a footprint, whose previews are embedded in the KMZ exports.
+func countLocated(products []exportedProduct) int {
+	count := 0
+
+	for _, product := range products {
+		if product.located {
+			count++
+		}
+	}
+
+	return count
+}
+
+// exportTarget returns the format and the filters of an export, as recorded in the audit log.
+func exportTarget(r *http.Request) string {
+	target := strings.TrimPrefix(r.URL.Path, "/api/v1/")
+	if query := queryTarget(r); query != "" {
+		target += "?" + query
+	}
+
+	return target
+}
+
+// exportHandler exports the products of the images list in a file for the GIS tools, according to the path:
+//   - /api/v1/export.kml: a KML document with the footprints and the previews as ground overlays,
+//     loaded from the server
+//   - /api/v1/export.kmz: the same KML document in a KMZ archive, along with the previews
+//   - /api/v1/export.gpkg: a GeoPackage with the footprints as the features of its products table
+//
+// The images are filtered and sorted with the query parameters of the images list, without pagination.
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		prettier(w, "Method not allowed", nil, http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	format := strings.TrimPrefix(r.URL.Path, "/api/v1/export.")
+
+	query, err := parseImagesQuery(r.URL.Query())
+	if err != nil {
+		prettier(w, err.Error(), nil, http.StatusBadRequest)
+
+		return
+	}
+
+	products := exportedProducts(r, query)
+	filename := fmt.Sprintf("products-%s.%s", time.Now().UTC().Format("20060102T150405Z"), format)
+
+	var (
+		contentType string
+		write       func(w io.Writer) error
+	)
+
+	switch format {
+	case exportKML, exportKMZ:
+		if located := countLocated(products); format == exportKMZ && located > maxKMZPreviews {
+			prettier(w, fmt.Sprintf("Too many products to embed their previews in a KMZ (%d, max %d), "+
+				"narrow the filters or export a KML", located, maxKMZPreviews), nil, http.StatusUnprocessableEntity)
+
+			return
+		}
+
+		document, previews, err := exportDocument(products, format == exportKMZ)
+		if err != nil {
+			printError(err, false)
+			prettier(w, "Failed to export the products: "+err.Error(), nil, http.StatusInternalServerError)
+
+			return
+		}
+
+		defer closePreviews(previews)
+
+		if format == exportKML {
+			contentType = "application/vnd.google-earth.kml+xml"
+			write = func(w io.Writer) error {
+				_, err := w.Write(document)
+
+				return err //nolint:wrapcheck
+			}
+		} else {
+			contentType = "application/vnd.google-earth.kmz"
+			write = func(w io.Writer) error { return writeKMZ(w, document, previews) }
+		}
+	case exportGeoPackage:
+		serveGeoPackage(w, r, filename, products)
+
+		return
+	default:
+		prettier(w, "Unknown export format, expected kml, kmz or gpkg", nil, http.StatusNotFound)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+
+	if err = write(w); err != nil {
+		printError(fmt.Errorf("failed to write export %q: %w", filename, err), false)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestWriteKMZEvictedPreviews writes a KMZ whose previews were removed from the cache after they were opened,
+// as when they are evicted while the export is written.
+func TestWriteKMZEvictedPreviews(t *testing.T) {
+	dir := t.TempDir()
+	contents := map[string][]byte{
+		"previews/a.jpg": bytes.Repeat([]byte{0xff, 0xd8}, 4096),
+		"previews/b.png": bytes.Repeat([]byte{0x89, 'P', 'N', 'G'}, 4096),
+	}
+
+	previews := make([]kmzPreview, 0, len(contents))
+
+	for name, content := range contents {
+		filePath := filepath.Join(dir, filepath.Base(name))
+		if err := os.WriteFile(filePath, content, 0o600); err != nil {
+			t.Fatal(err)
+		}
+
+		file, err := os.Open(filePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		previews = append(previews, kmzPreview{name: name, file: file})
+	}
+
+	defer closePreviews(previews)
+
+	for _, preview := range previews {
+		if err := os.Remove(preview.file.Name()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var kmz bytes.Buffer
+	if err := writeKMZ(&kmz, []byte("<kml/>"), previews); err != nil {
+		t.Fatalf("failed to write the KMZ: %v", err)
+	}
+
+	archive, err := zip.NewReader(bytes.NewReader(kmz.Bytes()), int64(kmz.Len()))
+	if err != nil {
+		t.Fatalf("invalid KMZ: %v", err)
+	}
+
+	expected := map[string][]byte{"doc.kml": []byte("<kml/>")}
+	for name, content := range contents {
+		expected[name] = content
+	}
+
+	if len(archive.File) != len(expected) {
+		t.Fatalf("expected %d files in the KMZ, got %d", len(expected), len(archive.File))
+	}
+
+	for _, entry := range archive.File {
+		file, err := entry.Open()
+		if err != nil {
+			t.Fatalf("failed to open %q: %v", entry.Name, err)
+		}
+
+		content, err := io.ReadAll(file)
+		_ = file.Close()
+
+		if err != nil || !bytes.Equal(content, expected[entry.Name]) {
+			t.Errorf("%q: expected %d bytes, got %d (%v)", entry.Name, len(expected[entry.Name]), len(content), err)
+		}
+	}
+}
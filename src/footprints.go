@@ -0,0 +1,469 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const geoJSONContentType = "application/geo+json"
+
+// BBox is a bounding box in WGS 84 longitudes and latitudes.
+type BBox struct {
+	MinLon float64
+	MinLat float64
+	MaxLon float64
+	MaxLat float64
+}
+
+// parseBBox parses a bounding box given as "minLon,minLat,maxLon,maxLat".
+// A box crossing the antimeridian has a minimum longitude greater than its maximum one, as in GeoJSON.
+func parseBBox(raw string) (BBox, error) {
+	parts := strings.Split(raw, ",")
+	if len(parts) != 4 {
+		return BBox{}, errors.New("invalid bbox, expected minLon,minLat,maxLon,maxLat")
+	}
+
+	values := make([]float64, len(parts))
+
+	for i, part := range parts {
+		value, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return BBox{}, fmt.Errorf("invalid bbox value %q", part)
+		}
+
+		values[i] = value
+	}
+
+	return newBBox(values)
+}
+
+// newBBox returns the bounding box given as [minLon, minLat, maxLon, maxLat], after checking its coordinates.
+func newBBox(values []float64) (BBox, error) {
+	if len(values) != 4 {
+		return BBox{}, errors.New("invalid bbox, expected minLon,minLat,maxLon,maxLat")
+	}
+
+	box := BBox{MinLon: values[0], MinLat: values[1], MaxLon: values[2], MaxLat: values[3]}
+
+	if box.MinLon < -180 || box.MaxLon > 180 || box.MinLon > 180 || box.MaxLon < -180 ||
+		box.MinLat < -90 || box.MaxLat > 90 || box.MinLat > box.MaxLat {
+		return BBox{}, errors.New("invalid bbox, the longitudes must be between -180 and 180 and the latitudes between -90 and 90")
+	}
+
+	return box, nil
+}
+
+// split returns the box as one or two boxes not crossing the antimeridian.
+func (box BBox) split() []BBox {
+	if box.MinLon <= box.MaxLon {
+		return []BBox{box}
+	}
+
+	return []BBox{
+		{MinLon: box.MinLon, MinLat: box.MinLat, MaxLon: 180, MaxLat: box.MaxLat},
+		{MinLon: -180, MinLat: box.MinLat, MaxLon: box.MaxLon, MaxLat: box.MaxLat},
+	}
+}
+
+// intersects returns whether the boxes have a common point.
+func (box BBox) intersects(other BBox) bool {
+	for _, part := range box.split() {
+		for _, otherPart := range other.split() {
+			if part.MinLon <= otherPart.MaxLon && otherPart.MinLon <= part.MaxLon &&
+				part.MinLat <= otherPart.MaxLat && otherPart.MinLat <= part.MaxLat {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (box BBox) array() []float64 {
+	return []float64{box.MinLon, box.MinLat, box.MaxLon, box.MaxLat}
+}
+
+func (box BBox) String() string {
+	return fmt.Sprintf("%g,%g,%g,%g", box.MinLon, box.MinLat, box.MaxLon, box.MaxLat)
+}
+
+// Footprint is the area covered by an image, as one closed ring of [lon, lat] positions per polygon.
+// It has two polygons when it crosses the antimeridian.
+type Footprint struct {
+	Polygons [][][2]float64
+	BBox     BBox
+}
+
+// footprintOf returns the footprint of the image built from the corners of its localization file.
+// It returns false when the image has no localization, or when its corners are not valid coordinates.
+func footprintOf(img S3Image) (Footprint, bool) {
+	if img.AssociatedLocalization == nil {
+		return Footprint{}, false
+	}
+
+	corner := img.AssociatedLocalization.Corner
+	ring := make([][2]float64, 0, 4)
+
+	for _, point := range []Point{corner.UpperLeft, corner.UpperRight, corner.LowerRight, corner.LowerLeft} {
+		lon, lat := point.Coordinates.Lon, point.Coordinates.Lat
+		if lon < -180 || lon > 180 || lat < -90 || lat > 90 {
+			return Footprint{}, false
+		}
+
+		ring = append(ring, [2]float64{lon, lat})
+	}
+
+	// an image can't be wider than half the globe, so a wider footprint crosses the antimeridian:
+	// its western longitudes are moved beyond 180 to make it contiguous
+	lons := []float64{ring[0][0], ring[1][0], ring[2][0], ring[3][0]}
+	crossing := slices.Max(lons)-slices.Min(lons) > 180
+
+	if crossing {
+		for i := range ring {
+			if ring[i][0] < 0 {
+				ring[i][0] += 360
+			}
+		}
+	}
+
+	// the exterior rings are counterclockwise in GeoJSON (RFC 7946)
+	var area float64
+	for i := range ring {
+		next := ring[(i+1)%len(ring)]
+		area += ring[i][0]*next[1] - next[0]*ring[i][1]
+	}
+
+	if area == 0 {
+		return Footprint{}, false
+	}
+
+	if area < 0 {
+		slices.Reverse(ring)
+	}
+
+	box := BBox{MinLon: ring[0][0], MinLat: ring[0][1], MaxLon: ring[0][0], MaxLat: ring[0][1]}
+	for _, position := range ring[1:] {
+		box.MinLon, box.MaxLon = min(box.MinLon, position[0]), max(box.MaxLon, position[0])
+		box.MinLat, box.MaxLat = min(box.MinLat, position[1]), max(box.MaxLat, position[1])
+	}
+
+	if !crossing {
+		return Footprint{Polygons: [][][2]float64{closeRing(ring)}, BBox: box}, true
+	}
+
+	// the footprint is cut along the antimeridian, as recommended by RFC 7946
+	box.MaxLon -= 360
+	east := clipRing(ring, func(lon float64) bool { return lon <= 180 })
+	west := clipRing(ring, func(lon float64) bool { return lon >= 180 })
+
+	for i := range west {
+		west[i][0] -= 360
+	}
+
+	return Footprint{Polygons: [][][2]float64{closeRing(east), closeRing(west)}, BBox: box}, true
+}
+
+// clipRing returns the part of the ring whose longitudes are inside, the ring being cut at the 180th meridian
+// (Sutherland-Hodgman algorithm).
+func clipRing(ring [][2]float64, inside func(lon float64) bool) [][2]float64 {
+	clipped := make([][2]float64, 0, len(ring)+2)
+
+	for i, current := range ring {
+		previous := ring[(i+len(ring)-1)%len(ring)]
+
+		if inside(current[0]) != inside(previous[0]) {
+			ratio := (180 - previous[0]) / (current[0] - previous[0])
+			clipped = append(clipped, [2]float64{180, previous[1] + ratio*(current[1]-previous[1])})
+		}
+
+		if inside(current[0]) {
+			clipped = append(clipped, current)
+		}
+	}
+
+	return clipped
+}
+
+func closeRing(ring [][2]float64) [][2]float64 {
+	return append(ring, ring[0])
+}
+
+// GeoJSONGeometry is a GeoJSON Polygon, or a MultiPolygon for the footprints crossing the antimeridian.
+// The polygons are made of their exterior ring only.
+type GeoJSONGeometry struct {
+	Type        string `json:"type"`
+	Coordinates any    `json:"coordinates"`
+}
+
+func newFootprintGeometry(footprint Footprint) GeoJSONGeometry {
+	if len(footprint.Polygons) == 1 {
+		return GeoJSONGeometry{Type: "Polygon", Coordinates: footprint.Polygons}
+	}
+
+	polygons := make([][][][2]float64, len(footprint.Polygons))
+	for i, ring := range footprint.Polygons {
+		polygons[i] = [][][2]float64{ring}
+	}
+
+	return GeoJSONGeometry{Type: "MultiPolygon", Coordinates: polygons}
+}
+
+// FootprintProperties are the properties of the footprint features.
+// Its fields must be kept backward compatible.
+type FootprintProperties struct {
+	Key      string    `json:"key"`
+	Type     string    `json:"type"`
+	Date     time.Time `json:"date"`
+	Geoname  string    `json:"geoname"`
+	ImageURL string    `json:"image_url"`
+	InfosURL string    `json:"infos_url"`
+	// DistanceKm is the distance from the position of a nearest search to the footprint
+	DistanceKm *float64 `json:"distance_km,omitempty"`
+}
+
+// GeoJSONFeature is the footprint of an image as a GeoJSON Feature.
+type GeoJSONFeature struct {
+	Type       string              `json:"type"`
+	ID         string              `json:"id"`
+	BBox       []float64           `json:"bbox"`
+	Geometry   GeoJSONGeometry     `json:"geometry"`
+	Properties FootprintProperties `json:"properties"`
+}
+
+// GeoJSONFeatureCollection is a collection of footprints.
+type GeoJSONFeatureCollection struct {
+	Type     string           `json:"type"`
+	Features []GeoJSONFeature `json:"features"`
+}
+
+func newFootprintFeature(img S3Image, footprint Footprint) GeoJSONFeature {
+	properties := FootprintProperties{
+		Key:      img.FormattedKey,
+		Date:     img.LastModified,
+		ImageURL: config.BasePath + "/image/" + img.FormattedKey,
+		InfosURL: config.BasePath + "/infos/" + img.FormattedKey,
+	}
+
+	if img.AssociatedGeonames != nil && len(img.AssociatedGeonames.Objects) > 0 {
+		properties.Geoname = img.AssociatedGeonames.getTopLevel()
+	}
+
+	if img.Type != nil {
+		properties.Type = img.Type.Name
+	}
+
+	return GeoJSONFeature{
+		Type:       "Feature",
+		ID:         img.FormattedKey,
+		BBox:       footprint.BBox.array(),
+		Geometry:   newFootprintGeometry(footprint),
+		Properties: properties,
+	}
+}
+
+const (
+	footprintsDefaultNearLimit = 10
+	footprintsMaxNearLimit     = 1000
+)
+
+// footprintsQuery holds the filters of a request to the footprints.
+// At most one of bbox, point and near is set.
+type footprintsQuery struct {
+	bbox     *BBox
+	point    *[2]float64
+	near     *[2]float64
+	limit    int
+	types    []string
+	groups   []string
+	from, to time.Time
+}
+
+// parsePosition parses a position given as "lon,lat".
+func parsePosition(name, raw string) (*[2]float64, error) {
+	lonText, latText, found := strings.Cut(raw, ",")
+	lon, lonErr := strconv.ParseFloat(strings.TrimSpace(lonText), 64)
+	lat, latErr := strconv.ParseFloat(strings.TrimSpace(latText), 64)
+
+	if !found || lonErr != nil || latErr != nil || lon < -180 || lon > 180 || lat < -90 || lat > 90 {
+		return nil, fmt.Errorf("invalid %s, expected lon,lat with a longitude between -180 and 180 and a latitude between -90 and 90", name)
+	}
+
+	return &[2]float64{lon, lat}, nil
+}
+
+func parseFootprintsQuery(values url.Values) (footprintsQuery, error) {
+	query := footprintsQuery{
+		types:  splitQueryValues(values, "type"),
+		groups: splitQueryValues(values, "group"),
+		limit:  footprintsDefaultNearLimit,
+	}
+
+	var err error
+
+	if raw := values.Get("bbox"); raw != "" {
+		var box BBox
+		if box, err = parseBBox(raw); err != nil {
+			return footprintsQuery{}, err
+		}
+
+		query.bbox = &box
+	}
+
+	if raw := values.Get("point"); raw != "" {
+		if query.point, err = parsePosition("point", raw); err != nil {
+			return footprintsQuery{}, err
+		}
+	}
+
+	if raw := values.Get("near"); raw != "" {
+		if query.near, err = parsePosition("near", raw); err != nil {
+			return footprintsQuery{}, err
+		}
+	}
+
+	if (query.bbox != nil && query.point != nil) || (query.bbox != nil && query.near != nil) || (query.point != nil && query.near != nil) {
+		return footprintsQuery{}, errors.New("only one of bbox, point and near can be given")
+	}
+
+	if limit := values.Get("limit"); limit != "" {
+		query.limit, err = strconv.Atoi(limit)
+		if err != nil || query.limit < 1 || query.limit > footprintsMaxNearLimit {
+			return footprintsQuery{}, fmt.Errorf("invalid limit, expected a number between 1 and %d", footprintsMaxNearLimit)
+		}
+
+		if query.near == nil {
+			return footprintsQuery{}, errors.New("limit can only be given with near")
+		}
+	}
+
+	if from := values.Get("from"); from != "" {
+		if query.from, err = time.Parse(time.RFC3339, from); err != nil {
+			return footprintsQuery{}, fmt.Errorf("invalid 'from' date, expected RFC 3339: %w", err)
+		}
+	}
+
+	if to := values.Get("to"); to != "" {
+		if query.to, err = time.Parse(time.RFC3339, to); err != nil {
+			return footprintsQuery{}, fmt.Errorf("invalid 'to' date, expected RFC 3339: %w", err)
+		}
+	}
+
+	return query, nil
+}
+
+// matches returns whether the image passes the filters of the query other than the location.
+func (query footprintsQuery) matches(img S3Image) bool {
+	if len(query.types) > 0 && (img.Type == nil || !slices.Contains(query.types, img.Type.Name)) {
+		return false
+	}
+
+	if len(query.groups) > 0 && (img.Type == nil || !slices.Contains(query.groups, img.Type.group)) {
+		return false
+	}
+
+	if !query.from.IsZero() && img.LastModified.Before(query.from) {
+		return false
+	}
+
+	return query.to.IsZero() || !img.LastModified.After(query.to)
+}
+
+// listFootprints returns the footprints of the images of the main cache visible to the identity and matching the query.
+// The footprints near a position are sorted by increasing distance, the other ones from the most recent.
+// The images without localization are left out.
+func listFootprints(identity *Identity, query footprintsQuery) GeoJSONFeatureCollection {
+	collection := GeoJSONFeatureCollection{Type: "FeatureCollection", Features: make([]GeoJSONFeature, 0)}
+
+	accepted := func(key string) (S3Image, bool) {
+		img, found := mainCache.findImageByKey(key)
+
+		return img, found && identity.canViewType(img.Type) && query.matches(img)
+	}
+
+	if query.near != nil {
+		for _, neighbour := range spatialIndex.nearest(query.near[0], query.near[1], query.limit, func(key string) bool {
+			_, ok := accepted(key)
+
+			return ok
+		}) {
+			if img, ok := accepted(neighbour.Key); ok {
+				if footprint, found := footprintOf(img); found {
+					feature := newFootprintFeature(img, footprint)
+					feature.Properties.DistanceKm = &neighbour.DistanceKm
+					collection.Features = append(collection.Features, feature)
+				}
+			}
+		}
+
+		return collection
+	}
+
+	var images []S3Image
+
+	switch {
+	case query.bbox != nil || query.point != nil:
+		var keys []string
+		if query.bbox != nil {
+			keys = spatialIndex.intersecting(*query.bbox)
+		} else {
+			keys = spatialIndex.containing(query.point[0], query.point[1])
+		}
+
+		for _, key := range keys {
+			if img, ok := accepted(key); ok {
+				images = append(images, img)
+			}
+		}
+	default:
+		for _, img := range identity.visibleImages(mainCache.snapshot()) {
+			if query.matches(img) {
+				images = append(images, img)
+			}
+		}
+	}
+
+	slices.SortFunc(images, func(a, b S3Image) int {
+		return cmp.Or(b.LastModified.Compare(a.LastModified), cmp.Compare(a.FormattedKey, b.FormattedKey))
+	})
+
+	for _, img := range images {
+		if footprint, found := footprintOf(img); found {
+			collection.Features = append(collection.Features, newFootprintFeature(img, footprint))
+		}
+	}
+
+	return collection
+}
+
+// footprintsHandler returns the footprints of the cached images as a GeoJSON FeatureCollection,
+// so that they can be displayed by GIS tools. The footprints are built from the corners of the localization files.
+//
+// Query parameters:
+//   - bbox: only keep the footprints intersecting this box (minLon,minLat,maxLon,maxLat)
+//   - point: only keep the footprints containing this position (lon,lat)
+//   - near: the footprints closest to this position (lon,lat) with their distance, limit: their number (10 by default)
+//   - from, to: only keep the images modified in this range (RFC 3339 dates)
+//   - type, group: only keep the images of the given types or groups (repeated or comma-separated)
+func footprintsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		prettier(w, "Method not allowed", nil, http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	query, err := parseFootprintsQuery(r.URL.Query())
+	if err != nil {
+		prettier(w, err.Error(), nil, http.StatusBadRequest)
+
+		return
+	}
+
+	writeJSON(w, geoJSONContentType, listFootprints(identityFromRequest(r), query), http.StatusOK)
+}
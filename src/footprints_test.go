@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"testing"
+)
+
+// localizationOf returns a localization with the given corners, as [lon, lat] positions
+// from the upper left one, clockwise.
+func localizationOf(t *testing.T, corners [4][2]float64) *Localization {
+	t.Helper()
+
+	var localization Localization
+
+	raw := fmt.Sprintf(`{"corner": {
+		"upper-left": {"coordinates": {"lon": %g, "lat": %g}}, "upper-right": {"coordinates": {"lon": %g, "lat": %g}},
+		"lower-right": {"coordinates": {"lon": %g, "lat": %g}}, "lower-left": {"coordinates": {"lon": %g, "lat": %g}}}}`,
+		corners[0][0], corners[0][1], corners[1][0], corners[1][1], corners[2][0], corners[2][1], corners[3][0], corners[3][1])
+
+	if err := json.Unmarshal([]byte(raw), &localization); err != nil {
+		t.Fatal(err)
+	}
+
+	return &localization
+}
+
+// ringArea returns the signed area of the closed ring, positive when it is counterclockwise.
+func ringArea(ring [][2]float64) float64 {
+	var area float64
+	for i := range len(ring) - 1 {
+		area += ring[i][0]*ring[i+1][1] - ring[i+1][0]*ring[i][1]
+	}
+
+	return area / 2
+}
+
+func TestFootprintOf(t *testing.T) {
+	tests := []struct {
+		name    string
+		corners *[4][2]float64
+		found   bool
+		// polygons holds the longitudes range of each polygon
+		polygons [][2]float64
+		bbox     BBox
+	}{
+		{name: "no localization", found: false},
+		{name: "invalid longitude", corners: &[4][2]float64{{2, 49}, {181, 49}, {3, 48}, {2, 48}}, found: false},
+		{name: "invalid latitude", corners: &[4][2]float64{{2, 91}, {3, 49}, {3, 48}, {2, 48}}, found: false},
+		{name: "flat", corners: &[4][2]float64{{2, 49}, {2, 49}, {2, 49}, {2, 49}}, found: false},
+		{
+			name: "clockwise", corners: &[4][2]float64{{2, 49}, {3, 49}, {3, 48}, {2, 48}}, found: true,
+			polygons: [][2]float64{{2, 3}}, bbox: BBox{MinLon: 2, MinLat: 48, MaxLon: 3, MaxLat: 49},
+		},
+		{
+			name: "counterclockwise", corners: &[4][2]float64{{2, 49}, {2, 48}, {3, 48}, {3, 49}}, found: true,
+			polygons: [][2]float64{{2, 3}}, bbox: BBox{MinLon: 2, MinLat: 48, MaxLon: 3, MaxLat: 49},
+		},
+		{
+			name: "rotated", corners: &[4][2]float64{{0, 1}, {1, 0}, {0, -1}, {-1, 0}}, found: true,
+			polygons: [][2]float64{{-1, 1}}, bbox: BBox{MinLon: -1, MinLat: -1, MaxLon: 1, MaxLat: 1},
+		},
+		{
+			name: "crossing the antimeridian", corners: &[4][2]float64{{170, 10}, {-170, 10}, {-170, -10}, {170, -10}}, found: true,
+			polygons: [][2]float64{{170, 180}, {-180, -170}}, bbox: BBox{MinLon: 170, MinLat: -10, MaxLon: -170, MaxLat: 10},
+		},
+		{
+			name: "crossing the antimeridian askew", corners: &[4][2]float64{{175, 10}, {-175, 12}, {-178, -10}, {172, -12}}, found: true,
+			polygons: [][2]float64{{172, 180}, {-180, -175}}, bbox: BBox{MinLon: 172, MinLat: -12, MaxLon: -175, MaxLat: 12},
+		},
+		{
+			name: "touching the antimeridian", corners: &[4][2]float64{{170, 10}, {180, 10}, {180, -10}, {170, -10}}, found: true,
+			polygons: [][2]float64{{170, 180}}, bbox: BBox{MinLon: 170, MinLat: -10, MaxLon: 180, MaxLat: 10},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var img S3Image
+			if test.corners != nil {
+				img.AssociatedLocalization = localizationOf(t, *test.corners)
+			}
+
+			footprint, found := footprintOf(img)
+			if found != test.found {
+				t.Fatalf("expected found to be %t", test.found)
+			}
+
+			if !found {
+				return
+			}
+
+			if footprint.BBox != test.bbox {
+				t.Errorf("expected the bbox %v, got %v", test.bbox, footprint.BBox)
+			}
+
+			if len(footprint.Polygons) != len(test.polygons) {
+				t.Fatalf("expected %d polygons, got %v", len(test.polygons), footprint.Polygons)
+			}
+
+			for i, ring := range footprint.Polygons {
+				if len(ring) < 4 || ring[0] != ring[len(ring)-1] {
+					t.Errorf("polygon %d is not a closed ring: %v", i, ring)
+				}
+
+				if ringArea(ring) <= 0 {
+					t.Errorf("polygon %d is not counterclockwise: %v", i, ring)
+				}
+
+				lons := make([]float64, 0, len(ring))
+				for _, position := range ring {
+					lons = append(lons, position[0])
+				}
+
+				if slices.Min(lons) != test.polygons[i][0] || slices.Max(lons) != test.polygons[i][1] {
+					t.Errorf("expected polygon %d between the longitudes %v, got %v", i, test.polygons[i], ring)
+				}
+			}
+		})
+	}
+}
+
+func TestClipRing(t *testing.T) {
+	// a footprint crossing the antimeridian, its western longitudes moved beyond 180
+	ring := [][2]float64{{170, 0}, {190, 10}, {190, 20}, {170, 20}}
+
+	tests := []struct {
+		name     string
+		inside   func(lon float64) bool
+		expected [][2]float64
+	}{
+		{
+			name:     "east",
+			inside:   func(lon float64) bool { return lon <= 180 },
+			expected: [][2]float64{{170, 0}, {180, 5}, {180, 20}, {170, 20}},
+		},
+		{
+			name:     "west",
+			inside:   func(lon float64) bool { return lon >= 180 },
+			expected: [][2]float64{{180, 5}, {190, 10}, {190, 20}, {180, 20}},
+		},
+		{
+			name:     "whole",
+			inside:   func(float64) bool { return true },
+			expected: ring,
+		},
+		{
+			name:     "nothing",
+			inside:   func(float64) bool { return false },
+			expected: [][2]float64{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if clipped := clipRing(ring, test.inside); !slices.Equal(clipped, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, clipped)
+			}
+		})
+	}
+}
+
+func TestBBoxIntersects(t *testing.T) {
+	france := BBox{MinLon: -5, MinLat: 42, MaxLon: 8, MaxLat: 51}
+	fiji := BBox{MinLon: 177, MinLat: -19, MaxLon: -179, MaxLat: -16}
+
+	tests := []struct {
+		name     string
+		box      BBox
+		other    BBox
+		expected bool
+	}{
+		{name: "overlapping", box: france, other: BBox{MinLon: 2, MinLat: 48, MaxLon: 3, MaxLat: 49}, expected: true},
+		{name: "touching", box: france, other: BBox{MinLon: 8, MinLat: 51, MaxLon: 10, MaxLat: 53}, expected: true},
+		{name: "apart", box: france, other: fiji, expected: false},
+		{name: "east of the antimeridian", box: fiji, other: BBox{MinLon: 178, MinLat: -18, MaxLon: 179, MaxLat: -17}, expected: true},
+		{name: "west of the antimeridian", box: fiji, other: BBox{MinLon: -179.5, MinLat: -18, MaxLon: -179.2, MaxLat: -17}, expected: true},
+		{name: "both crossing", box: fiji, other: BBox{MinLon: 179, MinLat: -20, MaxLon: -170, MaxLat: 0}, expected: true},
+		{name: "beyond the western part", box: fiji, other: BBox{MinLon: -178, MinLat: -18, MaxLon: -170, MaxLat: -17}, expected: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.box.intersects(test.other) != test.expected || test.other.intersects(test.box) != test.expected {
+				t.Errorf("expected %v and %v to intersect: %t", test.box, test.other, test.expected)
+			}
+		})
+	}
+}
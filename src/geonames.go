@@ -142,7 +142,10 @@ func parseGeonames(filePath string, objDate time.Time) (Geonames, error) {
 func getGeoname(imgName string) string {
 	geonamesFilename := imgName[:strings.LastIndex(imgName, "@")+1] + config.GeonamesFilename
 
+	geonamesCacheMutex.Lock()
 	geoname, found := geonamesCache[geonamesFilename]
+	geonamesCacheMutex.Unlock()
+
 	if found && len(geoname.Objects) > 0 {
 		return geoname.getTopLevel()
 	}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite" // pure Go SQLite driver, the binaries are built without cgo
+)
+
+const (
+	// geoPackageApplicationID is "GPKG", and geoPackageVersion the 1.3.0 version of the specification
+	geoPackageApplicationID = 0x47504B47
+	geoPackageVersion       = 10300
+
+	geoPackageTable    = "products"
+	geoPackageDateTime = "2006-01-02T15:04:05.000Z"
+
+	wgs84SRSID = 4326
+	// wgs84Definition is the WKT definition of WGS 84 given by the GeoPackage specification
+	wgs84Definition = `GEOGCS["WGS 84",DATUM["WGS_1984",SPHEROID["WGS 84",6378137,298.257223563,AUTHORITY["EPSG","7030"]],` +
+		`AUTHORITY["EPSG","6326"]],PRIMEM["Greenwich",0,AUTHORITY["EPSG","8901"]],` +
+		`UNIT["degree",0.0174532925199433,AUTHORITY["EPSG","9122"]],AUTHORITY["EPSG","4326"]]`
+)
+
+// geoPackageSchema creates the tables required by the GeoPackage specification, and the features table of the products.
+var geoPackageSchema = []string{ //nolint:gochecknoglobals
+	`CREATE TABLE gpkg_spatial_ref_sys (
+		srs_name TEXT NOT NULL,
+		srs_id INTEGER PRIMARY KEY,
+		organization TEXT NOT NULL,
+		organization_coordsys_id INTEGER NOT NULL,
+		definition TEXT NOT NULL,
+		description TEXT
+	)`,
+	`CREATE TABLE gpkg_contents (
+		table_name TEXT NOT NULL PRIMARY KEY,
+		data_type TEXT NOT NULL,
+		identifier TEXT UNIQUE,
+		description TEXT DEFAULT '',
+		last_change DATETIME NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ','now')),
+		min_x DOUBLE,
+		min_y DOUBLE,
+		max_x DOUBLE,
+		max_y DOUBLE,
+		srs_id INTEGER,
+		CONSTRAINT fk_gc_r_srs_id FOREIGN KEY (srs_id) REFERENCES gpkg_spatial_ref_sys(srs_id)
+	)`,
+	`CREATE TABLE gpkg_geometry_columns (
+		table_name TEXT NOT NULL,
+		column_name TEXT NOT NULL,
+		geometry_type_name TEXT NOT NULL,
+		srs_id INTEGER NOT NULL,
+		z TINYINT NOT NULL,
+		m TINYINT NOT NULL,
+		CONSTRAINT pk_geom_cols PRIMARY KEY (table_name, column_name),
+		CONSTRAINT uk_gc_table_name UNIQUE (table_name),
+		CONSTRAINT fk_gc_tn FOREIGN KEY (table_name) REFERENCES gpkg_contents(table_name),
+		CONSTRAINT fk_gc_srs FOREIGN KEY (srs_id) REFERENCES gpkg_spatial_ref_sys (srs_id)
+	)`,
+	`INSERT INTO gpkg_spatial_ref_sys VALUES
+		('Undefined cartesian SRS', -1, 'NONE', -1, 'undefined', 'undefined cartesian coordinate reference system'),
+		('Undefined geographic SRS', 0, 'NONE', 0, 'undefined', 'undefined geographic coordinate reference system'),
+		('WGS 84 geodetic', 4326, 'EPSG', 4326, '` + wgs84Definition + `',
+			'longitude/latitude coordinates in decimal degrees on the WGS 84 spheroid')`,
+	`CREATE TABLE ` + geoPackageTable + ` (
+		fid INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+		geom MULTIPOLYGON,
+		key TEXT NOT NULL UNIQUE,
+		s3_key TEXT,
+		bucket TEXT,
+		type TEXT,
+		group_name TEXT,
+		name TEXT,
+		date DATETIME,
+		size INTEGER,
+		geonames TEXT,
+		features_class TEXT,
+		features_count INTEGER,
+		image_url TEXT,
+		infos_url TEXT,
+		links TEXT
+	)`,
+}
+
+// geoPackageGeometry encodes the footprint in the GeoPackage binary format:
+// a header with the SRS and the envelope, followed by the footprint as a WKB MultiPolygon.
+func geoPackageGeometry(footprint Footprint) []byte {
+	var buffer bytes.Buffer
+
+	write := func(data any) {
+		_ = binary.Write(&buffer, binary.LittleEndian, data)
+	}
+
+	envelope := [4]float64{math.Inf(1), math.Inf(-1), math.Inf(1), math.Inf(-1)}
+
+	for _, ring := range footprint.Polygons {
+		for _, position := range ring {
+			envelope[0], envelope[1] = min(envelope[0], position[0]), max(envelope[1], position[0])
+			envelope[2], envelope[3] = min(envelope[2], position[1]), max(envelope[3], position[1])
+		}
+	}
+
+	// version 0, little endian with a minx, maxx, miny, maxy envelope
+	buffer.WriteString("GP")
+	write([]byte{0, 0b0000_0011})
+	write(int32(wgs84SRSID))
+	write(envelope)
+
+	const (
+		wkbLittleEndian   = 1
+		wkbPolygon        = 3
+		wkbMultiPolygon   = 6
+		polygonRingsCount = 1
+	)
+
+	write(uint8(wkbLittleEndian))
+	write(uint32(wkbMultiPolygon))
+	write(uint32(len(footprint.Polygons)))
+
+	for _, ring := range footprint.Polygons {
+		write(uint8(wkbLittleEndian))
+		write(uint32(wkbPolygon))
+		write(uint32(polygonRingsCount))
+		write(uint32(len(ring)))
+		write(ring)
+	}
+
+	return buffer.Bytes()
+}
+
+// writeGeoPackage writes the products in a new GeoPackage file, as the features of its products table.
+// The products without localization have no geometry.
+func writeGeoPackage(filePath string, products []exportedProduct) error {
+	db, err := sql.Open("sqlite", filePath)
+	if err != nil {
+		return fmt.Errorf("failed to open GeoPackage: %w", err)
+	}
+
+	defer db.Close()
+
+	// the pragmas apply to a connection
+	db.SetMaxOpenConns(1)
+
+	statements := append([]string{
+		fmt.Sprintf("PRAGMA application_id = %d", geoPackageApplicationID),
+		fmt.Sprintf("PRAGMA user_version = %d", geoPackageVersion),
+		"PRAGMA journal_mode = OFF",
+	}, geoPackageSchema...)
+
+	for _, statement := range statements {
+		if _, err = db.Exec(statement); err != nil {
+			return fmt.Errorf("failed to create GeoPackage tables: %w", err)
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin GeoPackage transaction: %w", err)
+	}
+
+	defer tx.Rollback() //nolint:errcheck
+
+	insert, err := tx.Prepare(`INSERT INTO ` + geoPackageTable + ` (geom, key, s3_key, bucket, type, group_name, name, date, size,
+		geonames, features_class, features_count, image_url, infos_url, links) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare GeoPackage insertion: %w", err)
+	}
+
+	defer insert.Close()
+
+	var extent *BBox
+
+	for _, product := range products {
+		var geometry []byte
+
+		if product.located {
+			geometry = geoPackageGeometry(product.footprint)
+
+			for _, part := range product.footprint.BBox.split() {
+				if extent == nil {
+					extent = &part
+				} else {
+					union := extent.union(part)
+					extent = &union
+				}
+			}
+		}
+
+		_, err = insert.Exec(geometry, product.api.Key, product.api.S3Key, product.api.Bucket, product.api.Type,
+			product.api.Group, product.api.Name, product.api.Date.UTC().Format(geoPackageDateTime), product.api.Size,
+			product.api.Geonames, product.api.FeaturesClass, product.api.FeaturesCount,
+			product.api.ImageURL, product.api.InfosURL, strings.Join(product.links, "\n"))
+		if err != nil {
+			return fmt.Errorf("failed to insert product %q in GeoPackage: %w", product.api.Key, err)
+		}
+	}
+
+	var minX, minY, maxX, maxY *float64
+	if extent != nil {
+		minX, minY, maxX, maxY = &extent.MinLon, &extent.MinLat, &extent.MaxLon, &extent.MaxLat
+	}
+
+	_, err = tx.Exec(`INSERT INTO gpkg_contents (table_name, data_type, identifier, description, last_change,
+		min_x, min_y, max_x, max_y, srs_id) VALUES (?, 'features', ?, ?, ?, ?, ?, ?, ?, ?)`,
+		geoPackageTable, geoPackageTable, "Footprints of the products of "+config.WindowTitle,
+		time.Now().UTC().Format(geoPackageDateTime), minX, minY, maxX, maxY, wgs84SRSID)
+	if err != nil {
+		return fmt.Errorf("failed to register GeoPackage contents: %w", err)
+	}
+
+	_, err = tx.Exec(`INSERT INTO gpkg_geometry_columns VALUES (?, 'geom', 'MULTIPOLYGON', ?, 0, 0)`, geoPackageTable, wgs84SRSID)
+	if err != nil {
+		return fmt.Errorf("failed to register GeoPackage geometry column: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit GeoPackage: %w", err)
+	}
+
+	return nil
+}
+
+// serveGeoPackage writes the products in a temporary GeoPackage file, and serves it as an attachment.
+func serveGeoPackage(w http.ResponseWriter, r *http.Request, filename string, products []exportedProduct) {
+	file, err := os.CreateTemp("", "export-*.gpkg")
+	if err != nil {
+		printError(fmt.Errorf("failed to create GeoPackage: %w", err), false)
+		prettier(w, "Failed to export the products: "+err.Error(), nil, http.StatusInternalServerError)
+
+		return
+	}
+
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	if err = writeGeoPackage(file.Name(), products); err != nil {
+		printError(err, false)
+		prettier(w, "Failed to export the products: "+err.Error(), nil, http.StatusInternalServerError)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/geopackage+sqlite3")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	http.ServeContent(w, r, "", time.Now(), file)
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	listenerStarting  = "starting"
+	listenerListening = "listening"
+	listenerStopped   = "stopped"
+
+	// readinessTimeout bounds the time spent checking that the buckets can be reached
+	readinessTimeout = 5 * time.Second
+	// pingCacheDuration is how long the result of a bucket ping is reused by the readiness checks,
+	// so that the frequent probes don't hit the S3 server every time
+	pingCacheDuration = 5 * time.Second
+	// maxMissedPolls is the number of polling periods after which a bucket not polled successfully is not ready
+	maxMissedPolls = 3
+)
+
+// bucketHealth tracks the state of the extraction and of the notifications listener of a bucket.
+type bucketHealth struct {
+	mutex              sync.Mutex
+	extracted          bool
+	lastSuccessfulPoll time.Time
+	lastPollError      string
+	listener           string
+	lastListenerError  string
+
+	// pingMutex serializes the pings, the concurrent checks waiting for the result of the current one
+	pingMutex sync.Mutex
+	lastPing  time.Time
+	pingError error
+}
+
+// ping checks that the bucket can be reached, unless it was checked less than pingCacheDuration ago.
+func (health *bucketHealth) ping(ctx context.Context, store ObjectStore) error {
+	health.pingMutex.Lock()
+	defer health.pingMutex.Unlock()
+
+	if time.Since(health.lastPing) < pingCacheDuration {
+		return health.pingError
+	}
+
+	// the result is shared with the other checks, it mustn't depend on the request that triggered it
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), readinessTimeout)
+	defer cancel()
+
+	health.pingError = store.Ping(ctx)
+	health.lastPing = time.Now()
+
+	return health.pingError
+}
+
+func (health *bucketHealth) extractionDone(err error) {
+	health.mutex.Lock()
+	defer health.mutex.Unlock()
+
+	if err != nil {
+		health.lastPollError = err.Error()
+
+		return
+	}
+
+	health.extracted = true
+	health.lastSuccessfulPoll = time.Now()
+	health.lastPollError = ""
+}
+
+func (health *bucketHealth) setListenerState(state string) {
+	health.mutex.Lock()
+	health.listener = state
+	health.mutex.Unlock()
+}
+
+func (health *bucketHealth) listenerError(err error) {
+	health.mutex.Lock()
+	health.lastListenerError = err.Error()
+	health.mutex.Unlock()
+}
+
+// BucketReadiness is the state of a bucket reported by /readyz.
+type BucketReadiness struct {
+	Name               string     `json:"name"`
+	Ready              bool       `json:"ready"`
+	Reachable          bool       `json:"reachable"`
+	ReachabilityError  string     `json:"reachability_error,omitempty"`
+	Extracted          bool       `json:"extracted"`
+	LastSuccessfulPoll *time.Time `json:"last_successful_poll"`
+	LastPollError      string     `json:"last_poll_error,omitempty"`
+	// Listener is empty in polling mode
+	Listener          string `json:"listener,omitempty"`
+	LastListenerError string `json:"last_listener_error,omitempty"`
+}
+
+// CacheDirReadiness tells whether a cache directory can be written.
+type CacheDirReadiness struct {
+	Path     string `json:"path"`
+	Writable bool   `json:"writable"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Readiness is the response of /readyz.
+type Readiness struct {
+	Ready     bool                `json:"ready"`
+	Buckets   []BucketReadiness   `json:"buckets"`
+	CacheDirs []CacheDirReadiness `json:"cache_dirs"`
+}
+
+func (bucket *BucketConfig) readiness(ctx context.Context) BucketReadiness {
+	health := bucket.health
+
+	health.mutex.Lock()
+	result := BucketReadiness{
+		Name:              bucket.name(),
+		Extracted:         health.extracted,
+		LastPollError:     health.lastPollError,
+		LastListenerError: health.lastListenerError,
+	}
+
+	if !health.lastSuccessfulPoll.IsZero() {
+		lastPoll := health.lastSuccessfulPoll
+		result.LastSuccessfulPoll = &lastPoll
+	}
+
+	if !config.PollingMode {
+		result.Listener = health.listener
+	}
+	health.mutex.Unlock()
+
+	if err := health.ping(ctx, bucket.store); err != nil {
+		result.ReachabilityError = err.Error()
+	} else {
+		result.Reachable = true
+	}
+
+	result.Ready = result.Reachable && result.Extracted
+
+	if config.PollingMode {
+		result.Ready = result.Ready && result.LastSuccessfulPoll != nil &&
+			time.Since(*result.LastSuccessfulPoll) < maxMissedPolls*config.PollingPeriod
+	} else {
+		result.Ready = result.Ready && result.Listener == listenerListening
+	}
+
+	return result
+}
+
+// checkWritable creates and removes a file in the directory.
+func checkWritable(dir string) CacheDirReadiness {
+	result := CacheDirReadiness{Path: dir}
+
+	file, err := os.CreateTemp(dir, ".readyz-*")
+	if err != nil {
+		result.Error = err.Error()
+
+		return result
+	}
+
+	_ = file.Close()
+	_ = os.Remove(file.Name())
+
+	result.Writable = true
+
+	return result
+}
+
+func checkReadiness(ctx context.Context) Readiness {
+	ctx, cancel := context.WithTimeout(ctx, readinessTimeout)
+	defer cancel()
+
+	readiness := Readiness{Ready: true, Buckets: make([]BucketReadiness, len(config.Buckets))}
+
+	// the buckets are checked concurrently, as an unreachable one may take until the timeout
+	var wg sync.WaitGroup
+
+	for b := range config.Buckets {
+		wg.Add(1)
+
+		go func(b int) {
+			defer wg.Done()
+
+			readiness.Buckets[b] = config.Buckets[b].readiness(ctx)
+		}(b)
+	}
+
+	for _, dir := range []string{config.mainCacheDir, config.thumbnailsCacheDir} {
+		cacheDir := checkWritable(dir)
+		readiness.Ready = readiness.Ready && cacheDir.Writable
+		readiness.CacheDirs = append(readiness.CacheDirs, cacheDir)
+	}
+
+	wg.Wait()
+
+	for _, bucket := range readiness.Buckets {
+		readiness.Ready = readiness.Ready && bucket.Ready
+	}
+
+	return readiness
+}
+
+// readyzHandler tells whether the server can handle the traffic:
+// all the buckets must be reachable and their images extracted,
+// their notifications listened to or their last poll recent, and the cache directories writable.
+// When the authentication is enabled, the details are only given to the authenticated users,
+// as they hold the names of the buckets, the paths of the cache directories and the errors.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	readiness := checkReadiness(r.Context())
+
+	message, status := "Ready", http.StatusOK
+	if !readiness.Ready {
+		message, status = "Not ready", http.StatusServiceUnavailable
+	}
+
+	if config.Auth.Enabled && identityFromRequest(r) == nil {
+		prettier(w, message, nil, status)
+
+		return
+	}
+
+	prettier(w, message, readiness, status)
+}
+
+// livezHandler tells whether the server is alive, whatever the state of its dependencies.
+func livezHandler(w http.ResponseWriter, _ *http.Request) {
+	prettier(w, "Alive", nil, http.StatusOK)
+}
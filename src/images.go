@@ -2,8 +2,10 @@ package main
 
 import (
 	"io/fs"
+	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -11,6 +13,7 @@ type S3Image struct {
 	S3Key        string
 	LastModified time.Time
 	Size         int64
+	ETag         string
 
 	FormattedKey string
 	// PathOnDisk   string
@@ -48,6 +51,15 @@ func inferImageType(imageName string) *ImageType {
 	return nil
 }
 
+// retentionPeriodOf returns how long the file with the given key is kept in the cache, according to its image type.
+func retentionPeriodOf(key string) time.Duration {
+	if imgType := inferImageType(key); imgType != nil {
+		return imgType.getRetentionPeriod()
+	}
+
+	return config.RetentionPeriod
+}
+
 func (image S3Image) getAssociatedGeonamesPath() string {
 	return image.FormattedKey[:strings.LastIndex(image.FormattedKey, "@")+1] + config.GeonamesFilename
 }
@@ -56,98 +68,234 @@ func (image S3Image) String() string {
 	return image.S3Key
 }
 
+// ImageCache holds the images stored in a cache directory.
+// The images are indexed by S3 key, formatted key and product directory,
+// and are only handed out as copies, so they can be read while the cache is being updated.
 type ImageCache struct {
+	// name identifies the cache in the cache index
+	name       string
 	pathOnDisk string
-	images     []S3Image
+
+	mutex             sync.RWMutex
+	images            map[string]*S3Image
+	imagesByFormatted map[string]*S3Image
+	// dirs holds the S3 keys of the images of each product directory
+	dirs map[string]map[string]struct{}
 }
 
-func (images *ImageCache) findImageByKey(key string) (image *S3Image, found bool) {
-	for i, img := range images.images {
-		if img.S3Key == key {
-			return &images.images[i], true
-		}
+func newImageCache(pathOnDisk string) *ImageCache {
+	return &ImageCache{
+		name:              filepath.Base(pathOnDisk),
+		pathOnDisk:        pathOnDisk,
+		images:            make(map[string]*S3Image),
+		imagesByFormatted: make(map[string]*S3Image),
+		dirs:              make(map[string]map[string]struct{}),
 	}
+}
 
-	return nil, false
+func productDirOf(s3Key string) string {
+	return s3Key[:max(strings.LastIndex(s3Key, "/"), 0)]
 }
 
-func (images *ImageCache) findImageByPrefix(prefix string) (image *S3Image, found bool) {
-	for i, img := range images.images {
-		if strings.HasPrefix(img.S3Key, prefix) {
-			return &images.images[i], true
-		}
+// lookup returns the image having the given S3 key or formatted key. The cache must be locked.
+func (images *ImageCache) lookup(key string) (*S3Image, bool) {
+	if img, found := images.images[key]; found {
+		return img, true
 	}
 
-	return nil, false
+	img, found := images.imagesByFormatted[key]
+
+	return img, found
 }
 
-func (images *ImageCache) toEventObjects() []EventObject {
-	imagesCacheMutex.Lock()
-	defer imagesCacheMutex.Unlock()
+// findImageByKey returns a copy of the image having the given S3 key or formatted key.
+func (images *ImageCache) findImageByKey(key string) (image S3Image, found bool) {
+	images.mutex.RLock()
+	defer images.mutex.RUnlock()
 
-	sort.Slice(images.images, func(i, j int) bool {
-		return images.images[i].LastModified.After(images.images[j].LastModified) // Usage of After to invert the sort order
+	img, found := images.lookup(key)
+	if !found {
+		return S3Image{}, false
+	}
+
+	return *img, true
+}
+
+// findImagesInDir returns a copy of the images stored in the given product directory.
+func (images *ImageCache) findImagesInDir(dir string) []S3Image {
+	images.mutex.RLock()
+	defer images.mutex.RUnlock()
+
+	result := make([]S3Image, 0, len(images.dirs[dir]))
+	for s3Key := range images.dirs[dir] {
+		result = append(result, *images.images[s3Key])
+	}
+
+	return result
+}
+
+// snapshot returns a copy of all the images, from the most recent to the oldest.
+func (images *ImageCache) snapshot() []S3Image {
+	images.mutex.RLock()
+	result := make([]S3Image, 0, len(images.images))
+
+	for _, img := range images.images {
+		result = append(result, *img)
+	}
+	images.mutex.RUnlock()
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].LastModified.After(result[j].LastModified) // Usage of After to invert the sort order
 	})
 
-	maxImagesCount := len(images.images)
+	return result
+}
+
+// count returns the number of images.
+func (images *ImageCache) count() int {
+	images.mutex.RLock()
+	defer images.mutex.RUnlock()
+
+	return len(images.images)
+}
+
+// countByType returns the number of images of each type, the images of unknown types being counted with an empty name.
+func (images *ImageCache) countByType() map[string]int {
+	images.mutex.RLock()
+	defer images.mutex.RUnlock()
+
+	counts := make(map[string]int)
+
+	for _, img := range images.images {
+		if img.Type != nil {
+			counts[img.Type.Name]++
+		} else {
+			counts[""]++
+		}
+	}
+
+	return counts
+}
+
+func (images *ImageCache) toEventObjects(identity *Identity) []EventObject {
+	snapshot := identity.visibleImages(images.snapshot())
+
+	maxImagesCount := len(snapshot)
 	if maxImagesCount > config.MaxImagesDisplayCount {
 		maxImagesCount = config.MaxImagesDisplayCount
 	}
 
 	result := make([]EventObject, maxImagesCount)
 
-	for i, image := range images.images {
-		if i >= maxImagesCount {
-			// convert only the maxImagesCount first images,
-			// maxImagesCount being the minimum between the number of available images and the max images display count
-			break
-		}
-
+	for i, image := range snapshot[:maxImagesCount] {
 		features := Features{}
 
 		if image.AssociatedFeatures != nil {
-			/*for feature, count := range *image.AssociatedFeatures {
-				features += fmt.Sprintf("%s: %d ", feature, count)
-			}*/
 			features = *image.AssociatedFeatures
 		}
 
 		result[i] = EventObject{
-			ImgType:  image.Type.Name,
 			ImgKey:   image.FormattedKey,
 			ImgName:  getGeoname(image.FormattedKey),
 			ImgDate:  image.LastModified.In(time.Local).Format("2006-01-02 15:04:05 MST"), //nolint:gosmopolitan
 			Features: features,
 		}
+
+		if image.Type != nil {
+			result[i].ImgType = image.Type.Name
+		}
 	}
 
 	return result
 }
 
-func (images *ImageCache) addImage(objKey string, size int64, lastModified time.Time) {
-	imagesCacheMutex.Lock()
-	defer imagesCacheMutex.Unlock()
+// putImage adds the image to the cache, or replaces the one having the same key. The cache must be locked.
+func (images *ImageCache) putImage(image S3Image) {
+	images.images[image.S3Key] = &image
+	images.imagesByFormatted[image.FormattedKey] = &image
 
-	images.images = append(images.images, S3Image{
-		S3Key:        objKey,
-		LastModified: lastModified,
-		Size:         size,
-		FormattedKey: strings.ReplaceAll(objKey, "/", "@"),
-		// PathOnDisk:         "",
-		Type:               inferImageType(objKey),
-		AssociatedGeonames: nil,
+	dir := productDirOf(image.S3Key)
+	if images.dirs[dir] == nil {
+		images.dirs[dir] = make(map[string]struct{})
+	}
+
+	images.dirs[dir][image.S3Key] = struct{}{}
+}
+
+// addImage adds the object to the cache. If the image is already there,
+// its object information is updated and its associated metadata are kept.
+func (images *ImageCache) addImage(obj ObjectInfo) {
+	images.mutex.Lock()
+	defer images.mutex.Unlock()
+
+	if img, found := images.images[obj.Key]; found {
+		img.LastModified = obj.LastModified
+		img.Size = obj.Size
+		img.ETag = obj.ETag
+
+		return
+	}
+
+	images.putImage(S3Image{
+		S3Key:        obj.Key,
+		LastModified: obj.LastModified,
+		Size:         obj.Size,
+		ETag:         obj.ETag,
+		FormattedKey: formatFileName(obj.Key),
+		Type:         inferImageType(obj.Key),
 	})
 }
 
+// updateImage replaces the cached image having the same key with the given one.
+func (images *ImageCache) updateImage(image S3Image) {
+	images.mutex.Lock()
+	defer images.mutex.Unlock()
+
+	if _, found := images.images[image.S3Key]; found {
+		images.putImage(image)
+	}
+}
+
+// modifyImage calls fn with the image having the given S3 key or formatted key, while the cache is locked.
+// It returns false if the image is not in the cache.
+func (images *ImageCache) modifyImage(key string, fn func(img *S3Image)) bool {
+	images.mutex.Lock()
+	defer images.mutex.Unlock()
+
+	img, found := images.lookup(key)
+	if found {
+		fn(img)
+	}
+
+	return found
+}
+
 func (images *ImageCache) deleteImage(formattedName string) {
-	imagesCacheMutex.Lock()
-	defer imagesCacheMutex.Unlock()
+	images.mutex.Lock()
+	defer images.mutex.Unlock()
+
+	img, found := images.imagesByFormatted[formattedName]
+	if !found {
+		return
+	}
 
-	for i, img := range images.images {
-		if img.FormattedKey == formattedName {
-			images.images = append(images.images[:i], images.images[i+1:]...)
+	delete(images.images, img.S3Key)
+	delete(images.imagesByFormatted, formattedName)
 
-			return
-		}
+	dir := productDirOf(img.S3Key)
+	delete(images.dirs[dir], img.S3Key)
+
+	if len(images.dirs[dir]) == 0 {
+		delete(images.dirs, dir)
 	}
 }
+
+// clear removes all the images from the cache.
+func (images *ImageCache) clear() {
+	images.mutex.Lock()
+	defer images.mutex.Unlock()
+
+	images.images = make(map[string]*S3Image)
+	images.imagesByFormatted = make(map[string]*S3Image)
+	images.dirs = make(map[string]map[string]struct{})
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestImageCacheConcurrentAccess reads the cache while it is updated from several goroutines,
+// to be run with the race detector: go test -race ./src
+func TestImageCacheConcurrentAccess(t *testing.T) {
+	const (
+		writers          = 4
+		imagesPerWriter  = 200
+		removedPerWriter = 50
+	)
+
+	cache := newImageCache(t.TempDir())
+	date := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	keyOf := func(writer, i int) string {
+		return fmt.Sprintf("my-prefix/TYPE1/writer%d/DIR_%d/preview.jpg", writer, i)
+	}
+
+	var (
+		writersGroup, readersGroup sync.WaitGroup
+		done                       atomic.Bool
+	)
+
+	for writer := range writers {
+		writersGroup.Add(1)
+
+		go func() {
+			defer writersGroup.Done()
+
+			for i := range imagesPerWriter {
+				key := keyOf(writer, i)
+				cache.addImage(ObjectInfo{Key: key, Size: int64(i), LastModified: date.Add(time.Duration(i) * time.Minute)})
+				cache.modifyImage(key, func(img *S3Image) {
+					img.AssociatedFeatures = &Features{Class: "ship", Count: i}
+				})
+			}
+
+			for i := range removedPerWriter {
+				cache.deleteImage(formatFileName(keyOf(writer, i)))
+			}
+		}()
+	}
+
+	// each reader only goes through one method, so that it doesn't synchronize with the writers through the other ones
+	readers := []func(i int){
+		func(i int) {
+			if img, found := cache.findImageByKey(formatFileName(keyOf(i%writers, i%imagesPerWriter))); found {
+				_ = img.AssociatedFeatures
+			}
+		},
+		func(i int) {
+			for _, img := range cache.findImagesInDir(productDirOf(keyOf(i%writers, i%imagesPerWriter))) {
+				_ = img.AssociatedFeatures
+			}
+		},
+		func(int) {
+			for _, img := range cache.snapshot() {
+				_ = img.LastModified
+			}
+		},
+	}
+
+	for _, read := range readers {
+		readersGroup.Add(1)
+
+		go func() {
+			defer readersGroup.Done()
+
+			for i := 0; !done.Load(); i++ {
+				read(i)
+			}
+		}()
+	}
+
+	writersGroup.Wait()
+	done.Store(true)
+	readersGroup.Wait()
+
+	if count := len(cache.snapshot()); count != writers*(imagesPerWriter-removedPerWriter) {
+		t.Fatalf("expected %d images, got %d", writers*(imagesPerWriter-removedPerWriter), count)
+	}
+
+	for writer := range writers {
+		for i := range imagesPerWriter {
+			key := keyOf(writer, i)
+
+			img, found := cache.findImageByKey(key)
+			if found != (i >= removedPerWriter) {
+				t.Errorf("image %q: expected found to be %t", key, i >= removedPerWriter)
+
+				continue
+			}
+
+			if found && (img.AssociatedFeatures == nil || img.AssociatedFeatures.Count != i) {
+				t.Errorf("image %q lost its features", key)
+			}
+
+			if images := cache.findImagesInDir(productDirOf(key)); found && len(images) != 1 {
+				t.Errorf("expected 1 image in the directory of %q, got %d", key, len(images))
+			}
+		}
+	}
+
+	snapshot := cache.snapshot()
+	for i := 1; i < len(snapshot); i++ {
+		if snapshot[i].LastModified.After(snapshot[i-1].LastModified) {
+			t.Fatalf("snapshot not sorted from the most recent image: %v before %v", snapshot[i-1].LastModified, snapshot[i].LastModified)
+		}
+	}
+}
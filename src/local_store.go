@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// localWatchSettleDelay is the time a file must stay untouched
+// before its creation is notified, to avoid notifying partially written files.
+const localWatchSettleDelay = 500 * time.Millisecond
+
+// localStore is the ObjectStore backed by a directory tree,
+// the object keys being the slash-separated paths relative to the root directory.
+type localStore struct {
+	rootDir string
+}
+
+func newLocalStore(rootDir string) (*localStore, error) {
+	absDir, err := filepath.Abs(rootDir)
+	if err != nil {
+		return nil, fmt.Errorf("invalid local directory %q: %w", rootDir, err)
+	}
+
+	info, err := os.Stat(absDir)
+	if err != nil {
+		return nil, fmt.Errorf("invalid local directory %q: %w", rootDir, err)
+	}
+
+	if !info.IsDir() {
+		return nil, fmt.Errorf("invalid local directory %q: not a directory", rootDir)
+	}
+
+	printDebug("Local store directory: ", absDir)
+
+	return &localStore{rootDir: absDir}, nil
+}
+
+func (store *localStore) Name() string {
+	return store.rootDir
+}
+
+func (store *localStore) keyToPath(key string) string {
+	return filepath.Join(store.rootDir, filepath.FromSlash(key))
+}
+
+func (store *localStore) pathToKey(path string) string {
+	rel, err := filepath.Rel(store.rootDir, path)
+	if err != nil {
+		return ""
+	}
+
+	return filepath.ToSlash(rel)
+}
+
+func (store *localStore) objectInfo(path string, info fs.FileInfo) ObjectInfo {
+	return ObjectInfo{
+		Key:          store.pathToKey(path),
+		Size:         info.Size(),
+		LastModified: info.ModTime(),
+		ETag:         fmt.Sprintf("%x-%x", info.ModTime().UnixNano(), info.Size()),
+	}
+}
+
+func (store *localStore) ListObjects(ctx context.Context, prefix string, recursive bool) <-chan ObjectInfo {
+	objects := make(chan ObjectInfo)
+
+	go func() {
+		defer close(objects)
+
+		// Only walk the deepest directory fully contained in the prefix
+		walkRoot := store.rootDir
+		if idx := strings.LastIndex(prefix, "/"); idx != -1 {
+			walkRoot = store.keyToPath(prefix[:idx])
+		}
+
+		err := filepath.WalkDir(walkRoot, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+
+			if ctx.Err() != nil {
+				return ctx.Err() //nolint:wrapcheck
+			}
+
+			if entry.IsDir() {
+				if path != walkRoot && !recursive {
+					return filepath.SkipDir
+				}
+
+				return nil
+			}
+
+			if !strings.HasPrefix(store.pathToKey(path), prefix) {
+				return nil
+			}
+
+			info, err := entry.Info()
+			if err != nil {
+				return err //nolint:wrapcheck
+			}
+
+			select {
+			case objects <- store.objectInfo(path, info):
+			case <-ctx.Done():
+				return ctx.Err() //nolint:wrapcheck
+			}
+
+			return nil
+		})
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			select {
+			case objects <- ObjectInfo{Err: err}:
+			case <-ctx.Done():
+			}
+		}
+	}()
+
+	return objects
+}
+
+func (store *localStore) OpenObject(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error) {
+	path := store.keyToPath(key)
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, ObjectInfo{}, wrapLocalError(err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+
+		return nil, ObjectInfo{}, wrapLocalError(err)
+	}
+
+	return &ctxReader{ctx: ctx, r: file}, store.objectInfo(path, info), nil
+}
+
+func (store *localStore) StatObject(_ context.Context, key string) (ObjectInfo, error) {
+	path := store.keyToPath(key)
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return ObjectInfo{}, wrapLocalError(err)
+	}
+
+	return store.objectInfo(path, info), nil
+}
+
+func (store *localStore) PresignedGetObject(_ context.Context, key string, _ time.Duration) (*url.URL, error) {
+	return &url.URL{Scheme: "file", Path: filepath.ToSlash(store.keyToPath(key))}, nil
+}
+
+func (store *localStore) Ping(_ context.Context) error {
+	info, err := os.Stat(store.rootDir)
+	if err != nil {
+		return wrapLocalError(err)
+	}
+
+	if !info.IsDir() {
+		return fmt.Errorf("%q is not a directory", store.rootDir)
+	}
+
+	return nil
+}
+
+func (store *localStore) Watch(ctx context.Context, prefix, suffix string, eventTypes ...string) <-chan ObjectEvent {
+	events := make(chan ObjectEvent)
+
+	go func() {
+		defer close(events)
+
+		send := func(evt ObjectEvent) bool {
+			if evt.Err == nil {
+				if !strings.HasPrefix(evt.Object.Key, prefix) || !strings.HasSuffix(evt.Object.Key, suffix) || !wantsEvent(eventTypes, evt.Type) {
+					return true
+				}
+			}
+
+			select {
+			case events <- evt:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		watcher, err := fsnotify.NewWatcher()
+		if err != nil {
+			send(ObjectEvent{Err: fmt.Errorf("failed to create file watcher: %w", err)})
+
+			return
+		}
+
+		defer watcher.Close()
+
+		// fsnotify is not recursive, so every directory of the tree must be watched
+		watchTree := func(dir string, emitFiles bool) {
+			_ = filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+				if err != nil {
+					return nil //nolint:nilerr
+				}
+
+				if entry.IsDir() {
+					if err := watcher.Add(path); err != nil {
+						send(ObjectEvent{Err: fmt.Errorf("failed to watch directory %q: %w", path, err)})
+					}
+
+					return nil
+				}
+
+				// The files created before the directory was watched would be missed otherwise
+				if info, err := entry.Info(); err == nil && emitFiles {
+					send(ObjectEvent{Type: objectCreated, Object: store.objectInfo(path, info), Time: info.ModTime()})
+				}
+
+				return nil
+			})
+		}
+
+		watchTree(store.rootDir, false)
+
+		// written files, associated with the time of their last modification
+		pending := make(map[string]time.Time)
+
+		ticker := time.NewTicker(localWatchSettleDelay / 2)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				for path, lastWrite := range pending {
+					if now.Sub(lastWrite) < localWatchSettleDelay {
+						continue
+					}
+
+					delete(pending, path)
+
+					info, err := os.Stat(path)
+					if err != nil {
+						continue
+					}
+
+					if !send(ObjectEvent{Type: objectCreated, Object: store.objectInfo(path, info), Time: info.ModTime()}) {
+						return
+					}
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+
+				if !send(ObjectEvent{Err: err}) {
+					return
+				}
+			case fsEvent, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+
+				switch {
+				case fsEvent.Has(fsnotify.Create) || fsEvent.Has(fsnotify.Write):
+					info, err := os.Stat(fsEvent.Name)
+					if err != nil {
+						continue
+					}
+
+					if info.IsDir() {
+						watchTree(fsEvent.Name, true)
+
+						continue
+					}
+
+					pending[fsEvent.Name] = time.Now()
+				case fsEvent.Has(fsnotify.Remove) || fsEvent.Has(fsnotify.Rename):
+					delete(pending, fsEvent.Name)
+
+					if !send(ObjectEvent{Type: objectRemoved, Object: ObjectInfo{Key: store.pathToKey(fsEvent.Name)}, Time: time.Now()}) {
+						return
+					}
+				}
+			}
+		}
+	}()
+
+	return events
+}
+
+func wrapLocalError(err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("%w: %w", errObjectNotFound, err)
+	}
+
+	return err
+}
+
+// ctxReader stops the reading of the underlying reader once its context is done.
+type ctxReader struct {
+	ctx context.Context //nolint:containedctx
+	r   io.ReadCloser
+}
+
+func (cr *ctxReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err //nolint:wrapcheck
+	}
+
+	return cr.r.Read(p) //nolint:wrapcheck
+}
+
+func (cr *ctxReader) Close() error {
+	return cr.r.Close() //nolint:wrapcheck
+}
@@ -1,16 +1,17 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
 	"sync"
+	"syscall"
 	"time"
-
-	"github.com/minio/minio-go/v7"
-	"github.com/minio/minio-go/v7/pkg/credentials"
 )
 
 var version = "3.3.3-dev"
@@ -21,11 +22,8 @@ var config Config //nolint:gochecknoglobals
 
 //nolint:gochecknoglobals
 var (
-	mainCache                        ImageCache
-	thumbnailsCache                  ImageCache
-	imagesCacheMutex                 sync.Mutex
-	timers                           map[string]*time.Timer
-	timersMutex                      sync.Mutex
+	mainCache                        *ImageCache
+	thumbnailsCache                  *ImageCache
 	geonamesCache                    map[string]Geonames
 	geonamesCacheMutex               sync.Mutex
 	localizationCache                map[string]Localization
@@ -36,6 +34,11 @@ var (
 	fullProductLinksCacheMutex       sync.Mutex
 	additionalProductFilesCache      map[string]time.Time
 	additionalProductFilesCacheMutex sync.Mutex
+	cacheIndex                       *CacheIndex
+	expiryScheduler                  *ExpiryScheduler
+	auditLog                         *AuditLog
+	diskQuota                        *DiskQuota
+	spatialIndex                     *SpatialIndex
 )
 
 var pollMutex sync.Mutex //nolint:gochecknoglobals
@@ -44,6 +47,7 @@ func main() {
 	var (
 		configPath   string
 		printVersion bool
+		hashPassword bool
 		err          error
 	)
 
@@ -55,6 +59,7 @@ func main() {
 
 	flag.StringVar(&configPath, "c", "", "config file path")
 	flag.BoolVar(&printVersion, "v", false, "software version")
+	flag.BoolVar(&hashPassword, "hash-password", false, "print the bcrypt hash of the password read from stdin, for the auth users")
 	flag.Parse()
 
 	if len(os.Args) == 1 {
@@ -67,6 +72,15 @@ func main() {
 		os.Exit(0)
 	}
 
+	if hashPassword {
+		err = printPasswordHash(os.Stdin)
+		if err != nil {
+			exitWithError(err)
+		}
+
+		os.Exit(0)
+	}
+
 	if len(configPath) == 0 {
 		exitWithError(errors.New("no configuration file provided (-c <file-path>)"))
 	}
@@ -83,53 +97,97 @@ func main() {
 		log.Println("\nStarting S3 Image Server " + version + " ...\n")
 	}
 
-	minioClient, err := minio.New(config.S3.EndPoint, &minio.Options{
-		Creds:  credentials.NewStaticV4(config.S3.AccessID, config.S3.AccessSecret, ""),
-		Secure: config.S3.UseSSL,
-	})
+	initLogger()
+
+	for b := range config.Buckets {
+		bucket := &config.Buckets[b]
+
+		bucket.store, err = newObjectStore(bucket.S3Config)
+		if err != nil {
+			exitWithError(fmt.Errorf("failed to create the store of bucket [%s]: %w", bucket.name(), err))
+		}
+
+		bucket.health = &bucketHealth{listener: listenerStarting}
+	}
+
+	auth, err := newAuthenticator(config.Auth)
 	if err != nil {
-		exitWithError(err)
+		exitWithError(fmt.Errorf("failed to initialize authentication: %w", err))
 	}
 
-	initLogger()
+	auditLog, err = openAuditLog(config.Audit)
+	if err != nil {
+		exitWithError(err)
+	}
 
-	if config.HTTPTrace {
-		minioClient.TraceOn(os.Stdout)
+	cacheIndex, err = openCacheIndex(config.BaseCacheDir)
+	if err != nil {
+		exitWithError(err)
 	}
 
-	printDebug("S3 endpoint:", minioClient.EndpointURL())
+	eventChan := make(chan event, 1)
+
+	// the files found in the caches are recorded in the disk quota
+	diskQuota = newDiskQuota(eventChan)
+
+	spatialIndex = newSpatialIndex()
 
 	mainCache = createCache(config.mainCacheDir)
 	thumbnailsCache = createCache(config.thumbnailsCacheDir)
 
-	eventChan := make(chan event, 1)
-	timers = make(map[string]*time.Timer)
 	geonamesCache = make(map[string]Geonames)
 	localizationCache = make(map[string]Localization)
 	featuresCache = make(map[string]Features)
+	fullProductLinksCache = make(map[string][]string)
 	additionalProductFilesCache = make(map[string]time.Time)
 
+	expiryScheduler = newExpiryScheduler(eventChan)
+
+	cacheIndex.restoreImages(mainCache)
+	cacheIndex.restoreImages(thumbnailsCache)
+	cacheIndex.restoreFiles()
+	cacheIndex.restorePins()
+	cacheIndex.restoreEvicted()
+	removeOrphanedVariants()
+
+	go expiryScheduler.run()
+	go diskQuota.run()
+
+	// the polling and the notifications listeners are stopped on SIGINT or SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	server, hub := newWebServer(config.WebServerPort, eventChan, auth)
+
 	go func() {
 		if config.PollingMode {
-			pollBucket(minioClient, eventChan)
+			pollBuckets(ctx, eventChan)
 		} else {
-			listenToBucket(minioClient, eventChan)
+			for b := range config.Buckets {
+				listenToBucket(ctx, &config.Buckets[b], eventChan)
+			}
 		}
 
-		err = startWSServer(config.WebServerPort, eventChan, minioClient)
-		if err != nil {
+		printInfo("Starting web socket server on port ", config.WebServerPort, " ...")
+
+		err := server.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
 			exitWithError(err)
 		}
 	}()
 
-	err = extractFilesFromBucket(minioClient, eventChan)
-	if err != nil {
-		exitWithError(fmt.Errorf("failed to extract files from bucket: %w", err))
+	for b := range config.Buckets {
+		err = extractFilesFromBucket(ctx, &config.Buckets[b], eventChan)
+		if err != nil && ctx.Err() == nil {
+			exitWithError(fmt.Errorf("failed to extract files from bucket [%s]: %w", config.Buckets[b].name(), err))
+		}
 	}
 
 	printDebug("S3 images have been stored in ", config.mainCacheDir)
 
-	wg := new(sync.WaitGroup)
-	wg.Add(1)
-	wg.Wait()
+	<-ctx.Done()
+	// a second signal kills the server without waiting for the shutdown
+	stop()
+
+	shutdown(server, hub)
 }
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "s3_image_server"
+
+const (
+	resultSuccess  = "success"
+	resultNotFound = "not_found"
+	resultError    = "error"
+
+	transportWS  = "websocket"
+	transportSSE = "sse"
+)
+
+//nolint:gochecknoglobals
+var (
+	s3GetDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "s3_get_duration_seconds",
+		Help:      "Duration of the downloads of the S3 objects, retries included.",
+		Buckets:   []float64{.01, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"result"})
+
+	s3GetAttemptErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "s3_get_attempt_errors_total",
+		Help:      "Number of failed download attempts of S3 objects, including the ones that were retried.",
+	})
+
+	s3ChecksumMismatches = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "s3_checksum_mismatches_total",
+		Help:      "Number of downloads discarded because their size or checksum didn't match the object.",
+	})
+
+	extractDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "extract_duration_seconds",
+		Help:      "Duration of the cycles looking for new images in a bucket.",
+		Buckets:   []float64{.1, .5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+	}, []string{"bucket", "result"})
+
+	expirationsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "expirations_total",
+		Help:      "Number of images removed from the caches at the end of their retention period.",
+	}, []string{"cache"})
+
+	cacheEvictionsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "cache_evictions_total",
+		Help:      "Number of images evicted from the caches to keep them within their maximum size.",
+	}, []string{"cache"})
+
+	hubClients = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "hub_clients",
+		Help:      "Number of clients connected to the events streams.",
+	}, []string{"transport"})
+
+	hubDroppedClients = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "hub_dropped_clients_total",
+		Help:      "Number of clients disconnected because they didn't read their events fast enough.",
+	}, []string{"transport"})
+
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Duration of the HTTP requests, by route.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method", "code"})
+)
+
+func init() {
+	prometheus.MustRegister(cacheCollector{
+		images: prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "cache", "images"),
+			"Number of images in the main cache, by image type.", []string{"type"}, nil),
+		diskBytes: prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "cache", "disk_bytes"),
+			"Size of the files stored in each cache directory.", []string{"cache"}, nil),
+	})
+}
+
+// cacheCollector computes the cache metrics when they are scraped.
+type cacheCollector struct {
+	images    *prometheus.Desc
+	diskBytes *prometheus.Desc
+}
+
+func (collector cacheCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- collector.images
+	ch <- collector.diskBytes
+}
+
+func (collector cacheCollector) Collect(ch chan<- prometheus.Metric) {
+	if mainCache == nil || thumbnailsCache == nil || diskQuota == nil {
+		return
+	}
+
+	for imgType, count := range mainCache.countByType() {
+		ch <- prometheus.MustNewConstMetric(collector.images, prometheus.GaugeValue, float64(count), imgType)
+	}
+
+	// the sizes tracked by the disk quota, the directories are not walked
+	for _, usage := range diskQuota.usage() {
+		ch <- prometheus.MustNewConstMetric(collector.diskBytes, prometheus.GaugeValue, float64(usage.Size), usage.Name)
+	}
+}
+
+func (c *Client) transport() string {
+	if c.conn == nil {
+		return transportSSE
+	}
+
+	return transportWS
+}
+
+// handleFunc registers the handler of the route, measuring the duration of its requests and compressing its JSON responses.
+// The events streams must not be registered with it, as their requests last as long as the connections.
+func handleFunc(route string, handler http.HandlerFunc) {
+	http.Handle(route, promhttp.InstrumentHandlerDuration(httpRequestDuration.MustCurryWith(prometheus.Labels{"route": route}), compressed(handler)))
+}
+
+// metricsHandler exposes the metrics in the Prometheus format.
+func metricsHandler() http.HandlerFunc {
+	return promhttp.Handler().ServeHTTP
+}
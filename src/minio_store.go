@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// minioStore is the ObjectStore backed by an S3 bucket.
+type minioStore struct {
+	client     *minio.Client
+	bucketName string
+}
+
+func newMinioStore(s3Config S3Config) (*minioStore, error) {
+	minioClient, err := minio.New(s3Config.EndPoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(s3Config.AccessID, s3Config.AccessSecret, ""),
+		Secure: s3Config.UseSSL,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create S3 client: %w", err)
+	}
+
+	if config.HTTPTrace {
+		minioClient.TraceOn(os.Stdout)
+	}
+
+	printDebug("S3 endpoint:", minioClient.EndpointURL())
+
+	return &minioStore{client: minioClient, bucketName: s3Config.BucketName}, nil
+}
+
+func (store *minioStore) Name() string {
+	return store.bucketName
+}
+
+func (store *minioStore) ListObjects(ctx context.Context, prefix string, recursive bool) <-chan ObjectInfo {
+	objects := make(chan ObjectInfo)
+
+	go func() {
+		defer close(objects)
+
+		for obj := range store.client.ListObjects(ctx, store.bucketName, minio.ListObjectsOptions{Prefix: prefix, Recursive: recursive}) {
+			select {
+			case objects <- objectInfoFromMinio(obj):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return objects
+}
+
+func (store *minioStore) OpenObject(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error) {
+	// the checksums are only sent by S3 when they are requested
+	obj, err := store.client.GetObject(ctx, store.bucketName, key, minio.GetObjectOptions{Checksum: true})
+	if err != nil {
+		return nil, ObjectInfo{}, wrapMinioError(err)
+	}
+
+	info, err := obj.Stat()
+	if err != nil {
+		_ = obj.Close()
+
+		return nil, ObjectInfo{}, wrapMinioError(err)
+	}
+
+	return obj, objectInfoFromMinio(info), nil
+}
+
+func (store *minioStore) StatObject(ctx context.Context, key string) (ObjectInfo, error) {
+	obj, err := store.client.StatObject(ctx, store.bucketName, key, minio.StatObjectOptions{})
+	if err != nil {
+		return ObjectInfo{}, wrapMinioError(err)
+	}
+
+	return objectInfoFromMinio(obj), nil
+}
+
+func (store *minioStore) PresignedGetObject(ctx context.Context, key string, expiry time.Duration) (*url.URL, error) {
+	return store.client.PresignedGetObject(ctx, store.bucketName, key, expiry, url.Values{}) //nolint:wrapcheck
+}
+
+func (store *minioStore) Ping(ctx context.Context) error {
+	exists, err := store.client.BucketExists(ctx, store.bucketName)
+	if err != nil {
+		return wrapMinioError(err)
+	}
+
+	if !exists {
+		return fmt.Errorf("bucket %q: %w", store.bucketName, errObjectNotFound)
+	}
+
+	return nil
+}
+
+func (store *minioStore) Watch(ctx context.Context, prefix, suffix string, eventTypes ...string) <-chan ObjectEvent {
+	var s3Events []string
+
+	if wantsEvent(eventTypes, objectCreated) {
+		s3Events = append(s3Events, "s3:ObjectCreated:*")
+	}
+
+	if wantsEvent(eventTypes, objectRemoved) {
+		s3Events = append(s3Events, "s3:ObjectRemoved:*")
+	}
+
+	events := make(chan ObjectEvent)
+
+	go func() {
+		defer close(events)
+
+		for notif := range store.client.ListenBucketNotification(ctx, store.bucketName, prefix, suffix, s3Events) {
+			if notif.Err != nil {
+				select {
+				case events <- ObjectEvent{Err: notif.Err}:
+				case <-ctx.Done():
+					return
+				}
+
+				continue
+			}
+
+			for _, record := range notif.Records {
+				evt := ObjectEvent{
+					Object: ObjectInfo{
+						Key:  record.S3.Object.Key,
+						Size: record.S3.Object.Size,
+						ETag: record.S3.Object.ETag,
+					},
+				}
+
+				switch {
+				case strings.HasPrefix(record.EventName, "s3:ObjectCreated"):
+					evt.Type = objectCreated
+				case strings.HasPrefix(record.EventName, "s3:ObjectRemoved"):
+					evt.Type = objectRemoved
+				default:
+					continue
+				}
+
+				//                             2016–09–08T22:34:38.226Z
+				evtTime, err := time.Parse("2006-01-02T15:04:05.000Z", record.EventTime)
+				if err != nil {
+					printWarn("Failed to parse event time: ", err)
+
+					evtTime = time.Now()
+				}
+
+				evt.Time = evtTime
+				evt.Object.LastModified = evtTime
+
+				select {
+				case events <- evt:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return events
+}
+
+func wrapMinioError(err error) error {
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return fmt.Errorf("%w: %w", errObjectNotFound, err)
+	}
+
+	return err
+}
+
+func objectInfoFromMinio(obj minio.ObjectInfo) ObjectInfo {
+	return ObjectInfo{
+		Key:            obj.Key,
+		Size:           obj.Size,
+		LastModified:   obj.LastModified,
+		ETag:           obj.ETag,
+		ChecksumSHA256: obj.ChecksumSHA256,
+		ChecksumSHA1:   obj.ChecksumSHA1,
+		ChecksumCRC32C: obj.ChecksumCRC32C,
+		ChecksumCRC32:  obj.ChecksumCRC32,
+		Encrypted:      isServerSideEncrypted(obj.Metadata),
+		Err:            obj.Err,
+	}
+}
+
+// isServerSideEncrypted returns whether the response headers of an object announce its server-side encryption.
+func isServerSideEncrypted(metadata http.Header) bool {
+	for name := range metadata {
+		if strings.HasPrefix(http.CanonicalHeaderKey(name), "X-Amz-Server-Side-Encryption") {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"time"
+)
+
+const (
+	objectCreated = "created"
+	objectRemoved = "removed"
+)
+
+// errObjectNotFound is wrapped by the errors of the stores when the requested object doesn't exist.
+var errObjectNotFound = errors.New("object not found")
+
+// ObjectInfo describes an object stored in an ObjectStore.
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+	ETag         string
+	// the checksums computed by S3 when the object was uploaded with one, base64 encoded
+	ChecksumSHA256 string
+	ChecksumSHA1   string
+	ChecksumCRC32C string
+	ChecksumCRC32  string
+	// Encrypted is set when the object is encrypted on the server side (SSE-S3, SSE-KMS or SSE-C),
+	// its ETag is then not the MD5 of its content
+	Encrypted bool
+	Err       error
+}
+
+// ObjectEvent is a change notification emitted by ObjectStore.Watch.
+type ObjectEvent struct {
+	Type   string // objectCreated or objectRemoved
+	Object ObjectInfo
+	Time   time.Time
+	Err    error
+}
+
+// ObjectStore abstracts the storage the images are fetched from,
+// so that the server can run against an S3 bucket or a local directory.
+type ObjectStore interface {
+	// Name returns the bucket name, or the root directory for a local store.
+	Name() string
+	// ListObjects lists the objects whose key starts with the given prefix.
+	// The channel is closed once all the objects have been sent.
+	ListObjects(ctx context.Context, prefix string, recursive bool) <-chan ObjectInfo
+	// OpenObject returns the content of the object, along with its information.
+	OpenObject(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error)
+	StatObject(ctx context.Context, key string) (ObjectInfo, error)
+	PresignedGetObject(ctx context.Context, key string, expiry time.Duration) (*url.URL, error)
+	// Watch sends an event for every object matching the given prefix and suffix
+	// that is created or removed, until the context is canceled.
+	// If no event type is given, all of them are sent.
+	Watch(ctx context.Context, prefix, suffix string, eventTypes ...string) <-chan ObjectEvent
+	// Ping checks that the bucket, or the root directory, can be reached.
+	Ping(ctx context.Context) error
+}
+
+func newObjectStore(s3Config S3Config) (ObjectStore, error) {
+	switch s3Config.Backend {
+	case backendS3:
+		return newMinioStore(s3Config)
+	case backendLocal:
+		return newLocalStore(s3Config.LocalDir)
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", s3Config.Backend)
+	}
+}
+
+func wantsEvent(eventTypes []string, eventType string) bool {
+	if len(eventTypes) == 0 {
+		return true
+	}
+
+	for _, t := range eventTypes {
+		if t == eventType {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// allGroups can be used in the groups of a role to grant rights on all the image groups.
+const allGroups = "*"
+
+// permissions are the rights granted to an identity by its roles.
+type permissions struct {
+	viewAll  bool
+	adminAll bool
+	// view and admin hold the names of the image groups the identity can see or administrate
+	view  map[string]struct{}
+	admin map[string]struct{}
+}
+
+// resolvePermissions merges the rights of the given roles.
+// When no role is configured, the authenticated users have all the rights.
+func resolvePermissions(roles map[string]AuthRole, roleNames []string) permissions {
+	if len(roles) == 0 {
+		return permissions{viewAll: true, adminAll: true}
+	}
+
+	perms := permissions{view: make(map[string]struct{}), admin: make(map[string]struct{})}
+
+	for _, name := range roleNames {
+		role, found := roles[name]
+		if !found {
+			printDebug("Ignoring unknown role '" + name + "'")
+
+			continue
+		}
+
+		for _, group := range role.Groups {
+			if group == allGroups {
+				perms.viewAll = true
+				perms.adminAll = perms.adminAll || role.Admin
+
+				continue
+			}
+
+			perms.view[group] = struct{}{}
+
+			if role.Admin {
+				perms.admin[group] = struct{}{}
+			}
+		}
+	}
+
+	return perms
+}
+
+// The following methods can be called on a nil identity, when the authentication is disabled,
+// in which case everything is allowed.
+
+func (identity *Identity) canViewGroup(group string) bool {
+	if identity == nil || identity.permissions.viewAll {
+		return true
+	}
+
+	_, found := identity.permissions.view[group]
+
+	return found
+}
+
+func (identity *Identity) canAdministrateGroup(group string) bool {
+	if identity == nil || identity.permissions.adminAll {
+		return true
+	}
+
+	_, found := identity.permissions.admin[group]
+
+	return found
+}
+
+// isAdmin returns whether the identity can administrate all the image groups,
+// which is required by the actions affecting the whole server.
+func (identity *Identity) isAdmin() bool {
+	return identity == nil || identity.permissions.adminAll
+}
+
+// canViewType returns whether the identity can see the images of the given type.
+// The images of unknown types are only visible to the identities that can see all the groups.
+func (identity *Identity) canViewType(imgType *ImageType) bool {
+	if identity == nil || identity.permissions.viewAll {
+		return true
+	}
+
+	return imgType != nil && identity.canViewGroup(imgType.group)
+}
+
+// canViewKey returns whether the identity can see the image or file with the given key.
+func (identity *Identity) canViewKey(key string) bool {
+	if identity == nil || identity.permissions.viewAll {
+		return true
+	}
+
+	return identity.canViewType(inferImageType(strings.ReplaceAll(key, "@", "/")))
+}
+
+// visibleImages returns the images the identity can see.
+func (identity *Identity) visibleImages(images []S3Image) []S3Image {
+	if identity == nil || identity.permissions.viewAll {
+		return images
+	}
+
+	visible := make([]S3Image, 0, len(images))
+
+	for _, img := range images {
+		if identity.canViewType(img.Type) {
+			visible = append(visible, img)
+		}
+	}
+
+	return visible
+}
+
+// visibleGroups returns the image groups the identity can see.
+func (identity *Identity) visibleGroups(groups []ImageGroup) []ImageGroup {
+	if identity == nil || identity.permissions.viewAll {
+		return groups
+	}
+
+	visible := make([]ImageGroup, 0, len(groups))
+
+	for _, group := range groups {
+		if identity.canViewGroup(group.GroupName) {
+			visible = append(visible, group)
+		}
+	}
+
+	return visible
+}
+
+// visibleTypes returns the image types the identity can see.
+func (identity *Identity) visibleTypes(imgTypes []ImageType) []ImageType {
+	if identity == nil || identity.permissions.viewAll {
+		return imgTypes
+	}
+
+	visible := make([]ImageType, 0, len(imgTypes))
+
+	for _, imgType := range imgTypes {
+		if identity.canViewGroup(imgType.group) {
+			visible = append(visible, imgType)
+		}
+	}
+
+	return visible
+}
+
+// requireAdmin rejects the requests of the users who can't administrate all the image groups.
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !identityFromRequest(r).isAdmin() {
+			prettier(w, "Forbidden", nil, http.StatusForbidden)
+
+			return
+		}
+
+		next(w, r)
+	}
+}
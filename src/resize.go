@@ -0,0 +1,491 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/gif" // the GIF previews are resized to PNG
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	fitContain = "contain"
+	fitCover   = "cover"
+	fitFill    = "fill"
+
+	// resizedMarker separates the key of an image from the size of its resized variants,
+	// which are stored in the main cache next to it, e.g. my@product@preview.jpg.resized.256x0.contain
+	resizedMarker = ".resized."
+
+	maxResizeDimension = 4096
+	// maxResizeSourcePixels bounds the size of the images decoded to be resized
+	maxResizeSourcePixels = 100_000_000
+	resizeJPEGQuality     = 85
+	// resizeWindow bounds the number of source pixels copied at once while an image is resized
+	resizeWindow = 4096
+
+	// galleryThumbnailWidth is the width of the previews displayed in the gallery
+	galleryThumbnailWidth = 512
+
+	// maxResizedVariants bounds the number of resized variants kept for an image,
+	// so that the requests for many different sizes can't fill the disk
+	maxResizedVariants = 8
+)
+
+var errImageTooLarge = errors.New("image too large to be resized")
+
+//nolint:gochecknoglobals
+var (
+	// resizedVariants holds the last use of the resized variants of each image, by formatted key and file name
+	resizedVariants      = make(map[string]map[string]time.Time)
+	resizedVariantsMutex sync.Mutex
+	// resizeSemaphore bounds the number of images resized concurrently
+	resizeSemaphore = make(chan struct{}, runtime.NumCPU())
+)
+
+// resizeSpec is the size requested for an image. A zero dimension is computed from the other one.
+type resizeSpec struct {
+	width  int
+	height int
+	// fit is fitContain to fit the image in the box, fitCover to fill the box by cropping the image,
+	// or fitFill to stretch the image to the box
+	fit string
+}
+
+// parseResizeSpec reads the w, h and fit query parameters, and returns false if none of them is given.
+func parseResizeSpec(values url.Values) (spec resizeSpec, resize bool, err error) {
+	if !values.Has("w") && !values.Has("h") && !values.Has("fit") {
+		return resizeSpec{}, false, nil
+	}
+
+	parseDimension := func(name string) (int, error) {
+		raw := values.Get(name)
+		if raw == "" {
+			return 0, nil
+		}
+
+		dimension, err := strconv.Atoi(raw)
+		if err != nil || dimension < 0 || dimension > maxResizeDimension {
+			return 0, fmt.Errorf("invalid '%s', expected a number of pixels between 0 and %d", name, maxResizeDimension)
+		}
+
+		return dimension, nil
+	}
+
+	if spec.width, err = parseDimension("w"); err != nil {
+		return resizeSpec{}, false, err
+	}
+
+	if spec.height, err = parseDimension("h"); err != nil {
+		return resizeSpec{}, false, err
+	}
+
+	if spec.width == 0 && spec.height == 0 {
+		return resizeSpec{}, false, errors.New("no 'w' nor 'h' provided")
+	}
+
+	spec.fit = values.Get("fit")
+
+	switch spec.fit {
+	case "":
+		spec.fit = fitContain
+	case fitContain, fitCover:
+	case fitFill:
+		if spec.width == 0 || spec.height == 0 {
+			return resizeSpec{}, false, errors.New("both 'w' and 'h' must be provided with 'fit=fill'")
+		}
+	default:
+		return resizeSpec{}, false, fmt.Errorf("invalid 'fit', expected '%s', '%s' or '%s'", fitContain, fitCover, fitFill)
+	}
+
+	return spec, true, nil
+}
+
+// variantName returns the name of the file holding the variant of the image in the main cache.
+func (spec resizeSpec) variantName(formattedKey string) string {
+	return fmt.Sprintf("%s%s%dx%d.%s", formattedKey, resizedMarker, spec.width, spec.height, spec.fit)
+}
+
+// variantETag derives the ETag of a variant from the one of its image, so that it changes along with the image.
+func variantETag(img S3Image, spec resizeSpec) string {
+	if img.ETag == "" {
+		return ""
+	}
+
+	return fmt.Sprintf("%s-%dx%d-%s", strings.Trim(img.ETag, `"`), spec.width, spec.height, spec.fit)
+}
+
+// geometry returns the part of the source image that is kept, and the size it is scaled to.
+// The images are never enlarged, except to fill the box with fitFill.
+func (spec resizeSpec) geometry(bounds image.Rectangle) (crop image.Rectangle, width, height int) {
+	srcWidth, srcHeight := float64(bounds.Dx()), float64(bounds.Dy())
+	widthRatio, heightRatio := float64(spec.width)/srcWidth, float64(spec.height)/srcHeight
+
+	switch {
+	case spec.fit == fitFill:
+		return bounds, spec.width, spec.height
+	case spec.fit == fitCover && spec.width > 0 && spec.height > 0:
+		scale := math.Min(1, math.Max(widthRatio, heightRatio))
+		width = min(spec.width, max(1, int(math.Round(srcWidth*scale))))
+		height = min(spec.height, max(1, int(math.Round(srcHeight*scale))))
+
+		cropWidth := min(bounds.Dx(), int(math.Round(float64(width)/scale)))
+		cropHeight := min(bounds.Dy(), int(math.Round(float64(height)/scale)))
+		origin := bounds.Min.Add(image.Pt((bounds.Dx()-cropWidth)/2, (bounds.Dy()-cropHeight)/2))
+
+		return image.Rectangle{Min: origin, Max: origin.Add(image.Pt(cropWidth, cropHeight))}, width, height
+	default:
+		scale := 1.0
+		if spec.width > 0 {
+			scale = math.Min(scale, widthRatio)
+		}
+
+		if spec.height > 0 {
+			scale = math.Min(scale, heightRatio)
+		}
+
+		return bounds, max(1, int(math.Round(srcWidth*scale))), max(1, int(math.Round(srcHeight*scale)))
+	}
+}
+
+// scaledRow is a row of the source image scaled to the width of the resized image, 4 channels per pixel.
+type scaledRow struct {
+	y      int
+	values []float64
+}
+
+// resizeImage scales the given part of the image to width x height,
+// every destination pixel being the average of the source pixels it covers.
+// The source is read row by row, through a window of at most resizeWindow pixels, and only the two last rows
+// scaled to the destination width are kept, so that the memory used besides the resized image
+// doesn't depend on the size of the source.
+func resizeImage(src image.Image, crop image.Rectangle, width, height int) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+
+	if crop.Dx() == width && crop.Dy() == height {
+		draw.Draw(dst, dst.Bounds(), src, crop.Min, draw.Src)
+
+		return dst
+	}
+
+	xScale, yScale := float64(crop.Dx())/float64(width), float64(crop.Dy())/float64(height)
+
+	window := image.NewRGBA(image.Rect(0, 0, min(resizeWindow, crop.Dx()), 1))
+	windowStart := 0
+
+	// scale fills values with the source row y of the crop scaled to the destination width
+	scale := func(y int, values []float64) {
+		// the window is loaded again for every row
+		windowStart = crop.Dx()
+
+		for x := range width {
+			start, end := float64(x)*xScale, float64(x+1)*xScale
+			pixel := values[x*4 : x*4+4]
+			clear(pixel)
+
+			var total float64
+
+			for s := int(start); s < crop.Dx() && float64(s) < end; s++ {
+				weight := math.Min(end, float64(s+1)) - math.Max(start, float64(s))
+				if weight <= 0 {
+					continue
+				}
+
+				// the source pixels are read in order, the window only moves forward
+				if s < windowStart || s >= windowStart+window.Rect.Dx() {
+					windowStart = s
+					draw.Draw(window, image.Rect(0, 0, min(window.Rect.Dx(), crop.Dx()-s), 1),
+						src, image.Pt(crop.Min.X+s, crop.Min.Y+y), draw.Src)
+				}
+
+				offset := (s - windowStart) * 4
+				for c := range pixel {
+					pixel[c] += float64(window.Pix[offset+c]) * weight
+				}
+
+				total += weight
+			}
+
+			for c := range pixel {
+				pixel[c] /= total
+			}
+		}
+	}
+
+	// consecutive destination rows share a source row at most, the two last scaled rows are enough
+	rows := [2]scaledRow{{y: -1, values: make([]float64, width*4)}, {y: -1, values: make([]float64, width*4)}}
+	next := 0
+
+	scaled := func(y int) []float64 {
+		for _, row := range rows {
+			if row.y == y {
+				return row.values
+			}
+		}
+
+		row := &rows[next]
+		next = 1 - next
+
+		scale(y, row.values)
+		row.y = y
+
+		return row.values
+	}
+
+	pixels := make([]float64, width*4)
+
+	for y := range height {
+		start, end := float64(y)*yScale, float64(y+1)*yScale
+		clear(pixels)
+
+		var total float64
+
+		for s := int(start); s < crop.Dy() && float64(s) < end; s++ {
+			weight := math.Min(end, float64(s+1)) - math.Max(start, float64(s))
+			if weight <= 0 {
+				continue
+			}
+
+			for i, value := range scaled(s) {
+				pixels[i] += value * weight
+			}
+
+			total += weight
+		}
+
+		dstRow := dst.Pix[y*dst.Stride : y*dst.Stride+width*4]
+		for i, value := range pixels {
+			dstRow[i] = uint8(math.Min(255, math.Round(value/total)))
+		}
+	}
+
+	return dst
+}
+
+// encodeResized writes the resized image in JPEG if the source was a JPEG, in PNG otherwise.
+func encodeResized(w io.Writer, img image.Image, format string) error {
+	if format == "jpeg" {
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: resizeJPEGQuality}) //nolint:wrapcheck
+	}
+
+	return png.Encode(w, img) //nolint:wrapcheck
+}
+
+// decodeCachedImage decodes the image of the main cache, and returns it with its format.
+// It fails with errImageTooLarge instead of decoding the images having more than maxResizeSourcePixels pixels.
+func decodeCachedImage(img S3Image) (image.Image, string, error) {
+	src, err := os.Open(filepath.Join(config.mainCacheDir, img.FormattedKey))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to open image: %w", err)
+	}
+
+	defer src.Close()
+
+	// the size is checked before the image is decoded, to avoid allocating huge images
+	imgConfig, _, err := image.DecodeConfig(src)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to decode image: %w", err)
+	}
+
+	if imgConfig.Width*imgConfig.Height > maxResizeSourcePixels {
+		return nil, "", fmt.Errorf("%w: %dx%d", errImageTooLarge, imgConfig.Width, imgConfig.Height)
+	}
+
+	if _, err = src.Seek(0, io.SeekStart); err != nil {
+		return nil, "", fmt.Errorf("failed to read image: %w", err)
+	}
+
+	decoded, format, err := image.Decode(src)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to decode image: %w", err)
+	}
+
+	return decoded, format, nil
+}
+
+// generateVariant resizes the image of the main cache to the given file.
+func generateVariant(img S3Image, spec resizeSpec, filePath string) error {
+	decoded, format, err := decodeCachedImage(img)
+	if err != nil {
+		return err
+	}
+
+	crop, width, height := spec.geometry(decoded.Bounds())
+	resized := resizeImage(decoded, crop, width, height)
+
+	tmpFile, err := os.CreateTemp(filepath.Dir(filePath), "."+filepath.Base(filePath)+".*"+downloadTempSuffix)
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+
+	tmpPath := tmpFile.Name()
+
+	err = encodeResized(tmpFile, resized, format)
+	if err == nil {
+		err = tmpFile.Chmod(0o644) //nolint:gosec
+	}
+
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		// the variant has the date of its image, so that it is generated again when the image is updated
+		err = os.Chtimes(tmpPath, img.LastModified, img.LastModified)
+	}
+
+	if err == nil {
+		err = os.Rename(tmpPath, filePath)
+	}
+
+	if err != nil {
+		_ = os.Remove(tmpPath)
+
+		return fmt.Errorf("failed to write resized image: %w", err)
+	}
+
+	return nil
+}
+
+// resizedVariant returns the name of the file of the main cache holding the image resized according to spec,
+// generating it if it doesn't exist or if the image was updated since.
+func resizedVariant(img S3Image, spec resizeSpec) (string, error) {
+	name := spec.variantName(img.FormattedKey)
+	filePath := filepath.Join(config.mainCacheDir, name)
+
+	isUpToDate := func() bool {
+		info, err := os.Stat(filePath)
+
+		return err == nil && info.ModTime().Truncate(time.Second).Equal(img.LastModified.Truncate(time.Second))
+	}
+
+	if isUpToDate() {
+		registerResizedVariant(name, time.Now())
+
+		return name, nil
+	}
+
+	resizeSemaphore <- struct{}{}
+	defer func() { <-resizeSemaphore }()
+
+	// the variant may have been generated by a concurrent request meanwhile
+	if isUpToDate() {
+		registerResizedVariant(name, time.Now())
+
+		return name, nil
+	}
+
+	if err := generateVariant(img, spec, filePath); err != nil {
+		return "", err
+	}
+
+	if info, err := os.Stat(filePath); err == nil {
+		diskQuota.fileAdded(config.mainCacheDir, name, info.Size(), time.Now())
+	}
+
+	registerResizedVariant(name, time.Now())
+	evictResizedVariants(img.FormattedKey)
+
+	// the image may have been removed while it was resized
+	if _, found := mainCache.findImageByKey(img.FormattedKey); !found {
+		removeResizedVariants(img.FormattedKey)
+	}
+
+	return name, nil
+}
+
+// isResizedVariant returns whether the file of the main cache is a resized variant of an image.
+func isResizedVariant(filename string) bool {
+	return strings.Contains(filename, resizedMarker)
+}
+
+// registerResizedVariant records the variant along with its last use.
+func registerResizedVariant(filename string, lastUse time.Time) {
+	formattedKey := filename[:strings.LastIndex(filename, resizedMarker)]
+
+	resizedVariantsMutex.Lock()
+	defer resizedVariantsMutex.Unlock()
+
+	if resizedVariants[formattedKey] == nil {
+		resizedVariants[formattedKey] = make(map[string]time.Time)
+	}
+
+	resizedVariants[formattedKey][filename] = lastUse
+}
+
+// evictResizedVariants removes the least recently used variants of the image
+// from the main cache, until it has at most maxResizedVariants of them.
+func evictResizedVariants(formattedKey string) {
+	var evicted []string
+
+	resizedVariantsMutex.Lock()
+	variants := resizedVariants[formattedKey]
+
+	for len(variants) > maxResizedVariants {
+		var oldest string
+
+		for filename, lastUse := range variants {
+			if oldest == "" || lastUse.Before(variants[oldest]) {
+				oldest = filename
+			}
+		}
+
+		delete(variants, oldest)
+		evicted = append(evicted, oldest)
+	}
+	resizedVariantsMutex.Unlock()
+
+	for _, filename := range evicted {
+		printDebug("Evicting least recently used resized variant from cache: ", filename)
+		deleteFileFromCache(filename)
+	}
+}
+
+// removeResizedVariants removes the resized variants of the image from the main cache.
+func removeResizedVariants(formattedKey string) {
+	resizedVariantsMutex.Lock()
+	variants := resizedVariants[formattedKey]
+	delete(resizedVariants, formattedKey)
+	resizedVariantsMutex.Unlock()
+
+	for filename := range variants {
+		deleteFileFromCache(filename)
+	}
+}
+
+// removeOrphanedVariants removes the resized variants whose image isn't in the main cache anymore.
+// It must be called after the images of the main cache have been restored.
+func removeOrphanedVariants() {
+	resizedVariantsMutex.Lock()
+	formattedKeys := make([]string, 0, len(resizedVariants))
+
+	for formattedKey := range resizedVariants {
+		formattedKeys = append(formattedKeys, formattedKey)
+	}
+	resizedVariantsMutex.Unlock()
+
+	for _, formattedKey := range formattedKeys {
+		if _, found := mainCache.findImageByKey(formattedKey); !found {
+			printDebug("Removing orphaned resized variants from cache: ", formattedKey)
+			removeResizedVariants(formattedKey)
+		}
+	}
+}
+
+func clearResizedVariants() {
+	resizedVariantsMutex.Lock()
+	resizedVariants = make(map[string]map[string]time.Time)
+	resizedVariantsMutex.Unlock()
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"net/url"
+	"runtime"
+	"testing"
+)
+
+func TestParseResizeSpec(t *testing.T) {
+	tests := []struct {
+		query  string
+		spec   resizeSpec
+		resize bool
+		err    bool
+	}{
+		{query: "", resize: false},
+		{query: "w=256", spec: resizeSpec{width: 256, fit: fitContain}, resize: true},
+		{query: "h=100&fit=cover", spec: resizeSpec{height: 100, fit: fitCover}, resize: true},
+		{query: "w=300&h=200&fit=fill", spec: resizeSpec{width: 300, height: 200, fit: fitFill}, resize: true},
+		{query: "w=4096&h=4096", spec: resizeSpec{width: 4096, height: 4096, fit: fitContain}, resize: true},
+		{query: "fit=contain", err: true},
+		{query: "w=0&h=0", err: true},
+		{query: "w=4097", err: true},
+		{query: "w=-1", err: true},
+		{query: "w=abc", err: true},
+		{query: "w=100&fit=fill", err: true},
+		{query: "w=100&fit=stretch", err: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.query, func(t *testing.T) {
+			values, _ := url.ParseQuery(test.query)
+
+			spec, resize, err := parseResizeSpec(values)
+			if (err != nil) != test.err {
+				t.Fatalf("expected error %t, got %v", test.err, err)
+			}
+
+			if spec != test.spec || resize != test.resize {
+				t.Errorf("expected %+v (resize %t), got %+v (resize %t)", test.spec, test.resize, spec, resize)
+			}
+		})
+	}
+}
+
+func TestResizeSpecGeometry(t *testing.T) {
+	bounds := image.Rect(0, 0, 1000, 500)
+
+	tests := []struct {
+		name          string
+		spec          resizeSpec
+		crop          image.Rectangle
+		width, height int
+	}{
+		{"contain width", resizeSpec{width: 200, fit: fitContain}, bounds, 200, 100},
+		{"contain height", resizeSpec{height: 100, fit: fitContain}, bounds, 200, 100},
+		{"contain box", resizeSpec{width: 200, height: 200, fit: fitContain}, bounds, 200, 100},
+		{"contain never enlarges", resizeSpec{width: 2000, fit: fitContain}, bounds, 1000, 500},
+		{"cover crops the sides", resizeSpec{width: 200, height: 200, fit: fitCover}, image.Rect(250, 0, 750, 500), 200, 200},
+		{"cover never enlarges", resizeSpec{width: 2000, height: 2000, fit: fitCover}, bounds, 1000, 500},
+		{"cover with a single dimension", resizeSpec{width: 100, fit: fitCover}, bounds, 100, 50},
+		{"fill stretches", resizeSpec{width: 300, height: 300, fit: fitFill}, bounds, 300, 300},
+		{"fill enlarges", resizeSpec{width: 2000, height: 100, fit: fitFill}, bounds, 2000, 100},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			crop, width, height := test.spec.geometry(bounds)
+			if crop != test.crop || width != test.width || height != test.height {
+				t.Errorf("expected %v scaled to %dx%d, got %v scaled to %dx%d", test.crop, test.width, test.height, crop, width, height)
+			}
+		})
+	}
+}
+
+func TestResizeImage(t *testing.T) {
+	// 4x2 image: a black and a white 2x2 square side by side
+	src := image.NewRGBA(image.Rect(0, 0, 4, 2))
+	for y := range 2 {
+		for x := range 4 {
+			gray := uint8(x / 2 * 255)
+			src.SetRGBA(x, y, color.RGBA{R: gray, G: gray, B: gray, A: 255})
+		}
+	}
+
+	tests := []struct {
+		name          string
+		crop          image.Rectangle
+		width, height int
+		expected      []uint8
+	}{
+		{"halved", src.Bounds(), 2, 1, []uint8{0, 255}},
+		{"averaged", src.Bounds(), 1, 1, []uint8{128}},
+		{"uneven", src.Bounds(), 3, 1, []uint8{0, 128, 255}},
+		{"cropped", image.Rect(1, 0, 3, 2), 2, 2, []uint8{0, 255, 0, 255}},
+		{"enlarged", image.Rect(1, 0, 3, 1), 4, 2, []uint8{0, 0, 255, 255, 0, 0, 255, 255}},
+		{"unscaled", src.Bounds(), 4, 2, []uint8{0, 0, 255, 255, 0, 0, 255, 255}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resized := resizeImage(src, test.crop, test.width, test.height)
+			if resized.Bounds() != image.Rect(0, 0, test.width, test.height) {
+				t.Fatalf("expected %dx%d, got %v", test.width, test.height, resized.Bounds())
+			}
+
+			for i, expected := range test.expected {
+				x, y := i%test.width, i/test.width
+				pixel := resized.RGBAAt(x, y)
+				for _, channel := range []uint8{pixel.R, pixel.G, pixel.B} {
+					// the halves are rounded either way
+					if max(channel, expected)-min(channel, expected) > 1 || pixel.A != 255 {
+						t.Errorf("pixel (%d, %d): expected gray %d, got %v", x, y, expected, pixel)
+
+						break
+					}
+				}
+			}
+		})
+	}
+}
+
+// grayGradient returns a gray image of the given bounds, read by resizeImage without allocating its pixels.
+func grayGradient(bounds image.Rectangle) *image.Gray {
+	img := image.NewGray(bounds)
+	for p := range img.Pix {
+		img.Pix[p] = uint8(p)
+	}
+
+	return img
+}
+
+// TestResizeImageMemory checks that the memory allocated to resize an image is about the size of the resized image,
+// whatever the size of the source.
+func TestResizeImageMemory(t *testing.T) {
+	if testing.Short() {
+		t.Skip("resizes a large image")
+	}
+
+	tests := []struct {
+		name          string
+		src           image.Rectangle
+		width, height int
+	}{
+		// the previous implementation copied the source and kept all its rows scaled to the destination width,
+		// from 150 MB to 1.3 GB for these
+		{"downscaled", image.Rect(0, 0, 10000, 1000), 4096, 410},
+		{"stretched", image.Rect(0, 0, 100, 10000), 4096, 1000},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			src := grayGradient(test.src)
+
+			var before, after runtime.MemStats
+
+			runtime.GC()
+			runtime.ReadMemStats(&before)
+
+			resized := resizeImage(src, test.src, test.width, test.height)
+
+			runtime.ReadMemStats(&after)
+
+			allocated := after.TotalAlloc - before.TotalAlloc
+			limit := uint64(len(resized.Pix))*2 + 1<<20
+
+			if allocated > limit {
+				t.Errorf("resizing %v to %dx%d allocated %d bytes, expected at most %d", test.src, test.width, test.height, allocated, limit)
+			}
+		})
+	}
+}
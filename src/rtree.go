@@ -0,0 +1,335 @@
+package main
+
+import (
+	"container/heap"
+	"math"
+	"slices"
+)
+
+const (
+	rtreeMaxEntries = 16
+	rtreeMinEntries = 6
+)
+
+// rtreeEntry is either an item of a leaf, or a child node with the bounding box of its entries.
+type rtreeEntry struct {
+	box   BBox
+	child *rtreeNode
+	key   string
+}
+
+type rtreeNode struct {
+	entries []rtreeEntry
+}
+
+func (node *rtreeNode) bbox() BBox {
+	box := node.entries[0].box
+	for _, entry := range node.entries[1:] {
+		box = box.union(entry.box)
+	}
+
+	return box
+}
+
+// RTree is an R-tree of keyed bounding boxes (Guttman, with the quadratic split).
+// The boxes must not cross the antimeridian. It is not safe for concurrent use.
+type RTree struct {
+	root *rtreeNode
+	// height is the level of the root, the leaves being at level 0
+	height int
+	size   int
+}
+
+func newRTree() *RTree {
+	return &RTree{root: &rtreeNode{}}
+}
+
+func (box BBox) union(other BBox) BBox {
+	return BBox{
+		MinLon: min(box.MinLon, other.MinLon),
+		MinLat: min(box.MinLat, other.MinLat),
+		MaxLon: max(box.MaxLon, other.MaxLon),
+		MaxLat: max(box.MaxLat, other.MaxLat),
+	}
+}
+
+func (box BBox) area() float64 {
+	return (box.MaxLon - box.MinLon) * (box.MaxLat - box.MinLat)
+}
+
+func (box BBox) contains(other BBox) bool {
+	return box.MinLon <= other.MinLon && other.MaxLon <= box.MaxLon &&
+		box.MinLat <= other.MinLat && other.MaxLat <= box.MaxLat
+}
+
+// insert adds the item to the tree.
+func (tree *RTree) insert(key string, box BBox) {
+	tree.insertEntry(rtreeEntry{box: box, key: key}, 0)
+	tree.size++
+}
+
+// insertEntry adds the entry to a node of the given level, growing the tree when the root is split.
+func (tree *RTree) insertEntry(entry rtreeEntry, level int) {
+	if sibling := tree.insertAt(tree.root, tree.height, entry, level); sibling != nil {
+		tree.root = &rtreeNode{entries: []rtreeEntry{
+			{box: tree.root.bbox(), child: tree.root},
+			{box: sibling.bbox(), child: sibling},
+		}}
+		tree.height++
+	}
+}
+
+// insertAt adds the entry under the node, and returns the new sibling of the node if it had to be split.
+func (tree *RTree) insertAt(node *rtreeNode, nodeLevel int, entry rtreeEntry, level int) *rtreeNode {
+	if nodeLevel == level {
+		node.entries = append(node.entries, entry)
+	} else {
+		i := chooseSubtree(node, entry.box)
+		child := node.entries[i].child
+
+		sibling := tree.insertAt(child, nodeLevel-1, entry, level)
+		node.entries[i].box = child.bbox()
+
+		if sibling != nil {
+			node.entries = append(node.entries, rtreeEntry{box: sibling.bbox(), child: sibling})
+		}
+	}
+
+	if len(node.entries) > rtreeMaxEntries {
+		return node.split()
+	}
+
+	return nil
+}
+
+// chooseSubtree returns the entry of the node whose box needs the least enlargement to include the box.
+func chooseSubtree(node *rtreeNode, box BBox) int {
+	best, bestEnlargement, bestArea := 0, math.Inf(1), math.Inf(1)
+
+	for i, entry := range node.entries {
+		area := entry.box.area()
+		enlargement := entry.box.union(box).area() - area
+
+		if enlargement < bestEnlargement || (enlargement == bestEnlargement && area < bestArea) {
+			best, bestEnlargement, bestArea = i, enlargement, area
+		}
+	}
+
+	return best
+}
+
+// split distributes the entries of the node between the node and a new sibling, which is returned.
+func (node *rtreeNode) split() *rtreeNode {
+	entries := node.entries
+
+	// the seeds are the two entries that would waste the most area if they were put together
+	seed1, seed2, worst := 0, 1, math.Inf(-1)
+
+	for i := range entries {
+		for j := i + 1; j < len(entries); j++ {
+			if waste := entries[i].box.union(entries[j].box).area() - entries[i].box.area() - entries[j].box.area(); waste > worst {
+				seed1, seed2, worst = i, j, waste
+			}
+		}
+	}
+
+	group1 := []rtreeEntry{entries[seed1]}
+	group2 := []rtreeEntry{entries[seed2]}
+	box1, box2 := entries[seed1].box, entries[seed2].box
+
+	remaining := make([]rtreeEntry, 0, len(entries)-2)
+	for i, entry := range entries {
+		if i != seed1 && i != seed2 {
+			remaining = append(remaining, entry)
+		}
+	}
+
+	for len(remaining) > 0 {
+		// a group too small takes all the remaining entries
+		if len(group1)+len(remaining) == rtreeMinEntries {
+			group1 = append(group1, remaining...)
+
+			break
+		}
+
+		if len(group2)+len(remaining) == rtreeMinEntries {
+			group2 = append(group2, remaining...)
+
+			break
+		}
+
+		// the next entry is the one with the strongest preference for a group
+		next, bestDifference := 0, math.Inf(-1)
+		var nextEnlargement1, nextEnlargement2 float64
+
+		for i, entry := range remaining {
+			enlargement1 := box1.union(entry.box).area() - box1.area()
+			enlargement2 := box2.union(entry.box).area() - box2.area()
+
+			if difference := math.Abs(enlargement1 - enlargement2); difference > bestDifference {
+				next, bestDifference = i, difference
+				nextEnlargement1, nextEnlargement2 = enlargement1, enlargement2
+			}
+		}
+
+		entry := remaining[next]
+		remaining = slices.Delete(remaining, next, next+1)
+
+		toFirst := nextEnlargement1 < nextEnlargement2 ||
+			(nextEnlargement1 == nextEnlargement2 && (box1.area() < box2.area() ||
+				(box1.area() == box2.area() && len(group1) <= len(group2))))
+
+		if toFirst {
+			group1 = append(group1, entry)
+			box1 = box1.union(entry.box)
+		} else {
+			group2 = append(group2, entry)
+			box2 = box2.union(entry.box)
+		}
+	}
+
+	node.entries = group1
+
+	return &rtreeNode{entries: group2}
+}
+
+// remove deletes the item having the given key and box, and returns whether it was found.
+// The entries of the nodes left with too few entries are inserted again.
+func (tree *RTree) remove(key string, box BBox) bool {
+	var orphans []rtreeOrphan
+
+	if !tree.removeAt(tree.root, tree.height, key, box, &orphans) {
+		return false
+	}
+
+	tree.size--
+
+	for tree.height > 0 && len(tree.root.entries) == 1 {
+		tree.root = tree.root.entries[0].child
+		tree.height--
+	}
+
+	for _, orphan := range orphans {
+		tree.insertEntry(orphan.entry, orphan.level)
+	}
+
+	return true
+}
+
+// rtreeOrphan is an entry of a removed node, with the level of the node.
+type rtreeOrphan struct {
+	entry rtreeEntry
+	level int
+}
+
+func (tree *RTree) removeAt(node *rtreeNode, nodeLevel int, key string, box BBox, orphans *[]rtreeOrphan) bool {
+	if nodeLevel == 0 {
+		for i, entry := range node.entries {
+			if entry.key == key && entry.box == box {
+				node.entries = slices.Delete(node.entries, i, i+1)
+
+				return true
+			}
+		}
+
+		return false
+	}
+
+	for i, entry := range node.entries {
+		if !entry.box.contains(box) || !tree.removeAt(entry.child, nodeLevel-1, key, box, orphans) {
+			continue
+		}
+
+		if len(entry.child.entries) < rtreeMinEntries {
+			for _, orphan := range entry.child.entries {
+				*orphans = append(*orphans, rtreeOrphan{entry: orphan, level: nodeLevel - 1})
+			}
+
+			node.entries = slices.Delete(node.entries, i, i+1)
+		} else {
+			node.entries[i].box = entry.child.bbox()
+		}
+
+		return true
+	}
+
+	return false
+}
+
+// search calls visit with the key of every item whose box intersects the given one, until it returns false.
+func (tree *RTree) search(box BBox, visit func(key string) bool) {
+	tree.searchAt(tree.root, tree.height, box, visit)
+}
+
+func (tree *RTree) searchAt(node *rtreeNode, nodeLevel int, box BBox, visit func(key string) bool) bool {
+	for _, entry := range node.entries {
+		if !entry.box.intersects(box) {
+			continue
+		}
+
+		if nodeLevel == 0 {
+			if !visit(entry.key) {
+				return false
+			}
+		} else if !tree.searchAt(entry.child, nodeLevel-1, box, visit) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// rtreeCandidate is an entry of the best-first search, or an item whose exact distance is known when exact is set.
+type rtreeCandidate struct {
+	entry    rtreeEntry
+	level    int
+	distance float64
+	exact    bool
+}
+
+type rtreeCandidates []rtreeCandidate
+
+func (h rtreeCandidates) Len() int           { return len(h) }
+func (h rtreeCandidates) Less(i, j int) bool { return h[i].distance < h[j].distance }
+func (h rtreeCandidates) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *rtreeCandidates) Push(x any)        { *h = append(*h, x.(rtreeCandidate)) } //nolint:forcetypeassert
+
+func (h *rtreeCandidates) Pop() any {
+	old := *h
+	candidate := old[len(old)-1]
+	*h = old[:len(old)-1]
+
+	return candidate
+}
+
+// nearest calls visit with the keys of the items by increasing distance, until it returns false.
+// boxDistance must be a lower bound of itemDistance for the items inside the box.
+// An item stored with several boxes is visited once per box.
+func (tree *RTree) nearest(boxDistance func(box BBox) float64, itemDistance func(key string) float64,
+	visit func(key string, distance float64) bool,
+) {
+	candidates := rtreeCandidates{}
+
+	for _, entry := range tree.root.entries {
+		heap.Push(&candidates, rtreeCandidate{entry: entry, level: tree.height, distance: boxDistance(entry.box)})
+	}
+
+	for candidates.Len() > 0 {
+		candidate := heap.Pop(&candidates).(rtreeCandidate) //nolint:forcetypeassert
+
+		switch {
+		case candidate.exact:
+			if !visit(candidate.entry.key, candidate.distance) {
+				return
+			}
+		case candidate.level == 0:
+			candidate.distance = itemDistance(candidate.entry.key)
+			candidate.exact = true
+			heap.Push(&candidates, candidate)
+		default:
+			for _, entry := range candidate.entry.child.entries {
+				heap.Push(&candidates, rtreeCandidate{entry: entry, level: candidate.level - 1, distance: boxDistance(entry.box)})
+			}
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"testing"
+)
+
+// checkRTree checks the invariants of the tree: the leaves are all at level 0, the nodes but the root
+// hold between rtreeMinEntries and rtreeMaxEntries entries, and the box of a child covers its entries.
+func checkRTree(t *testing.T, tree *RTree) {
+	t.Helper()
+
+	size := 0
+
+	var check func(node *rtreeNode, level int, isRoot bool)
+	check = func(node *rtreeNode, level int, isRoot bool) {
+		if len(node.entries) > rtreeMaxEntries || (!isRoot && len(node.entries) < rtreeMinEntries) {
+			t.Fatalf("node at level %d holds %d entries", level, len(node.entries))
+		}
+
+		for _, entry := range node.entries {
+			if level == 0 {
+				if entry.child != nil {
+					t.Fatal("leaf entry with a child")
+				}
+
+				size++
+
+				continue
+			}
+
+			if entry.child == nil {
+				t.Fatalf("entry without child at level %d", level)
+			}
+
+			if entry.child.bbox() != entry.box {
+				t.Fatalf("entry box %v doesn't match the one of its child %v", entry.box, entry.child.bbox())
+			}
+
+			check(entry.child, level-1, false)
+		}
+	}
+
+	check(tree.root, tree.height, true)
+
+	if size != tree.size {
+		t.Fatalf("expected %d items, found %d", tree.size, size)
+	}
+}
+
+// randomBoxes returns boxes of up to 2 degrees, not crossing the antimeridian.
+func randomBoxes(random *rand.Rand, count int) map[string]BBox {
+	boxes := make(map[string]BBox, count)
+
+	for i := range count {
+		lon, lat := random.Float64()*356-178, random.Float64()*176-88
+		boxes[fmt.Sprintf("image%d", i)] = BBox{MinLon: lon, MinLat: lat, MaxLon: lon + random.Float64()*2, MaxLat: lat + random.Float64()*2}
+	}
+
+	return boxes
+}
+
+func searchRTree(tree *RTree, box BBox) []string {
+	keys := make([]string, 0)
+
+	tree.search(box, func(key string) bool {
+		keys = append(keys, key)
+
+		return true
+	})
+
+	slices.Sort(keys)
+
+	return keys
+}
+
+func searchBoxes(boxes map[string]BBox, box BBox) []string {
+	keys := make([]string, 0)
+
+	for key, other := range boxes {
+		if other.intersects(box) {
+			keys = append(keys, key)
+		}
+	}
+
+	slices.Sort(keys)
+
+	return keys
+}
+
+func TestRTree(t *testing.T) {
+	random := rand.New(rand.NewPCG(1, 2)) //nolint:gosec
+	boxes := randomBoxes(random, 2000)
+	tree := newRTree()
+
+	for key, box := range boxes {
+		tree.insert(key, box)
+	}
+
+	checkRTree(t, tree)
+
+	if tree.height < 2 {
+		t.Fatalf("expected a tree of several levels, got a height of %d", tree.height)
+	}
+
+	queries := []struct {
+		name string
+		box  BBox
+	}{
+		{name: "world", box: BBox{MinLon: -180, MinLat: -90, MaxLon: 180, MaxLat: 90}},
+		{name: "europe", box: BBox{MinLon: -10, MinLat: 35, MaxLon: 30, MaxLat: 70}},
+		{name: "small", box: BBox{MinLon: 2, MinLat: 48, MaxLon: 3, MaxLat: 49}},
+		{name: "point", box: BBox{MinLon: 2.35, MinLat: 48.85, MaxLon: 2.35, MaxLat: 48.85}},
+		{name: "crossing the antimeridian", box: BBox{MinLon: 170, MinLat: -20, MaxLon: -170, MaxLat: 20}},
+		{name: "pole", box: BBox{MinLon: -180, MinLat: 85, MaxLon: 180, MaxLat: 90}},
+	}
+
+	checkQueries := func(t *testing.T) {
+		t.Helper()
+
+		for _, query := range queries {
+			if found, expected := searchRTree(tree, query.box), searchBoxes(boxes, query.box); !slices.Equal(found, expected) {
+				t.Errorf("%s: expected %d items, found %d", query.name, len(expected), len(found))
+			}
+		}
+	}
+
+	checkQueries(t)
+
+	// the search stops when visit returns false
+	visited := 0
+
+	tree.search(queries[0].box, func(string) bool {
+		visited++
+
+		return visited < 10
+	})
+
+	if visited != 10 {
+		t.Errorf("expected the search to stop after 10 items, visited %d", visited)
+	}
+
+	if tree.remove("image0", BBox{MinLon: 1000}) || tree.remove("unknown", boxes["image1"]) {
+		t.Error("removed an item with another box or key")
+	}
+
+	// most of the items are removed, so that the nodes are merged and the tree shrinks
+	for i := range 1900 {
+		key := fmt.Sprintf("image%d", i)
+
+		if !tree.remove(key, boxes[key]) {
+			t.Fatalf("%s not found", key)
+		}
+
+		delete(boxes, key)
+
+		if i%100 == 0 {
+			checkRTree(t, tree)
+		}
+	}
+
+	checkRTree(t, tree)
+	checkQueries(t)
+
+	for key, box := range boxes {
+		if !tree.remove(key, box) {
+			t.Fatalf("%s not found", key)
+		}
+	}
+
+	if tree.size != 0 || tree.height != 0 || len(searchRTree(tree, queries[0].box)) != 0 {
+		t.Errorf("expected an empty tree, got %d items and a height of %d", tree.size, tree.height)
+	}
+}
+
+func TestRTreeNearest(t *testing.T) {
+	random := rand.New(rand.NewPCG(3, 4)) //nolint:gosec
+	boxes := randomBoxes(random, 500)
+	tree := newRTree()
+
+	for key, box := range boxes {
+		tree.insert(key, box)
+	}
+
+	positions := [][2]float64{{2.35, 48.85}, {-179, 0}, {0, -89}, {120, 30}}
+
+	for _, position := range positions {
+		// the planar distance to the box, which is both the distance of the boxes and of the items
+		distance := func(box BBox) float64 {
+			dx := max(box.MinLon-position[0], 0, position[0]-box.MaxLon)
+			dy := max(box.MinLat-position[1], 0, position[1]-box.MaxLat)
+
+			return math.Hypot(dx, dy)
+		}
+
+		var found []float64
+
+		tree.nearest(distance, func(key string) float64 { return distance(boxes[key]) }, func(_ string, distance float64) bool {
+			found = append(found, distance)
+
+			return len(found) < 20
+		})
+
+		expected := make([]float64, 0, len(boxes))
+		for _, box := range boxes {
+			expected = append(expected, distance(box))
+		}
+
+		slices.Sort(expected)
+
+		if !slices.Equal(found, expected[:20]) {
+			t.Errorf("%v: expected the distances %v, got %v", position, expected[:20], found)
+		}
+	}
+}
@@ -4,36 +4,94 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"log"
+	"maps"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
 	"time"
-
-	"github.com/minio/minio-go/v7"
 )
 
-func getFileFromBucket(minioClient *minio.Client, objKey, filePath string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
+// getFileFromBucket downloads the given object, retrying up to config.DownloadRetries times
+// with an exponential backoff starting at config.DownloadRetryDelay.
+// The downloads are refused once the server is shutting down.
+func getFileFromBucket(store ObjectStore, objKey, filePath string) error {
+	if !downloads.begin() {
+		return fmt.Errorf("failed to fetch %q: %w", objKey, errShuttingDown)
+	}
+
+	defer downloads.end()
+
+	var err error
+
+	start := time.Now()
+	retryDelay := config.DownloadRetryDelay
+
+	for attempt := 0; attempt <= config.DownloadRetries; attempt++ {
+		if attempt > 0 {
+			printDebug(fmt.Sprintf("Retrying to get object %q in %v (attempt %d/%d)", objKey, retryDelay, attempt, config.DownloadRetries))
 
-	if err := minioClient.FGetObject(ctx, config.S3.BucketName, objKey, filePath, minio.GetObjectOptions{}); err != nil {
-		if errors.Is(err, context.DeadlineExceeded) {
-			printWarn(fmt.Sprintf("Context deadline exceeded while getting object %q", objKey))
+			select {
+			case <-time.After(retryDelay):
+			case <-downloadsCtx.Done():
+				return fmt.Errorf("failed to fetch %q: %w", objKey, errShuttingDown)
+			}
+
+			retryDelay *= 2
 		}
 
+		err = getObjectWithTimeout(store, objKey, filePath)
+		if err == nil || errors.Is(err, errObjectNotFound) {
+			break
+		}
+
+		if downloadsCtx.Err() != nil {
+			return fmt.Errorf("download of %q aborted: %w", objKey, errShuttingDown)
+		}
+
+		s3GetAttemptErrors.Inc()
+	}
+
+	switch {
+	case err == nil:
+		s3GetDuration.WithLabelValues(resultSuccess).Observe(time.Since(start).Seconds())
+	case errors.Is(err, errObjectNotFound):
+		s3GetDuration.WithLabelValues(resultNotFound).Observe(time.Since(start).Seconds())
+	default:
+		s3GetDuration.WithLabelValues(resultError).Observe(time.Since(start).Seconds())
+	}
+
+	if err != nil {
 		handleS3Error(fmt.Errorf("failed to fetch file from s3 bucket => exit: %w", err))
 
 		return fmt.Errorf("failed to fetch file from s3 bucket: %w", err)
 	}
 
+	if info, err := os.Stat(filePath); err == nil {
+		diskQuota.fileAdded(filepath.Dir(filePath), filepath.Base(filePath), info.Size(), time.Now())
+	}
+
 	return nil
 }
 
-func getImageFromBucket(cache ImageCache, minioClient *minio.Client, objKey, formattedKey, imgType string, lastModTime time.Time, eventChan chan event, updateOnly bool) error {
+func getObjectWithTimeout(store ObjectStore, objKey, filePath string) error {
+	ctx, cancel := context.WithTimeout(downloadsCtx, 30*time.Second)
+	defer cancel()
+
+	err := downloadFile(ctx, store, objKey, filePath)
+	if errors.Is(err, context.DeadlineExceeded) {
+		printWarn(fmt.Sprintf("Context deadline exceeded while getting object %q", objKey))
+	}
+
+	return err //nolint:wrapcheck
+}
+
+func getImageFromBucket(cache *ImageCache, store ObjectStore, obj ObjectInfo, formattedKey, imgType string, eventChan chan event, updateOnly bool) error {
 	filePath := filepath.Join(cache.pathOnDisk, formattedKey)
+	lastModTime := obj.LastModified
 
-	err := getFileFromBucket(minioClient, objKey, filePath)
+	err := getFileFromBucket(store, obj.Key, filePath)
 	if err != nil {
 		return err
 	}
@@ -57,66 +115,48 @@ func getImageFromBucket(cache ImageCache, minioClient *minio.Client, objKey, for
 		}
 	}
 
-	imageID := formattedKey
-
-	timersMutex.Lock()
-
-	if timer, found := timers[imageID]; found {
-		timer.Stop()
-	}
-
-	timers[imageID] = time.AfterFunc(config.RetentionPeriod, func() {
-		cache.deleteImage(formattedKey)
-		deleteFileFromCache(formattedKey)
-
-		if eventChan != nil {
-			eventChan <- event{EventType: eventRemove, EventObj: EventObject{ImgKey: formattedKey}}
-		}
-
-		delete(timers, imageID)
-	})
-
-	timersMutex.Unlock()
+	expiry := time.Now().Add(retentionPeriodOf(obj.Key))
+	expiryScheduler.schedule(cache, formattedKey, expiry)
+	cacheIndex.putImage(cache, S3Image{
+		S3Key:        obj.Key,
+		LastModified: obj.LastModified,
+		Size:         obj.Size,
+		ETag:         obj.ETag,
+		FormattedKey: formattedKey,
+	}, expiry)
 
 	return os.Chtimes(filePath, lastModTime, lastModTime) //nolint:wrapcheck
 }
 
-func getGeonamesFileFromBucket(minioClient *minio.Client, objKey string, objDate time.Time, formattedFilename, targetImg string, eventChan chan event) error {
+func getGeonamesFileFromBucket(store ObjectStore, objKey string, objDate time.Time, etag string, formattedFilename, targetImg string, eventChan chan event) error {
 	filePath := filepath.Join(config.mainCacheDir, formattedFilename)
 
-	err := getFileFromBucket(minioClient, objKey, filePath)
+	err := getFileFromBucket(store, objKey, filePath)
 	if err != nil {
 		return err
 	}
 
-	if timer, found := timers[formattedFilename]; found {
-		timer.Stop()
-	}
-
 	geonames, err := parseGeonames(filePath, objDate)
 	if err != nil {
 		return err
 	}
 
-	img, found := mainCache.findImageByPrefix(targetImg)
-	if found {
+	mainCache.modifyImage(targetImg, func(img *S3Image) {
 		img.AssociatedGeonames = &geonames
-	}
+	})
 
 	geonamesCacheMutex.Lock()
 	geonamesCache[formattedFilename] = geonames
 	geonamesCacheMutex.Unlock()
-	timersMutex.Lock()
-	timers[formattedFilename] = time.AfterFunc(config.RetentionPeriod, func() {
-		geonamesCacheMutex.Lock()
-		delete(geonamesCache, formattedFilename)
-		geonamesCacheMutex.Unlock()
-		deleteFileFromCache(formattedFilename)
-		timersMutex.Lock()
-		delete(timers, formattedFilename)
-		timersMutex.Unlock()
+
+	cacheIndex.putFile(formattedFilename, indexedFile{
+		Kind:         fileKindGeonames,
+		TargetImg:    targetImg,
+		ETag:         etag,
+		LastModified: objDate,
+		Geonames:     &geonames,
 	})
-	timersMutex.Unlock()
+
 	eventChan <- event{
 		EventType: eventGeonames,
 		EventObj: EventGeonames{
@@ -130,84 +170,71 @@ func getGeonamesFileFromBucket(minioClient *minio.Client, objKey string, objDate
 	return nil
 }
 
-func getLocalizationFileFromBucket(minioClient *minio.Client, objKey string, objDate time.Time, formattedFilename string, targetImg string) error {
+func getLocalizationFileFromBucket(store ObjectStore, objKey string, objDate time.Time, etag string, formattedFilename string, targetImg string) error {
 	filePath := filepath.Join(config.mainCacheDir, formattedFilename)
 
-	err := getFileFromBucket(minioClient, objKey, filePath)
+	err := getFileFromBucket(store, objKey, filePath)
 	if err != nil {
 		return err
 	}
 
-	if timer, found := timers[formattedFilename]; found {
-		timer.Stop()
-	}
-
 	localization, err := parseLocalization(filePath, objDate)
 	if err != nil {
 		return err
 	}
 
-	img, found := mainCache.findImageByPrefix(targetImg)
-	if found {
+	mainCache.modifyImage(targetImg, func(img *S3Image) {
 		img.AssociatedLocalization = &localization
+	})
+
+	if img, found := mainCache.findImageByKey(targetImg); found {
+		spatialIndex.update(img)
 	}
 
 	localizationCacheMutex.Lock()
 	localizationCache[formattedFilename] = localization
 	localizationCacheMutex.Unlock()
-	timersMutex.Lock()
-	timers[formattedFilename] = time.AfterFunc(config.RetentionPeriod, func() {
-		localizationCacheMutex.Lock()
-		delete(localizationCache, formattedFilename)
-		localizationCacheMutex.Unlock()
-		deleteFileFromCache(formattedFilename)
-		timersMutex.Lock()
-		delete(timers, formattedFilename)
-		timersMutex.Unlock()
-	})
 
-	timersMutex.Unlock()
+	cacheIndex.putFile(formattedFilename, indexedFile{
+		Kind:         fileKindLocalization,
+		TargetImg:    targetImg,
+		ETag:         etag,
+		LastModified: objDate,
+		Localization: &localization,
+	})
 
 	return nil
 }
 
-func getFeaturesFileFromBucket(minioClient *minio.Client, objKey string, objDate time.Time, formattedFilename string, targetImg string, eventChan chan event) error {
+func getFeaturesFileFromBucket(store ObjectStore, objKey string, objDate time.Time, etag string, formattedFilename string, targetImg string, eventChan chan event) error {
 	filePath := filepath.Join(config.mainCacheDir, formattedFilename)
 
-	err := getFileFromBucket(minioClient, objKey, filePath)
+	err := getFileFromBucket(store, objKey, filePath)
 	if err != nil {
 		return err
 	}
 
-	if timer, found := timers[formattedFilename]; found {
-		timer.Stop()
-	}
-
 	features, err := parseFeatures(filePath, objDate)
 	if err != nil {
 		return err
 	}
 
-	img, found := mainCache.findImageByPrefix(targetImg)
-	if found {
+	mainCache.modifyImage(targetImg, func(img *S3Image) {
 		img.AssociatedFeatures = &features
-	}
+	})
 
 	featuresCacheMutex.Lock()
 	featuresCache[formattedFilename] = features
 	featuresCacheMutex.Unlock()
-	timersMutex.Lock()
-	timers[formattedFilename] = time.AfterFunc(config.RetentionPeriod, func() {
-		featuresCacheMutex.Lock()
-		delete(featuresCache, formattedFilename)
-		featuresCacheMutex.Unlock()
-		deleteFileFromCache(formattedFilename)
-		timersMutex.Lock()
-		delete(timers, formattedFilename)
-		timersMutex.Unlock()
+
+	cacheIndex.putFile(formattedFilename, indexedFile{
+		Kind:         fileKindFeatures,
+		TargetImg:    targetImg,
+		ETag:         etag,
+		LastModified: objDate,
+		Features:     &features,
 	})
 
-	timersMutex.Unlock()
 	eventChan <- event{
 		EventType: eventFeatures,
 		EventObj: EventFeatures{
@@ -224,16 +251,27 @@ func getFeaturesFileFromBucket(minioClient *minio.Client, objKey string, objDate
 }
 
 func deleteFileFromCache(fileName string) {
-	err := os.Remove(filepath.Join(config.mainCacheDir, fileName))
+	deleteFileFromDir(config.mainCacheDir, fileName)
+}
+
+func deleteFileFromDir(dir, fileName string) {
+	err := os.Remove(filepath.Join(dir, fileName))
 	if err != nil && !os.IsNotExist(err) {
 		printError(fmt.Errorf("failed to delete file from cache: %w", err), false)
 	}
 
+	diskQuota.fileRemoved(dir, fileName)
+
 	printDebug("Removed", fileName, "from cache")
 }
 
-func existsInCache(imgName string, obj minio.ObjectInfo) (exists, needsUpdate bool) {
+func existsInCache(imgName string, obj ObjectInfo) (exists, needsUpdate bool) {
 	if img, found := mainCache.findImageByKey(imgName); found {
+		// an unchanged ETag means that the content of the image is the same
+		if img.ETag != "" && img.ETag == obj.ETag {
+			return true, false
+		}
+
 		lastModTime := img.LastModified
 		if obj.LastModified.Before(lastModTime) || obj.LastModified.Equal(lastModTime) {
 			return true, false
@@ -249,7 +287,7 @@ func existsInCache(imgName string, obj minio.ObjectInfo) (exists, needsUpdate bo
 	return false, false
 }
 
-func fetchThumbnailsFrom(imgDir, imgKey string, minioClient *minio.Client) []string {
+func fetchThumbnailsFrom(imgDir, imgKey string, store ObjectStore) []string {
 	printInfo("Fetching thumbnails from ", imgDir, " ...")
 
 	ctx, cancel := context.WithTimeout(context.Background(), config.PollingPeriod)
@@ -258,23 +296,20 @@ func fetchThumbnailsFrom(imgDir, imgKey string, minioClient *minio.Client) []str
 	thumbnails := make([]string, 0)
 	s3ImgDir := strings.ReplaceAll(imgDir, "@", "/")
 
-	for obj := range minioClient.ListObjects(ctx, config.S3.BucketName, minio.ListObjectsOptions{
-		Prefix:    s3ImgDir,
-		Recursive: true,
-	}) {
+	for obj := range store.ListObjects(ctx, s3ImgDir, true) {
 		if !strings.HasSuffix(obj.Key, config.PreviewFilename) || obj.Key == imgKey {
 			continue
 		}
 
 		formattedFilename := formatFileName(obj.Key)
 		if _, found := thumbnailsCache.findImageByKey(obj.Key); !found {
-			err := getImageFromBucket(thumbnailsCache, minioClient, obj.Key, formattedFilename, "", obj.LastModified, nil, false)
+			err := getImageFromBucket(thumbnailsCache, store, obj, formattedFilename, "", nil, false)
 			if err != nil {
 				printError(fmt.Errorf("failed to fetch thumbnail %q: %w", obj.Key, err), false)
 				continue
 			}
 
-			thumbnailsCache.addImage(obj.Key, obj.Size, obj.LastModified)
+			thumbnailsCache.addImage(obj)
 		}
 
 		thumbnails = append(thumbnails, getThumbnailsCacheFileLink(formattedFilename))
@@ -283,142 +318,236 @@ func fetchThumbnailsFrom(imgDir, imgKey string, minioClient *minio.Client) []str
 	return thumbnails
 }
 
-func listMetaFiles(minioClient *minio.Client, dirs map[string]string, eventChan chan event) {
-	printDebug(fmt.Sprintf("Looking for metadata files in bucket [%s] ...", config.S3.BucketName))
+func listMetaFiles(bucket *BucketConfig, dirs map[string]string, eventChan chan event) {
+	printDebug(fmt.Sprintf("Looking for metadata files in bucket [%s] ...", bucket.name()))
 
 	tempFullProductLinksCache := map[string][]string{}
+	tempFullProductLinksCacheMutex := sync.Mutex{}
+
+	pool := newWorkerPool(config.DownloadWorkers)
 
 	for dir, targetImg := range dirs {
-		func() { // usage of an anonymous function to call defer funcs at the end of each loop
-			tempFullProductLinksCache[dir] = make([]string, 0)
+		// the directory is used as the key to keep the events of a product in order
+		pool.submit(dir, func() {
+			// the image may have been evicted since it was downloaded
+			if _, found := mainCache.findImageByKey(targetImg); !found {
+				return
+			}
 
-			ctx, cancel := context.WithTimeout(context.Background(), config.PollingPeriod)
-			defer cancel()
+			links := listProductMetaFiles(bucket.store, dir, targetImg, eventChan)
 
-			printDebug("Looking for metadata files in ", dir)
+			tempFullProductLinksCacheMutex.Lock()
+			tempFullProductLinksCache[dir] = links
+			tempFullProductLinksCacheMutex.Unlock()
+		})
+	}
 
-			for obj := range minioClient.ListObjects(ctx, config.S3.BucketName, minio.ListObjectsOptions{Prefix: dir + "/", Recursive: true}) {
-				if obj.Err != nil {
-					continue
-				}
+	pool.wait()
+
+	fullProductLinksCacheMutex.Lock()
+	// only replace the links of this bucket, the other ones are kept
+	for dir := range fullProductLinksCache {
+		if imgType := inferImageType(dir); imgType != nil && imgType.getBucket() == bucket {
+			delete(fullProductLinksCache, dir)
 
-				// geonames
-				if len(config.GeonamesFilename) > 0 && strings.HasSuffix(obj.Key, "/"+config.GeonamesFilename) { //nolint:nestif
-					formattedFilename := formatFileName(dir + "/" + config.GeonamesFilename)
-					if geonames, alreadyInCache := geonamesCache[formattedFilename]; alreadyInCache {
-						if geonames.lastUpdate.Before(obj.LastModified) {
-							err := getGeonamesFileFromBucket(minioClient, obj.Key, obj.LastModified, formattedFilename, targetImg, eventChan)
-							if err != nil {
-								printError(err, false)
-								continue
-							}
-						}
+			if _, found := tempFullProductLinksCache[dir]; !found {
+				cacheIndex.deleteLinks(dir)
+			}
+		}
+	}
 
-						tempFullProductLinksCache[dir] = append(tempFullProductLinksCache[dir], getMainCacheFileLink(strings.ReplaceAll(dir, "/", "@"), config.GeonamesFilename))
+	maps.Copy(fullProductLinksCache, tempFullProductLinksCache)
+	fullProductLinksCacheMutex.Unlock()
 
-						continue
-					}
+	for dir, links := range tempFullProductLinksCache {
+		cacheIndex.putLinks(dir, links)
+	}
+}
 
-					printDebug("Found geonames file: ", obj.Key)
+// listProductMetaFiles fetches the metadata files of the product stored in the given directory,
+// and returns the links to its full product and additional files.
+func listProductMetaFiles(store ObjectStore, dir, targetImg string, eventChan chan event) []string {
+	links := make([]string, 0)
 
-					err := getGeonamesFileFromBucket(minioClient, obj.Key, obj.LastModified, formattedFilename, targetImg, eventChan)
+	ctx, cancel := context.WithTimeout(context.Background(), config.PollingPeriod)
+	defer cancel()
+
+	printDebug("Looking for metadata files in ", dir)
+
+	for obj := range store.ListObjects(ctx, dir+"/", true) {
+		if obj.Err != nil {
+			continue
+		}
+
+		// geonames
+		if len(config.GeonamesFilename) > 0 && strings.HasSuffix(obj.Key, "/"+config.GeonamesFilename) { //nolint:nestif
+			formattedFilename := formatFileName(dir + "/" + config.GeonamesFilename)
+
+			geonamesCacheMutex.Lock()
+			geonames, alreadyInCache := geonamesCache[formattedFilename]
+			geonamesCacheMutex.Unlock()
+
+			if alreadyInCache {
+				if geonames.lastUpdate.Before(obj.LastModified) {
+					err := getGeonamesFileFromBucket(store, obj.Key, obj.LastModified, obj.ETag, formattedFilename, targetImg, eventChan)
 					if err != nil {
 						printError(err, false)
-
 						continue
 					}
+				}
 
-					tempFullProductLinksCache[dir] = append(tempFullProductLinksCache[dir], getMainCacheFileLink(strings.ReplaceAll(dir, "/", "@"), config.GeonamesFilename))
+				links = append(links, getMainCacheFileLink(strings.ReplaceAll(dir, "/", "@"), config.GeonamesFilename))
 
-					continue
-				}
+				continue
+			}
 
-				// localization
-				if len(config.LocalizationFilename) > 0 && strings.HasSuffix(obj.Key, "/"+config.LocalizationFilename) {
-					formattedFilename := formatFileName(dir + "/" + config.LocalizationFilename)
-					if localizationCache[formattedFilename].lastUpdate.Before(obj.LastModified) {
-						printDebug("Found localization file: ", obj.Key)
+			printDebug("Found geonames file: ", obj.Key)
 
-						err := getLocalizationFileFromBucket(minioClient, obj.Key, obj.LastModified, formattedFilename, targetImg)
-						if err != nil {
-							printError(err, false)
+			err := getGeonamesFileFromBucket(store, obj.Key, obj.LastModified, obj.ETag, formattedFilename, targetImg, eventChan)
+			if err != nil {
+				printError(err, false)
 
-							continue
-						}
-					}
-				}
+				continue
+			}
 
-				// features
-				if config.featuresExtensionRegexp != nil && config.featuresExtensionRegexp.MatchString(obj.Key) {
-					parts := strings.Split(obj.Key, "/")
-					filename := parts[len(parts)-1]
-					formattedFilename := formatFileName(dir + "/" + filename)
+			links = append(links, getMainCacheFileLink(strings.ReplaceAll(dir, "/", "@"), config.GeonamesFilename))
 
-					if featuresCache[formattedFilename].lastUpdate.Before(obj.LastModified) {
-						printDebug("Found features file: ", obj.Key)
+			continue
+		}
 
-						err := getFeaturesFileFromBucket(minioClient, obj.Key, obj.LastModified, formattedFilename, targetImg, eventChan)
-						if err != nil {
-							printError(err, false)
-						}
-					}
+		// localization
+		if len(config.LocalizationFilename) > 0 && strings.HasSuffix(obj.Key, "/"+config.LocalizationFilename) {
+			formattedFilename := formatFileName(dir + "/" + config.LocalizationFilename)
 
-					tempFullProductLinksCache[dir] = append(tempFullProductLinksCache[dir], getMainCacheFileLink(strings.ReplaceAll(dir, "/", "@"), filename))
+			localizationCacheMutex.Lock()
+			lastUpdate := localizationCache[formattedFilename].lastUpdate
+			localizationCacheMutex.Unlock()
+
+			if lastUpdate.Before(obj.LastModified) {
+				printDebug("Found localization file: ", obj.Key)
+
+				err := getLocalizationFileFromBucket(store, obj.Key, obj.LastModified, obj.ETag, formattedFilename, targetImg)
+				if err != nil {
+					printError(err, false)
 
 					continue
 				}
+			}
+		}
 
-				// full product images
-				if len(config.FullProductExtension) > 0 && strings.HasSuffix(obj.Key, config.FullProductExtension) {
-					tempFullProductLinksCache[dir] = append(tempFullProductLinksCache[dir], getFullProductImageLink(minioClient, obj.Key))
+		// features
+		if config.featuresExtensionRegexp != nil && config.featuresExtensionRegexp.MatchString(obj.Key) {
+			parts := strings.Split(obj.Key, "/")
+			filename := parts[len(parts)-1]
+			formattedFilename := formatFileName(dir + "/" + filename)
 
-					continue
+			featuresCacheMutex.Lock()
+			lastUpdate := featuresCache[formattedFilename].lastUpdate
+			featuresCacheMutex.Unlock()
+
+			if lastUpdate.Before(obj.LastModified) {
+				printDebug("Found features file: ", obj.Key)
+
+				err := getFeaturesFileFromBucket(store, obj.Key, obj.LastModified, obj.ETag, formattedFilename, targetImg, eventChan)
+				if err != nil {
+					printError(err, false)
 				}
+			}
 
-				if config.additionalProductFilesRegexp != nil && config.additionalProductFilesRegexp.MatchString(obj.Key) {
-					parts := strings.Split(obj.Key, "/")
-					filename := parts[len(parts)-1]
-					formattedFilename := formatFileName(dir + "/" + filename)
+			links = append(links, getMainCacheFileLink(strings.ReplaceAll(dir, "/", "@"), filename))
 
-					if additionalProductFilesCache[formattedFilename].Before(obj.LastModified) {
-						printDebug("Found additional product file: ", obj.Key)
+			continue
+		}
 
-						err := getFileFromBucket(minioClient, obj.Key, filepath.Join(config.mainCacheDir, formattedFilename))
-						if err != nil {
-							printError(err, false)
+		// full product images
+		if len(config.FullProductExtension) > 0 && strings.HasSuffix(obj.Key, config.FullProductExtension) {
+			links = append(links, getFullProductImageLink(store, obj.Key))
 
-							continue
-						}
-					}
+			continue
+		}
 
-					additionalProductFilesCache[formattedFilename] = obj.LastModified
+		if config.additionalProductFilesRegexp != nil && config.additionalProductFilesRegexp.MatchString(obj.Key) {
+			parts := strings.Split(obj.Key, "/")
+			filename := parts[len(parts)-1]
+			formattedFilename := formatFileName(dir + "/" + filename)
 
-					tempFullProductLinksCache[dir] = append(tempFullProductLinksCache[dir], getMainCacheFileLink(strings.ReplaceAll(dir, "/", "@"), filename))
+			additionalProductFilesCacheMutex.Lock()
+			lastUpdate := additionalProductFilesCache[formattedFilename]
+			additionalProductFilesCacheMutex.Unlock()
+
+			if lastUpdate.Before(obj.LastModified) {
+				printDebug("Found additional product file: ", obj.Key)
+
+				err := getFileFromBucket(store, obj.Key, filepath.Join(config.mainCacheDir, formattedFilename))
+				if err != nil {
+					printError(err, false)
+
+					continue
 				}
 			}
-		}()
+
+			additionalProductFilesCacheMutex.Lock()
+			additionalProductFilesCache[formattedFilename] = obj.LastModified
+			additionalProductFilesCacheMutex.Unlock()
+			cacheIndex.putFile(formattedFilename, indexedFile{
+				Kind:         fileKindAdditional,
+				TargetImg:    targetImg,
+				ETag:         obj.ETag,
+				LastModified: obj.LastModified,
+			})
+
+			links = append(links, getMainCacheFileLink(strings.ReplaceAll(dir, "/", "@"), filename))
+		}
 	}
 
-	fullProductLinksCacheMutex.Lock()
-	fullProductLinksCache = tempFullProductLinksCache
-	fullProductLinksCacheMutex.Unlock()
+	return links
 }
 
-func extractFilesFromBucket(minioClient *minio.Client, eventChan chan event) error {
+// extractFilesFromBucket downloads the new images of the bucket and their metadata files.
+// The listing stops when the context is canceled.
+func extractFilesFromBucket(ctx context.Context, bucket *BucketConfig, eventChan chan event) (err error) {
 	pollMutex.Lock()
 	defer pollMutex.Unlock()
 
-	printInfo(fmt.Sprintf("Looking for images in bucket [%s] ...", config.S3.BucketName))
+	start := time.Now()
+
+	defer func() {
+		result := resultSuccess
+		if err != nil {
+			result = resultError
+		}
+
+		extractDuration.WithLabelValues(bucket.name(), result).Observe(time.Since(start).Seconds())
+		bucket.health.extractionDone(err)
+	}()
+
+	store := bucket.store
+
+	printInfo(fmt.Sprintf("Looking for images in bucket [%s] ...", bucket.name()))
 
 	previewBaseDirs := map[string]string{}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 120*time.Second)
 	defer cancel()
 
-	for _, imgType := range config.imageTypes {
-		for obj := range minioClient.ListObjects(ctx, config.S3.BucketName, minio.ListObjectsOptions{Prefix: imgType.ProductPrefix, Recursive: true}) {
+	pool := newWorkerPool(config.DownloadWorkers)
+
+	var (
+		downloadErr      error
+		downloadErrMutex sync.Mutex
+	)
+
+	for _, imgType := range bucket.imageTypes {
+		for obj := range store.ListObjects(ctx, imgType.ProductPrefix, true) {
 			if obj.Err != nil {
+				pool.wait()
+
+				if ctx.Err() != nil && errors.Is(obj.Err, context.Canceled) {
+					return obj.Err
+				}
+
 				handleS3Error(fmt.Errorf("no connection to S3 server => exit: %w", obj.Err))
+
 				return obj.Err
 			}
 
@@ -426,13 +555,18 @@ func extractFilesFromBucket(minioClient *minio.Client, eventChan chan event) err
 				continue
 			}
 
-			if obj.LastModified.Add(config.RetentionPeriod).Before(time.Now()) {
-				printDebug("Found image '", obj.Key, "', ignored because older than ", config.RetentionPeriod.String())
+			if obj.LastModified.Add(imgType.getRetentionPeriod()).Before(time.Now()) {
+				printDebug("Found image '", obj.Key, "', ignored because older than ", imgType.getRetentionPeriod().String())
+				continue
+			}
+
+			// the evicted images are only downloaded again once they are modified
+			if diskQuota.wasEvicted(obj) {
 				continue
 			}
 
-			// previewBaseDirs = append(previewBaseDirs, obj.Key[:strings.LastIndex(obj.Key, "/")])
-			previewBaseDirs[obj.Key[:strings.LastIndex(obj.Key, "/")]] = obj.Key
+			productDir := obj.Key[:strings.LastIndex(obj.Key, "/")]
+			previewBaseDirs[productDir] = obj.Key
 
 			formattedName := formatFileName(obj.Key)
 
@@ -444,38 +578,55 @@ func extractFilesFromBucket(minioClient *minio.Client, eventChan chan event) err
 				}
 			}
 
-			err := getImageFromBucket(mainCache, minioClient, obj.Key, formattedName, imgType.Name, obj.LastModified, eventChan, needsUpdate)
-			if err != nil {
-				return err
-			}
-			// As getImageFromBucket does not add the image to the mainCache,
-			// we need to update it if the image was already there or add it manually if it's a new one
-			img, found := mainCache.findImageByKey(obj.Key)
-			if found {
-				img.LastModified = obj.LastModified
-			} else {
-				mainCache.addImage(obj.Key, obj.Size, obj.LastModified)
-			}
+			pool.submit(productDir, func() {
+				err := getImageFromBucket(mainCache, store, obj, formattedName, imgType.Name, eventChan, needsUpdate)
+				if err != nil {
+					downloadErrMutex.Lock()
+					downloadErr = errors.Join(downloadErr, err)
+					downloadErrMutex.Unlock()
+
+					return
+				}
+				// As getImageFromBucket does not add the image to the mainCache,
+				// we need to add it, or update it if the image was already there
+				mainCache.addImage(obj)
+			})
 		}
 	}
 
-	listMetaFiles(minioClient, previewBaseDirs, eventChan)
+	// the previews must all be there before their metadata files are fetched
+	pool.wait()
+
+	if downloadErr != nil {
+		return downloadErr
+	}
+
+	listMetaFiles(bucket, previewBaseDirs, eventChan)
 
 	return nil
 }
 
-func pollBucket(minioClient *minio.Client, eventChan chan event) {
+// pollBuckets extracts the files of the buckets every polling period, until the context is canceled.
+func pollBuckets(ctx context.Context, eventChan chan event) {
 	go func() {
 		startTime := time.Now()
 
 		for {
-			time.Sleep(config.PollingPeriod - time.Since(startTime))
+			select {
+			case <-time.After(config.PollingPeriod - time.Since(startTime)):
+			case <-ctx.Done():
+				printInfo("Stopped polling")
+
+				return
+			}
 
 			startTime = time.Now()
 
-			err := extractFilesFromBucket(minioClient, eventChan)
-			if err != nil {
-				printError(fmt.Errorf("failed to extract files from bucket: %w", err), false)
+			for b := range config.Buckets {
+				err := extractFilesFromBucket(ctx, &config.Buckets[b], eventChan)
+				if err != nil && ctx.Err() == nil {
+					printError(fmt.Errorf("failed to extract files from bucket [%s]: %w", config.Buckets[b].name(), err), false)
+				}
 			}
 		}
 	}()
@@ -483,127 +634,156 @@ func pollBucket(minioClient *minio.Client, eventChan chan event) {
 	printInfo("Started polling")
 }
 
-func listenToBucket(minioClient *minio.Client, eventChan chan event) {
-	previewNotifs := minioClient.ListenBucketNotification(context.Background(), config.S3.BucketName, "config.S3.KeyPrefix", config.PreviewFilename, []string{"s3:ObjectCreated:*", "s3:ObjectRemoved:*"})
-	geonamesNotifs := minioClient.ListenBucketNotification(context.Background(), config.S3.BucketName, "config.S3.KeyPrefix", config.GeonamesFilename, []string{"s3:ObjectCreated:*"})
-	fullProductNotifs := minioClient.ListenBucketNotification(context.Background(), config.S3.BucketName, "config.S3.KeyPrefix", config.FullProductExtension, []string{"s3:ObjectCreated:*"})
+// listenToBucket handles the notifications of the bucket, until the context is canceled.
+func listenToBucket(ctx context.Context, bucket *BucketConfig, eventChan chan event) {
+	store := bucket.store
+
+	previewNotifs := store.Watch(ctx, bucket.KeyPrefix, config.PreviewFilename, objectCreated, objectRemoved)
+	geonamesNotifs := store.Watch(ctx, bucket.KeyPrefix, config.GeonamesFilename, objectCreated)
+	fullProductNotifs := store.Watch(ctx, bucket.KeyPrefix, config.FullProductExtension, objectCreated)
 
 	go func() {
-		printInfo("Starting to listen for bucket notifications ...")
+		printInfo(fmt.Sprintf("Starting to listen for notifications of bucket [%s] ...", bucket.name()))
+		bucket.health.setListenerState(listenerListening)
+
+		// a closed notifications channel is set to nil, so that it isn't selected anymore
+		stopped := func(notifs *<-chan ObjectEvent) {
+			*notifs = nil
+
+			if ctx.Err() != nil {
+				return
+			}
+
+			printError(fmt.Errorf("the notifications listener of bucket [%s] stopped", bucket.name()), false)
+			bucket.health.setListenerState(listenerStopped)
+		}
 
 		for {
 			select {
-			case notif := <-previewNotifs:
+			case <-ctx.Done():
+				printInfo(fmt.Sprintf("Stopped listening for notifications of bucket [%s]", bucket.name()))
+				bucket.health.setListenerState(listenerStopped)
+
+				return
+			case notif, ok := <-previewNotifs:
+				if !ok {
+					stopped(&previewNotifs)
+
+					continue
+				}
+
 				if err := notif.Err; err != nil {
 					printError(fmt.Errorf("failed to receive preview notification: %w", err), false)
+					bucket.health.listenerError(err)
+
+					continue
+				}
+
+				obj := notif.Object
+				objKey := obj.Key
+				formattedName := formatFileName(objKey)
 
+				imgType := inferImageType(objKey)
+				if imgType == nil {
 					continue
 				}
 
-				for _, e := range notif.Records {
-					obj := e.S3.Object
-					objKey := obj.Key
-					formattedName := formatFileName(objKey)
-
-					if strings.HasPrefix(e.EventName, "s3:ObjectCreated") {
-						printDebug("[Created]: ", objKey)
-
-						err := getImageFromBucket(mainCache, minioClient, objKey, formattedName, inferImageType(objKey).Name, time.Now(), nil, false)
-						if err != nil {
-							printError(err, false)
-
-							continue
-						}
-
-						objDate, err := time.Parse("2006-01-02T15:04:05.000Z", e.EventTime)
-						if err != nil {
-							printWarn(fmt.Errorf("failed to parse event time: %w", err), false)
-
-							objDate = time.Now()
-						}
-
-						mainCache.addImage(objKey, obj.Size, objDate)
-						eventChan <- event{EventType: eventAdd, EventObj: EventObject{
-							ImgType: inferImageType(formattedName).Name,
-							ImgKey:  formattedName,
-							ImgName: getGeoname(formattedName),
-							ImgDate: objDate.In(time.Local).Format("2006-01-02 15:04:05 MST"), //nolint:gosmopolitan
-						}, EventDate: time.Now().String(),
-							source: "listenToBucket"}
-					} else if strings.HasPrefix(e.EventName, "s3:ObjectRemoved") {
-						printDebug("[Removed]: ", objKey)
-						deleteFileFromCache(formattedName)
-						mainCache.deleteImage(formattedName)
-						eventChan <- event{EventType: eventRemove, EventObj: EventObject{ImgKey: formattedName}, source: "listenToBucket"}
+				switch notif.Type {
+				case objectCreated:
+					printDebug("[Created]: ", objKey)
+
+					err := getImageFromBucket(mainCache, store, obj, formattedName, imgType.Name, nil, false)
+					if err != nil {
+						printError(err, false)
+
+						continue
 					}
+
+					objDate := notif.Time
+
+					mainCache.addImage(obj)
+					eventChan <- event{EventType: eventAdd, EventObj: EventObject{
+						ImgType: imgType.Name,
+						ImgKey:  formattedName,
+						ImgName: getGeoname(formattedName),
+						ImgDate: objDate.In(time.Local).Format("2006-01-02 15:04:05 MST"), //nolint:gosmopolitan
+					}, EventDate: time.Now().String(),
+						source: "listenToBucket"}
+				case objectRemoved:
+					printDebug("[Removed]: ", objKey)
+					expiryScheduler.cancel(mainCache, formattedName)
+					removeCachedImage(mainCache, formattedName)
+					eventChan <- event{EventType: eventRemove, EventObj: EventObject{ImgKey: formattedName}, source: "listenToBucket"}
+				}
+			case notif, ok := <-geonamesNotifs:
+				if !ok {
+					stopped(&geonamesNotifs)
+
+					continue
 				}
-			case notif := <-geonamesNotifs:
+
 				if err := notif.Err; err != nil {
 					printError(fmt.Errorf("failed to receive geonames notification: %w", err), false)
+					bucket.health.listenerError(err)
 
 					continue
 				}
 
-				for _, e := range notif.Records {
-					objKey := e.S3.Object.Key
-					printDebug("[Created geonames]: ", objKey)
+				objKey := notif.Object.Key
+				printDebug("[Created geonames]: ", objKey)
 
-					img, found := mainCache.findImageByKey(objKey)
-					if !found {
-						continue
-					}
+				imgs := mainCache.findImagesInDir(productDirOf(objKey))
+				if len(imgs) == 0 {
+					continue
+				}
 
-					log.Println("Event time:", e.EventTime)
-					//                          2016–09–08T22:34:38.226Z
-					objDate, err := time.Parse("2006-01-02T15:04:05.000Z", e.EventTime)
-					if err != nil {
-						printError(fmt.Errorf("failed to parse event time: %w", err), false)
+				img := imgs[0]
 
-						objDate = time.Now()
-					}
+				err := getGeonamesFileFromBucket(store, objKey, notif.Time, notif.Object.ETag, img.getAssociatedGeonamesPath(), img.FormattedKey, eventChan)
+				if err != nil {
+					printError(err, false)
 
-					err = getGeonamesFileFromBucket(minioClient, objKey, objDate, img.getAssociatedGeonamesPath(), img.FormattedKey, eventChan)
-					if err != nil {
-						printError(err, false)
+					continue
+				}
+			case notif, ok := <-fullProductNotifs:
+				if !ok {
+					stopped(&fullProductNotifs)
 
-						continue
-					}
+					continue
 				}
-			case notif := <-fullProductNotifs:
+
 				if err := notif.Err; err != nil {
 					printError(fmt.Errorf("failed to receive full product notification: %w", err), false)
+					bucket.health.listenerError(err)
 
 					continue
 				}
-			RecordsLoop:
-				for _, e := range notif.Records {
-					objKey := e.S3.Object.Key
-					printDebug("[Created full prod]: ", objKey)
-					// formattedFilename := strings.ReplaceAll(objKey, "/", "@")
-					// img, found := getCorrespondingImage(formattedFilename)
-					img, found := mainCache.findImageByKey(objKey)
-					if !found {
-						continue
-					}
 
-					imgDir := img.S3Key[:strings.LastIndex(img.S3Key, "/")]
-					fullProductLink := getFullProductImageLink(minioClient, objKey)
-					fullProductLinksCacheMutex.Lock()
-
-					existingLinks, found := fullProductLinksCache[imgDir]
-					if found {
-						for _, link := range existingLinks {
-							if link == fullProductLink {
-								continue RecordsLoop
-							}
-						}
-					} else {
-						existingLinks = []string{}
-					}
+				objKey := notif.Object.Key
+				printDebug("[Created full prod]: ", objKey)
+				// formattedFilename := strings.ReplaceAll(objKey, "/", "@")
+				// img, found := getCorrespondingImage(formattedFilename)
+				imgs := mainCache.findImagesInDir(productDirOf(objKey))
+				if len(imgs) == 0 {
+					continue
+				}
+
+				img := imgs[0]
+				imgDir := img.S3Key[:strings.LastIndex(img.S3Key, "/")]
+				fullProductLink := getFullProductImageLink(store, objKey)
+				fullProductLinksCacheMutex.Lock()
 
+				existingLinks, found := fullProductLinksCache[imgDir]
+				if !found {
+					existingLinks = []string{}
+				}
+
+				if !slices.Contains(existingLinks, fullProductLink) {
 					fullProductLinksCache[imgDir] = append(existingLinks, fullProductLink)
-					fullProductLinksCacheMutex.Unlock()
+					cacheIndex.putLinks(imgDir, fullProductLinksCache[imgDir])
 				}
+
+				fullProductLinksCacheMutex.Unlock()
 			}
 		}
 	}()
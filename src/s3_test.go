@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testBucketConfig = `
+s3:
+  backend: local
+  localDir: %q
+  bucketName: "my-bucket"
+  keyPrefix: "my-prefix/"
+imageGroups:
+  - groupName: "Group 1"
+    types:
+      - name: "TYPE1"
+        displayName: "Type 1"
+        productPrefix: "my-prefix/TYPE1/"
+        productRegexp: "^(?P<parent>.*/DIR_[^/]*/[^/]*)/preview.jpg$"
+previewFilename: "preview.jpg"
+geonamesFilename: "geonames.json"
+localizationFilename: "localization.json"
+fullProductExtension: "tif"
+additionalProductFilesRegexp: "osmtags.json"
+logLevel: "error"
+cacheDir: %q
+retentionPeriod: 1h
+pollingPeriod: 10s
+`
+
+// testProductDir returns the key of the directory of the i-th product of the test bucket.
+func testProductDir(i int) string {
+	return fmt.Sprintf("my-prefix/TYPE1/x/DIR_a/r%d", i)
+}
+
+// writeTestProduct writes the preview of the i-th product and its metadata files in the local bucket.
+// They are written aside and moved into the bucket at once, so that they are never listed half-written.
+func writeTestProduct(t *testing.T, dataDir, stagingDir string, i int) {
+	t.Helper()
+
+	preview := image.NewRGBA(image.Rect(0, 0, 8, 8))
+	for p := range preview.Pix {
+		preview.Pix[p] = uint8(i)
+	}
+
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, preview); err != nil {
+		t.Error(err)
+
+		return
+	}
+
+	files := map[string][]byte{
+		"preview.jpg":   encoded.Bytes(),
+		"full.tif":      nil,
+		"osmtags.json":  []byte(`{}`),
+		"geonames.json": []byte(`[{"name": "France"}]`),
+		"localization.json": fmt.Appendf(nil, `{"corner": {
+			"upper-left": {"coordinates": {"lon": %d, "lat": 49}}, "upper-right": {"coordinates": {"lon": %d, "lat": 49}},
+			"lower-right": {"coordinates": {"lon": %d, "lat": 48}}, "lower-left": {"coordinates": {"lon": %d, "lat": 48}}}}`, i, i+1, i+1, i),
+	}
+
+	productDir := filepath.Join(stagingDir, fmt.Sprintf("r%d", i))
+	if err := os.MkdirAll(productDir, 0o750); err != nil {
+		t.Error(err)
+
+		return
+	}
+
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(productDir, name), content, 0o600); err != nil {
+			t.Error(err)
+
+			return
+		}
+	}
+
+	if err := os.Rename(productDir, filepath.Join(dataDir, filepath.FromSlash(testProductDir(i)))); err != nil {
+		t.Error(err)
+	}
+}
+
+// setUpTestBucket loads a configuration serving the given directory as a local bucket, and initializes
+// the caches the way main does. The previous globals are restored at the end of the test.
+func setUpTestBucket(t *testing.T, dataDir string) (*BucketConfig, chan event) {
+	t.Helper()
+
+	cacheDir := t.TempDir()
+	configPath := filepath.Join(cacheDir, "config.yml")
+
+	err := os.WriteFile(configPath, fmt.Appendf(nil, testBucketConfig, dataDir, filepath.Join(cacheDir, "cache")), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	previousConfig, previousCacheIndex, previousDiskQuota, previousSpatialIndex := config, cacheIndex, diskQuota, spatialIndex
+	previousMainCache, previousThumbnailsCache, previousExpiryScheduler := mainCache, thumbnailsCache, expiryScheduler
+	previousGeonames, previousLocalizations, previousFeatures := geonamesCache, localizationCache, featuresCache
+	previousLinks, previousAdditionalFiles := fullProductLinksCache, additionalProductFilesCache
+
+	t.Cleanup(func() {
+		config, cacheIndex, diskQuota, spatialIndex = previousConfig, previousCacheIndex, previousDiskQuota, previousSpatialIndex
+		mainCache, thumbnailsCache, expiryScheduler = previousMainCache, previousThumbnailsCache, previousExpiryScheduler
+		geonamesCache, localizationCache, featuresCache = previousGeonames, previousLocalizations, previousFeatures
+		fullProductLinksCache, additionalProductFilesCache = previousLinks, previousAdditionalFiles
+	})
+
+	config, err = loadConfigFromFile(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bucket := &config.Buckets[0]
+
+	bucket.store, err = newObjectStore(bucket.S3Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bucket.health = &bucketHealth{listener: listenerStarting}
+
+	cacheIndex, err = openCacheIndex(config.BaseCacheDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { _ = cacheIndex.close() })
+
+	eventChan := make(chan event, 1)
+
+	mainCache = createCache(config.mainCacheDir)
+	thumbnailsCache = createCache(config.thumbnailsCacheDir)
+	geonamesCache = make(map[string]Geonames)
+	localizationCache = make(map[string]Localization)
+	featuresCache = make(map[string]Features)
+	fullProductLinksCache = make(map[string][]string)
+	additionalProductFilesCache = make(map[string]time.Time)
+	expiryScheduler = newExpiryScheduler(eventChan)
+	diskQuota = newDiskQuota(eventChan)
+	spatialIndex = newSpatialIndex()
+
+	return bucket, eventChan
+}
+
+// waitFor polls the condition until it is met, and fails the test after a while.
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+
+	for deadline := time.Now().Add(20 * time.Second); !condition(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// TestExtractionAndListener runs the extraction of a local bucket and its notifications listener while
+// products are added and removed, and the handlers read the caches. To be run with the race detector:
+// go test -race ./src
+func TestExtractionAndListener(t *testing.T) {
+	const (
+		extracted = 20
+		added     = 20
+		removed   = 10
+	)
+
+	dataDir, stagingDir := t.TempDir(), t.TempDir()
+
+	if err := os.MkdirAll(filepath.Join(dataDir, filepath.FromSlash(path.Dir(testProductDir(0)))), 0o750); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range extracted {
+		writeTestProduct(t, dataDir, stagingDir, i)
+	}
+
+	bucket, eventChan := setUpTestBucket(t, dataDir)
+
+	// the events are consumed by the hub in the server
+	go func() {
+		for range eventChan {
+		}
+	}()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/image/", imageHandler)
+	mux.HandleFunc("/images", imagesListHandler)
+	mux.HandleFunc("/infos/", infosHandler)
+	mux.HandleFunc("/api/v1/images", apiImagesHandler)
+	mux.HandleFunc("/api/v1/footprints", footprintsHandler)
+	mux.HandleFunc("/api/v1/expirations", expirationsHandler)
+	mux.HandleFunc("/cache/", cacheHandler)
+	mux.HandleFunc("/thumbnails/", thumbnailsHandler)
+
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	listenToBucket(ctx, bucket, eventChan)
+
+	var (
+		readers sync.WaitGroup
+		done    atomic.Bool
+	)
+
+	// the images and their files are requested whether they are in the cache or not,
+	// the responses depending on the progress of the extraction: only the final state is checked
+	urls := func(i int) []string {
+		formattedKey := formatFileName(testProductDir(i) + "/preview.jpg")
+
+		return []string{
+			"/images",
+			"/api/v1/images?limit=5",
+			"/api/v1/footprints",
+			"/api/v1/expirations",
+			"/image/" + formattedKey,
+			"/infos/" + formattedKey,
+			"/cache/" + formatFileName(testProductDir(i)) + "/osmtags.json",
+			"/thumbnails/" + formattedKey,
+		}
+	}
+
+	for reader := range 4 {
+		readers.Add(1)
+
+		go func() {
+			defer readers.Done()
+
+			for i := reader; !done.Load(); i++ {
+				for _, url := range urls(i % (extracted + added)) {
+					response, err := http.Get(server.URL + url) //nolint:noctx
+					if err != nil {
+						t.Error(err)
+
+						return
+					}
+
+					_, _ = io.Copy(io.Discard, response.Body)
+					_ = response.Body.Close()
+				}
+			}
+		}()
+	}
+
+	var writers sync.WaitGroup
+
+	writers.Add(2)
+
+	go func() {
+		defer writers.Done()
+
+		if err := extractFilesFromBucket(ctx, bucket, eventChan); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	// the products are added while the bucket is extracted, and notified by the listener
+	go func() {
+		defer writers.Done()
+
+		// by then, the listener watches the bucket
+		for len(mainCache.snapshot()) == 0 {
+			time.Sleep(time.Millisecond)
+		}
+
+		for i := extracted; i < extracted+added; i++ {
+			writeTestProduct(t, dataDir, stagingDir, i)
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+
+	writers.Wait()
+	waitFor(t, "the added products", func() bool { return len(mainCache.snapshot()) == extracted+added })
+
+	for i := range removed {
+		if err := os.Remove(filepath.Join(dataDir, filepath.FromSlash(testProductDir(i)), "preview.jpg")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	waitFor(t, "the removed products", func() bool { return len(mainCache.snapshot()) == extracted+added-removed })
+
+	done.Store(true)
+	readers.Wait()
+
+	for i := range extracted + added {
+		key := testProductDir(i) + "/preview.jpg"
+		formattedKey := formatFileName(key)
+
+		img, found := mainCache.findImageByKey(key)
+		if _, err := os.Stat(filepath.Join(config.mainCacheDir, formattedKey)); found != (err == nil) {
+			t.Errorf("%s: found in the cache %t, but its file: %v", formattedKey, found, err)
+		}
+
+		if found != (i >= removed) {
+			t.Errorf("%s: expected to be found %t", formattedKey, i >= removed)
+		}
+
+		if found && img.AssociatedLocalization == nil && i < extracted {
+			t.Errorf("%s: the localization of the extracted product is missing", formattedKey)
+		}
+	}
+
+	// the first product left is served along with its files
+	formattedKey := formatFileName(testProductDir(removed) + "/preview.jpg")
+
+	for _, url := range []string{"/image/" + formattedKey, "/infos/" + formattedKey, "/cache/" + formatFileName(testProductDir(removed)) + "/osmtags.json"} {
+		response, err := http.Get(server.URL + url) //nolint:noctx
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_ = response.Body.Close()
+
+		if response.StatusCode != http.StatusOK {
+			t.Errorf("%s: expected the status 200, got %d", url, response.StatusCode)
+		}
+	}
+
+	response, err := http.Get(server.URL + "/images") //nolint:noctx
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer response.Body.Close()
+
+	var list struct {
+		Data []S3Image `json:"data"`
+	}
+
+	if err := json.NewDecoder(response.Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(list.Data) != extracted+added-removed {
+		t.Errorf("expected %d images to be listed, got %d", extracted+added-removed, len(list.Data))
+	}
+
+	// the listener must be stopped before the directories are removed
+	cancel()
+	waitFor(t, "the listener to stop", func() bool {
+		bucket.health.mutex.Lock()
+		defer bucket.health.mutex.Unlock()
+
+		return bucket.health.listener == listenerStopped
+	})
+
+	close(eventChan)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// errShuttingDown is returned by the operations refused because the server is shutting down.
+var errShuttingDown = errors.New("the server is shutting down")
+
+// activityTracker counts the running tasks of a kind, so that the shutdown can wait for them.
+// Once it is draining, no new task can begin.
+type activityTracker struct {
+	mutex    sync.Mutex
+	count    int
+	draining bool
+	idle     chan struct{}
+}
+
+func newActivityTracker() *activityTracker {
+	return &activityTracker{idle: make(chan struct{})}
+}
+
+// begin registers a new task, and returns false if the tracker is draining.
+func (tracker *activityTracker) begin() bool {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	if tracker.draining {
+		return false
+	}
+
+	tracker.count++
+
+	return true
+}
+
+func (tracker *activityTracker) end() {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	tracker.count--
+	if tracker.draining && tracker.count == 0 {
+		close(tracker.idle)
+	}
+}
+
+// drain refuses the new tasks and waits for the running ones to end.
+// It returns false if some of them are still running after the timeout.
+func (tracker *activityTracker) drain(timeout time.Duration) bool {
+	tracker.mutex.Lock()
+	if !tracker.draining {
+		tracker.draining = true
+
+		if tracker.count == 0 {
+			close(tracker.idle)
+		}
+	}
+	tracker.mutex.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-tracker.idle:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+//nolint:gochecknoglobals
+var (
+	// downloads tracks the objects being downloaded from the buckets
+	downloads = newActivityTracker()
+	// downloadsCtx is canceled to abort the downloads that didn't end in time during the shutdown
+	downloadsCtx, abortDownloads = context.WithCancel(context.Background())
+)
+
+// shutdown stops the server once the polling and the notifications listeners have been stopped:
+// the in-flight downloads are given the shutdown timeout to complete before being aborted,
+// the events clients are disconnected, and the HTTP server waits for the running requests.
+func shutdown(server *http.Server, hub *Hub) {
+	printInfo("Shutting down ...")
+
+	if !downloads.drain(config.ShutdownTimeout) {
+		printWarn("Aborting the downloads still running after ", config.ShutdownTimeout)
+		abortDownloads()
+
+		// the aborted downloads only need to remove their partial files
+		if !downloads.drain(config.ShutdownTimeout) {
+			printWarn("Some downloads are still running")
+		}
+	}
+
+	hub.stop(config.ShutdownTimeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		printError(fmt.Errorf("failed to shut the web server down: %w", err), false)
+	}
+
+	if err := cacheIndex.close(); err != nil {
+		printError(fmt.Errorf("failed to close the cache index: %w", err), false)
+	}
+
+	auditLog.close()
+
+	printInfo("Shutdown complete")
+}
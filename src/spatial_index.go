@@ -0,0 +1,283 @@
+package main
+
+import (
+	"math"
+	"sync"
+)
+
+// kmPerDegree is the length of a degree of latitude, on a sphere of the mean Earth radius.
+const kmPerDegree = 6371.0088 * math.Pi / 180
+
+// SpatialIndex indexes the footprints of the images of the main cache, to find the ones covering a location.
+// It is kept in sync as the localization files are fetched and the images removed.
+type SpatialIndex struct {
+	mutex      sync.RWMutex
+	tree       *RTree
+	footprints map[string]Footprint
+}
+
+func newSpatialIndex() *SpatialIndex {
+	return &SpatialIndex{tree: newRTree(), footprints: make(map[string]Footprint)}
+}
+
+// update indexes the footprint of the image, replacing the previous one.
+// The image is removed from the index if it has no valid localization.
+func (index *SpatialIndex) update(img S3Image) {
+	footprint, found := footprintOf(img)
+
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+
+	index.removeLocked(img.FormattedKey)
+
+	if !found {
+		return
+	}
+
+	index.footprints[img.FormattedKey] = footprint
+
+	for _, box := range footprint.BBox.split() {
+		index.tree.insert(img.FormattedKey, box)
+	}
+}
+
+func (index *SpatialIndex) remove(formattedKey string) {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+
+	index.removeLocked(formattedKey)
+}
+
+func (index *SpatialIndex) removeLocked(formattedKey string) {
+	footprint, found := index.footprints[formattedKey]
+	if !found {
+		return
+	}
+
+	for _, box := range footprint.BBox.split() {
+		index.tree.remove(formattedKey, box)
+	}
+
+	delete(index.footprints, formattedKey)
+}
+
+func (index *SpatialIndex) clear() {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+
+	index.tree = newRTree()
+	index.footprints = make(map[string]Footprint)
+}
+
+// search returns the keys of the images whose footprint matches, among the ones whose bounding box intersects the box.
+func (index *SpatialIndex) search(box BBox, matches func(footprint Footprint) bool) []string {
+	index.mutex.RLock()
+	defer index.mutex.RUnlock()
+
+	found := make(map[string]bool)
+	keys := make([]string, 0)
+
+	for _, part := range box.split() {
+		index.tree.search(part, func(key string) bool {
+			if !found[key] && matches(index.footprints[key]) {
+				found[key] = true
+				keys = append(keys, key)
+			}
+
+			return true
+		})
+	}
+
+	return keys
+}
+
+// intersecting returns the keys of the images whose footprint intersects the box.
+func (index *SpatialIndex) intersecting(box BBox) []string {
+	return index.search(box, func(footprint Footprint) bool {
+		return footprint.intersects(box)
+	})
+}
+
+// containing returns the keys of the images whose footprint contains the point.
+func (index *SpatialIndex) containing(lon, lat float64) []string {
+	return index.search(BBox{MinLon: lon, MinLat: lat, MaxLon: lon, MaxLat: lat}, func(footprint Footprint) bool {
+		return footprint.contains(lon, lat)
+	})
+}
+
+// Neighbour is an image found by a nearest search, with the distance from the point to its footprint.
+type Neighbour struct {
+	Key        string
+	DistanceKm float64
+}
+
+// nearest returns up to limit images accepted by the filter, by increasing distance from the point to their footprint.
+// The distances are computed with an equirectangular projection centered on the point,
+// which is accurate enough at the scale of the footprints.
+func (index *SpatialIndex) nearest(lon, lat float64, limit int, accept func(key string) bool) []Neighbour {
+	index.mutex.RLock()
+	defer index.mutex.RUnlock()
+
+	projection := newLocalProjection(lon, lat)
+	visited := make(map[string]bool)
+	neighbours := make([]Neighbour, 0, limit)
+
+	index.tree.nearest(projection.boxDistance, func(key string) float64 {
+		return projection.footprintDistance(index.footprints[key])
+	}, func(key string, distance float64) bool {
+		if !visited[key] {
+			visited[key] = true
+
+			if accept(key) {
+				neighbours = append(neighbours, Neighbour{Key: key, DistanceKm: distance})
+			}
+		}
+
+		return len(neighbours) < limit
+	})
+
+	return neighbours
+}
+
+// contains returns whether the point is inside one of the polygons of the footprint (even-odd rule).
+func (footprint Footprint) contains(lon, lat float64) bool {
+	for _, ring := range footprint.Polygons {
+		inside := false
+
+		for i, j := 0, len(ring)-2; i < len(ring)-1; j, i = i, i+1 {
+			a, b := ring[i], ring[j]
+			if (a[1] > lat) != (b[1] > lat) && lon < (b[0]-a[0])*(lat-a[1])/(b[1]-a[1])+a[0] {
+				inside = !inside
+			}
+		}
+
+		if inside {
+			return true
+		}
+	}
+
+	return false
+}
+
+// intersects returns whether the footprint and the box have a common point.
+func (footprint Footprint) intersects(box BBox) bool {
+	if !footprint.BBox.intersects(box) {
+		return false
+	}
+
+	for _, part := range box.split() {
+		corners := [][2]float64{
+			{part.MinLon, part.MinLat}, {part.MaxLon, part.MinLat},
+			{part.MaxLon, part.MaxLat}, {part.MinLon, part.MaxLat},
+		}
+
+		for _, corner := range corners {
+			if footprint.contains(corner[0], corner[1]) {
+				return true
+			}
+		}
+
+		for _, ring := range footprint.Polygons {
+			for i := 0; i < len(ring)-1; i++ {
+				if ring[i][0] >= part.MinLon && ring[i][0] <= part.MaxLon && ring[i][1] >= part.MinLat && ring[i][1] <= part.MaxLat {
+					return true
+				}
+
+				for j := range corners {
+					if segmentsIntersect(ring[i], ring[i+1], corners[j], corners[(j+1)%len(corners)]) {
+						return true
+					}
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+func orientation(a, b, c [2]float64) float64 {
+	return (b[0]-a[0])*(c[1]-a[1]) - (b[1]-a[1])*(c[0]-a[0])
+}
+
+func onSegment(a, b, p [2]float64) bool {
+	return min(a[0], b[0]) <= p[0] && p[0] <= max(a[0], b[0]) && min(a[1], b[1]) <= p[1] && p[1] <= max(a[1], b[1])
+}
+
+func segmentsIntersect(p1, p2, q1, q2 [2]float64) bool {
+	d1, d2 := orientation(q1, q2, p1), orientation(q1, q2, p2)
+	d3, d4 := orientation(p1, p2, q1), orientation(p1, p2, q2)
+
+	if ((d1 > 0 && d2 < 0) || (d1 < 0 && d2 > 0)) && ((d3 > 0 && d4 < 0) || (d3 < 0 && d4 > 0)) {
+		return true
+	}
+
+	return (d1 == 0 && onSegment(q1, q2, p1)) || (d2 == 0 && onSegment(q1, q2, p2)) ||
+		(d3 == 0 && onSegment(p1, p2, q1)) || (d4 == 0 && onSegment(p1, p2, q2))
+}
+
+// localProjection projects the coordinates to kilometers on the plane tangent at a point.
+type localProjection struct {
+	lon, lat  float64
+	lonFactor float64
+}
+
+func newLocalProjection(lon, lat float64) localProjection {
+	return localProjection{lon: lon, lat: lat, lonFactor: math.Cos(lat * math.Pi / 180)}
+}
+
+// wrapLongitude brings a difference of longitudes between -180 and 180.
+func wrapLongitude(delta float64) float64 {
+	return delta - 360*math.Round(delta/360)
+}
+
+func (projection localProjection) project(position [2]float64) (x, y float64) {
+	return wrapLongitude(position[0]-projection.lon) * projection.lonFactor * kmPerDegree,
+		(position[1] - projection.lat) * kmPerDegree
+}
+
+// boxDistance returns the distance from the point to the box, which is never greater than the one to what it contains.
+func (projection localProjection) boxDistance(box BBox) float64 {
+	var dLon, dLat float64
+
+	if box.MinLon > projection.lon || projection.lon > box.MaxLon {
+		dLon = min(math.Abs(wrapLongitude(box.MinLon-projection.lon)), math.Abs(wrapLongitude(box.MaxLon-projection.lon)))
+	}
+
+	if projection.lat < box.MinLat {
+		dLat = box.MinLat - projection.lat
+	} else if projection.lat > box.MaxLat {
+		dLat = projection.lat - box.MaxLat
+	}
+
+	return math.Hypot(dLon*projection.lonFactor, dLat) * kmPerDegree
+}
+
+// footprintDistance returns the distance from the point to the footprint, 0 if the footprint contains it.
+func (projection localProjection) footprintDistance(footprint Footprint) float64 {
+	if footprint.contains(projection.lon, projection.lat) {
+		return 0
+	}
+
+	distance := math.Inf(1)
+
+	for _, ring := range footprint.Polygons {
+		for i := 0; i < len(ring)-1; i++ {
+			// the end of the segment is projected from its start, so that the segment isn't split
+			// when it crosses the meridian opposite to the point
+			ax, ay := projection.project(ring[i])
+			dx := wrapLongitude(ring[i+1][0]-ring[i][0]) * projection.lonFactor * kmPerDegree
+			dy := (ring[i+1][1] - ring[i][1]) * kmPerDegree
+
+			// distance from the origin to the segment
+			ratio := 0.0
+
+			if length := dx*dx + dy*dy; length > 0 {
+				ratio = max(0, min(1, -(ax*dx+ay*dy)/length))
+			}
+
+			distance = min(distance, math.Hypot(ax+ratio*dx, ay+ratio*dy))
+		}
+	}
+
+	return distance
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// sseKeepAlivePeriod is the period of the comments sent to keep the idle streams open through the proxies.
+const sseKeepAlivePeriod = 15 * time.Second
+
+// serveSSE streams the events of the hub as server-sent events.
+// The events following the one given by the Last-Event-ID header are replayed first.
+// The events can be filtered with the 'group', 'type' and 'event' query parameters.
+func serveSSE(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+
+		return
+	}
+
+	client := &Client{hub: hub, send: make(chan hubMessage, sendBufferSize), subscription: parseSubscription(r.URL.Query()), identity: identityFromRequest(r)}
+
+	if lastEventID := r.Header.Get("Last-Event-ID"); lastEventID != "" {
+		id, err := strconv.ParseUint(lastEventID, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid Last-Event-ID header", http.StatusBadRequest)
+
+			return
+		}
+
+		client.resume = true
+		client.lastEventID = id
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no") // disables the response buffering of nginx
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	if !hub.registerClient(client) {
+		return
+	}
+
+	defer hub.unregisterClient(client)
+
+	ticker := time.NewTicker(sseKeepAlivePeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case msg, ok := <-client.send:
+			if !ok {
+				// The hub closed the channel.
+				return
+			}
+
+			if _, err := fmt.Fprintf(w, "id: %d\ndata: %s\n\n", msg.id, msg.data); err != nil {
+				return
+			}
+
+			flusher.Flush()
+		case <-ticker.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+
+			flusher.Flush()
+		}
+	}
+}
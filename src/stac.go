@@ -0,0 +1,683 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	stacVersion        = "1.0.0"
+	stacCatalogID      = "s3-image-server"
+	stacDefaultLimit   = 10
+	stacMaxLimit       = 1000
+	stacMaxRequestSize = 1 << 20
+)
+
+//nolint:gochecknoglobals
+var stacConformance = []string{
+	"https://api.stacspec.org/v1.0.0/core",
+	"https://api.stacspec.org/v1.0.0/collections",
+	"https://api.stacspec.org/v1.0.0/ogcapi-features",
+	"https://api.stacspec.org/v1.0.0/item-search",
+	"http://www.opengis.net/spec/ogcapi-features-1/1.0/conf/core",
+	"http://www.opengis.net/spec/ogcapi-features-1/1.0/conf/geojson",
+}
+
+// STACLink is a link of a STAC object. Method and Body are only set on the links to the next page of a POST search.
+type STACLink struct {
+	Rel    string `json:"rel"`
+	Href   string `json:"href"`
+	Type   string `json:"type,omitempty"`
+	Title  string `json:"title,omitempty"`
+	Method string `json:"method,omitempty"`
+	Body   any    `json:"body,omitempty"`
+}
+
+// STACCatalog is the landing page of the STAC API.
+type STACCatalog struct {
+	Type        string     `json:"type"`
+	STACVersion string     `json:"stac_version"`
+	ID          string     `json:"id"`
+	Title       string     `json:"title"`
+	Description string     `json:"description"`
+	ConformsTo  []string   `json:"conformsTo"`
+	Links       []STACLink `json:"links"`
+}
+
+// STACExtent is the spatial and temporal extent of a collection. The open ends of the intervals are null.
+type STACExtent struct {
+	Spatial struct {
+		BBox [][]float64 `json:"bbox"`
+	} `json:"spatial"`
+	Temporal struct {
+		Interval [][]*time.Time `json:"interval"`
+	} `json:"temporal"`
+}
+
+// STACCollection describes the products of an image type.
+type STACCollection struct {
+	Type        string     `json:"type"`
+	STACVersion string     `json:"stac_version"`
+	ID          string     `json:"id"`
+	Title       string     `json:"title"`
+	Description string     `json:"description"`
+	Keywords    []string   `json:"keywords"`
+	License     string     `json:"license"`
+	Extent      STACExtent `json:"extent"`
+	Links       []STACLink `json:"links"`
+}
+
+// STACAsset is a file of a product.
+type STACAsset struct {
+	Href  string   `json:"href"`
+	Type  string   `json:"type,omitempty"`
+	Title string   `json:"title,omitempty"`
+	Roles []string `json:"roles"`
+}
+
+// STACItem is a product, described by its image.
+type STACItem struct {
+	Type        string               `json:"type"`
+	STACVersion string               `json:"stac_version"`
+	ID          string               `json:"id"`
+	Collection  string               `json:"collection,omitempty"`
+	Geometry    *GeoJSONGeometry     `json:"geometry"`
+	BBox        []float64            `json:"bbox,omitempty"`
+	Properties  map[string]any       `json:"properties"`
+	Links       []STACLink           `json:"links"`
+	Assets      map[string]STACAsset `json:"assets"`
+}
+
+// STACItemCollection is a page of items.
+type STACItemCollection struct {
+	Type           string     `json:"type"`
+	Features       []STACItem `json:"features"`
+	Links          []STACLink `json:"links"`
+	NumberMatched  int        `json:"numberMatched"`
+	NumberReturned int        `json:"numberReturned"`
+}
+
+// stacSearch holds the filters of an items search, as given to /stac/search or to the items of a collection.
+type stacSearch struct {
+	BBox        []float64 `json:"bbox,omitempty"`
+	Datetime    string    `json:"datetime,omitempty"`
+	Collections []string  `json:"collections,omitempty"`
+	IDs         []string  `json:"ids,omitempty"`
+	Limit       int       `json:"limit,omitempty"`
+	Token       string    `json:"token,omitempty"`
+	// Intersects is only decoded to reject it, as only the bounding boxes are supported
+	Intersects json.RawMessage `json:"intersects,omitempty"`
+
+	bbox     *BBox
+	from, to time.Time
+	cursor   *imagesCursor
+}
+
+// stacOrder sorts the items from the most recent, as the images list.
+//
+//nolint:gochecknoglobals
+var stacOrder = imagesQuery{sort: apiSortDate, order: apiOrderDesc}
+
+func stacCursorOf(img S3Image) imagesCursor {
+	return imagesCursor{Sort: stacOrder.sort, Order: stacOrder.order, Date: img.LastModified.UnixNano(), Key: img.FormattedKey}
+}
+
+// parseSTACDatetime parses a date or an interval of dates, whose open ends are empty or "..".
+func parseSTACDatetime(raw string) (from, to time.Time, err error) {
+	parseEnd := func(value string) (time.Time, error) {
+		if value == "" || value == ".." {
+			return time.Time{}, nil
+		}
+
+		date, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid datetime %q, expected RFC 3339", value)
+		}
+
+		return date, nil
+	}
+
+	start, end, interval := strings.Cut(raw, "/")
+	if !interval {
+		if raw == ".." {
+			return time.Time{}, time.Time{}, errors.New("invalid datetime, an open end is only valid in an interval")
+		}
+
+		from, err = parseEnd(raw)
+
+		return from, from, err
+	}
+
+	if from, err = parseEnd(start); err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+
+	if to, err = parseEnd(end); err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+
+	if from.IsZero() && to.IsZero() {
+		return time.Time{}, time.Time{}, errors.New("invalid datetime, both ends of the interval are open")
+	}
+
+	if !from.IsZero() && !to.IsZero() && from.After(to) {
+		return time.Time{}, time.Time{}, errors.New("invalid datetime, the interval ends before it starts")
+	}
+
+	return from, to, nil
+}
+
+// validate checks the search and parses its filters.
+func (search *stacSearch) validate() error {
+	if len(search.Intersects) > 0 {
+		return errors.New("intersects is not supported, use bbox")
+	}
+
+	if search.BBox != nil {
+		box, err := newBBox(search.BBox)
+		if err != nil {
+			return err
+		}
+
+		search.bbox = &box
+	}
+
+	if search.Datetime != "" {
+		var err error
+		if search.from, search.to, err = parseSTACDatetime(search.Datetime); err != nil {
+			return err
+		}
+	}
+
+	// a limit above the maximum is lowered to it, as required by OGC API - Features
+	switch {
+	case search.Limit == 0:
+		search.Limit = stacDefaultLimit
+	case search.Limit < 0:
+		return errors.New("invalid limit, expected a positive number")
+	case search.Limit > stacMaxLimit:
+		search.Limit = stacMaxLimit
+	}
+
+	if search.Token != "" {
+		cursor, err := decodeImagesCursor(search.Token)
+		if err != nil || cursor.Sort != stacOrder.sort || cursor.Order != stacOrder.order {
+			return errors.New("invalid token")
+		}
+
+		search.cursor = cursor
+	}
+
+	return nil
+}
+
+func parseSTACSearchValues(values url.Values) (stacSearch, error) {
+	search := stacSearch{
+		Datetime:    values.Get("datetime"),
+		Collections: splitQueryValues(values, "collections"),
+		IDs:         splitQueryValues(values, "ids"),
+		Token:       values.Get("token"),
+	}
+
+	if values.Get("intersects") != "" {
+		search.Intersects = json.RawMessage(values.Get("intersects"))
+	}
+
+	if raw := values.Get("bbox"); raw != "" {
+		for _, part := range strings.Split(raw, ",") {
+			value, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+			if err != nil {
+				return stacSearch{}, fmt.Errorf("invalid bbox value %q", part)
+			}
+
+			search.BBox = append(search.BBox, value)
+		}
+	}
+
+	if raw := values.Get("limit"); raw != "" {
+		limit, err := strconv.Atoi(raw)
+		if err != nil || limit < 1 {
+			return stacSearch{}, errors.New("invalid limit, expected a positive number")
+		}
+
+		search.Limit = limit
+	}
+
+	return search, search.validate()
+}
+
+func (search stacSearch) matches(img S3Image) bool {
+	if img.Type == nil {
+		return false
+	}
+
+	if len(search.Collections) > 0 && !slices.Contains(search.Collections, img.Type.Name) {
+		return false
+	}
+
+	if len(search.IDs) > 0 && !slices.Contains(search.IDs, img.FormattedKey) {
+		return false
+	}
+
+	if !search.from.IsZero() && img.LastModified.Before(search.from) {
+		return false
+	}
+
+	return search.to.IsZero() || !img.LastModified.After(search.to)
+}
+
+// run returns the page of the images visible to the identity and matching the search,
+// the number of matching images and the cursor of the next page, nil on the last page.
+func (search stacSearch) run(identity *Identity) (page []S3Image, matched int, next *imagesCursor) {
+	var candidates []S3Image
+
+	if search.bbox != nil {
+		for _, key := range spatialIndex.intersecting(*search.bbox) {
+			if img, found := mainCache.findImageByKey(key); found {
+				candidates = append(candidates, img)
+			}
+		}
+	} else {
+		candidates = mainCache.snapshot()
+	}
+
+	images := make([]S3Image, 0)
+
+	for _, img := range identity.visibleImages(candidates) {
+		if search.matches(img) {
+			images = append(images, img)
+		}
+	}
+
+	slices.SortFunc(images, func(a, b S3Image) int {
+		return stacOrder.compare(stacCursorOf(a), stacCursorOf(b))
+	})
+
+	matched = len(images)
+
+	if search.cursor != nil {
+		start, _ := slices.BinarySearchFunc(images, *search.cursor, func(img S3Image, cursor imagesCursor) int {
+			return stacOrder.compare(stacCursorOf(img), cursor)
+		})
+		// the image the cursor points to was on the previous page
+		if start < len(images) && images[start].FormattedKey == search.cursor.Key {
+			start++
+		}
+
+		images = images[start:]
+	}
+
+	if len(images) > search.Limit {
+		images = images[:search.Limit]
+		cursor := stacCursorOf(images[len(images)-1])
+		next = &cursor
+	}
+
+	return images, matched, next
+}
+
+// stacAPI builds the STAC objects, with absolute links to the server the request was sent to.
+type stacAPI struct {
+	// root is the URL of the STAC API, /stac under the base path of the server
+	root   string
+	origin string
+}
+
+func newSTACAPI(r *http.Request) stacAPI {
+	origin := requestOrigin(r)
+
+	return stacAPI{root: origin + config.BasePath + "/stac", origin: origin}
+}
+
+// absolute returns the absolute URL of a link of the server. The other links are returned as they are.
+func (api stacAPI) absolute(link string) string {
+	if strings.HasPrefix(link, "/") {
+		return api.origin + link
+	}
+
+	return link
+}
+
+func (api stacAPI) rootLinks() []STACLink {
+	return []STACLink{{Rel: "root", Href: api.root, Type: "application/json", Title: config.WindowTitle}}
+}
+
+func (api stacAPI) landingPage(identity *Identity) STACCatalog {
+	links := append(api.rootLinks(),
+		STACLink{Rel: "self", Href: api.root, Type: "application/json"},
+		STACLink{Rel: "conformance", Href: api.root + "/conformance", Type: "application/json"},
+		STACLink{Rel: "data", Href: api.root + "/collections", Type: "application/json"},
+		STACLink{Rel: "search", Href: api.root + "/search", Type: geoJSONContentType, Method: http.MethodGet},
+		STACLink{Rel: "search", Href: api.root + "/search", Type: geoJSONContentType, Method: http.MethodPost},
+	)
+
+	for _, imgType := range identity.visibleTypes(config.imageTypes) {
+		links = append(links, STACLink{Rel: "child", Href: api.collectionURL(imgType.Name), Type: "application/json", Title: imgType.DisplayName})
+	}
+
+	return STACCatalog{
+		Type:        "Catalog",
+		STACVersion: stacVersion,
+		ID:          stacCatalogID,
+		Title:       config.WindowTitle,
+		Description: "Products of the images cached by the server",
+		ConformsTo:  stacConformance,
+		Links:       links,
+	}
+}
+
+func (api stacAPI) collectionURL(name string) string {
+	return api.root + "/collections/" + url.PathEscape(name)
+}
+
+// itemURL returns the URL of the item of the image, in the collection of its type. The type must be known.
+func (api stacAPI) itemURL(img S3Image) string {
+	return api.collectionURL(img.Type.Name) + "/items/" + url.PathEscape(img.FormattedKey)
+}
+
+func (api stacAPI) collection(imgType ImageType, images []S3Image) STACCollection {
+	collection := STACCollection{
+		Type:        "Collection",
+		STACVersion: stacVersion,
+		ID:          imgType.Name,
+		Title:       imgType.DisplayName,
+		Description: fmt.Sprintf("Products of type %s of the group %s", cmp.Or(imgType.DisplayName, imgType.Name), imgType.group),
+		Keywords:    []string{imgType.group},
+		License:     "proprietary",
+		Links: append(api.rootLinks(),
+			STACLink{Rel: "self", Href: api.collectionURL(imgType.Name), Type: "application/json"},
+			STACLink{Rel: "parent", Href: api.root, Type: "application/json"},
+			STACLink{Rel: "items", Href: api.collectionURL(imgType.Name) + "/items", Type: geoJSONContentType},
+		),
+	}
+
+	// the extent covers the cached products of the type, the whole world and all times when there are none
+	var box *BBox
+
+	var oldest, newest *time.Time
+
+	for _, img := range images {
+		if img.Type == nil || img.Type.Name != imgType.Name {
+			continue
+		}
+
+		if oldest == nil || img.LastModified.Before(*oldest) {
+			oldest = &img.LastModified
+		}
+
+		if newest == nil || img.LastModified.After(*newest) {
+			newest = &img.LastModified
+		}
+
+		if footprint, found := footprintOf(img); found {
+			for _, part := range footprint.BBox.split() {
+				if box == nil {
+					box = &part
+				} else {
+					union := box.union(part)
+					box = &union
+				}
+			}
+		}
+	}
+
+	collection.Extent.Spatial.BBox = [][]float64{{-180, -90, 180, 90}}
+	if box != nil {
+		collection.Extent.Spatial.BBox = [][]float64{box.array()}
+	}
+
+	collection.Extent.Temporal.Interval = [][]*time.Time{{oldest, newest}}
+
+	return collection
+}
+
+func mediaTypeOf(filename string) string {
+	return mime.TypeByExtension(path.Ext(filename))
+}
+
+// item describes the product of the image, with its preview and the files of its product as assets.
+func (api stacAPI) item(img S3Image) STACItem {
+	item := STACItem{
+		Type:        "Feature",
+		STACVersion: stacVersion,
+		ID:          img.FormattedKey,
+		Properties: map[string]any{
+			"datetime": img.LastModified.UTC().Format(time.RFC3339Nano),
+			"title":    getGeoname(img.FormattedKey),
+			"s3_key":   img.S3Key,
+		},
+		Links: api.rootLinks(),
+		Assets: map[string]STACAsset{
+			"preview": {
+				Href:  api.absolute(config.BasePath + "/image/" + img.FormattedKey),
+				Type:  mediaTypeOf(img.S3Key),
+				Title: "Preview",
+				Roles: []string{"overview", "visual"},
+			},
+			"thumbnail": {
+				Href:  api.absolute(fmt.Sprintf("%s/image/%s?w=%d", config.BasePath, img.FormattedKey, galleryThumbnailWidth)),
+				Type:  mediaTypeOf(img.S3Key),
+				Title: "Thumbnail",
+				Roles: []string{"thumbnail"},
+			},
+		},
+	}
+
+	// the items are listed by collection, an image of an unknown type has none
+	if img.Type != nil {
+		item.Collection = img.Type.Name
+		item.Links = append(item.Links,
+			STACLink{Rel: "self", Href: api.itemURL(img), Type: geoJSONContentType},
+			STACLink{Rel: "parent", Href: api.collectionURL(img.Type.Name), Type: "application/json"},
+			STACLink{Rel: "collection", Href: api.collectionURL(img.Type.Name), Type: "application/json"},
+		)
+	}
+
+	if img.AssociatedFeatures != nil {
+		item.Properties["features_class"] = img.AssociatedFeatures.Class
+		item.Properties["features_count"] = img.AssociatedFeatures.Count
+	}
+
+	if footprint, found := footprintOf(img); found {
+		geometry := newFootprintGeometry(footprint)
+		item.Geometry = &geometry
+		item.BBox = footprint.BBox.array()
+	}
+
+	fullProductLinksCacheMutex.Lock()
+	links := slices.Clone(fullProductLinksCache[productDirOf(img.S3Key)])
+	fullProductLinksCacheMutex.Unlock()
+
+	cacheLinksPrefix := config.BasePath + "/cache/"
+	fullProducts := 0
+
+	for _, link := range links {
+		if strings.HasPrefix(link, cacheLinksPrefix) {
+			// the metadata and additional files of the product, served from the main cache
+			filename := path.Base(link)
+			item.Assets[filename] = STACAsset{Href: api.absolute(link), Type: mediaTypeOf(filename), Title: filename, Roles: []string{"metadata"}}
+
+			continue
+		}
+
+		fullProducts++
+
+		key := "full_product"
+		if fullProducts > 1 {
+			key += "_" + strconv.Itoa(fullProducts)
+		}
+
+		item.Assets[key] = STACAsset{Href: link, Type: mediaTypeOf(strings.SplitN(link, "?", 2)[0]), Title: "Full product", Roles: []string{"data"}}
+	}
+
+	return item
+}
+
+// itemCollection returns the page of items found by the search. self is the URL of the page, without its filters.
+func (api stacAPI) itemCollection(identity *Identity, search stacSearch, self string, method string) STACItemCollection {
+	images, matched, next := search.run(identity)
+
+	page := STACItemCollection{
+		Type:           "FeatureCollection",
+		Features:       make([]STACItem, 0, len(images)),
+		Links:          api.rootLinks(),
+		NumberMatched:  matched,
+		NumberReturned: len(images),
+	}
+
+	for _, img := range images {
+		page.Features = append(page.Features, api.item(img))
+	}
+
+	if next == nil {
+		return page
+	}
+
+	search.Token = next.encode()
+
+	if method == http.MethodPost {
+		page.Links = append(page.Links, STACLink{Rel: "next", Href: self, Type: geoJSONContentType, Method: http.MethodPost, Body: search})
+
+		return page
+	}
+
+	values := url.Values{"token": {search.Token}, "limit": {strconv.Itoa(search.Limit)}}
+	if search.Datetime != "" {
+		values.Set("datetime", search.Datetime)
+	}
+
+	if search.bbox != nil {
+		values.Set("bbox", search.bbox.String())
+	}
+
+	if len(search.Collections) > 0 && !strings.Contains(self, "/collections/") {
+		values.Set("collections", strings.Join(search.Collections, ","))
+	}
+
+	if len(search.IDs) > 0 {
+		values.Set("ids", strings.Join(search.IDs, ","))
+	}
+
+	page.Links = append(page.Links, STACLink{Rel: "next", Href: self + "?" + values.Encode(), Type: geoJSONContentType, Method: http.MethodGet})
+
+	return page
+}
+
+// visibleType returns the image type having the given name, if the identity can view it.
+func visibleType(identity *Identity, name string) (ImageType, bool) {
+	for _, imgType := range identity.visibleTypes(config.imageTypes) {
+		if imgType.Name == name {
+			return imgType, true
+		}
+	}
+
+	return ImageType{}, false
+}
+
+// stacHandler serves the STAC API: the landing page, the conformance classes, a collection per image type,
+// their items (one per product) and the item search, with the bbox, datetime, collections, ids and limit parameters.
+func stacHandler(w http.ResponseWriter, r *http.Request) {
+	api := newSTACAPI(r)
+	identity := identityFromRequest(r)
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/stac"), "/"), "/")
+
+	if r.Method != http.MethodGet && !(r.Method == http.MethodPost && len(parts) == 1 && parts[0] == "search") {
+		prettier(w, "Method not allowed", nil, http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && parts[0] == "":
+		writeJSON(w, "application/json", api.landingPage(identity), http.StatusOK)
+	case len(parts) == 1 && parts[0] == "conformance":
+		writeJSON(w, "application/json", map[string][]string{"conformsTo": stacConformance}, http.StatusOK)
+	case len(parts) == 1 && parts[0] == "collections":
+		images := mainCache.snapshot()
+		collections := make([]STACCollection, 0)
+
+		for _, imgType := range identity.visibleTypes(config.imageTypes) {
+			collections = append(collections, api.collection(imgType, images))
+		}
+
+		writeJSON(w, "application/json", map[string]any{
+			"collections": collections,
+			"links": append(api.rootLinks(),
+				STACLink{Rel: "self", Href: api.root + "/collections", Type: "application/json"},
+				STACLink{Rel: "parent", Href: api.root, Type: "application/json"}),
+		}, http.StatusOK)
+	case len(parts) == 1 && parts[0] == "search":
+		stacSearchHandler(w, r, api, identity)
+	case len(parts) >= 2 && len(parts) <= 4 && parts[0] == "collections":
+		imgType, found := visibleType(identity, parts[1])
+		if !found || (len(parts) >= 3 && parts[2] != "items") {
+			prettier(w, "Not found", nil, http.StatusNotFound)
+
+			return
+		}
+
+		switch len(parts) {
+		case 2:
+			writeJSON(w, "application/json", api.collection(imgType, mainCache.snapshot()), http.StatusOK)
+		case 3:
+			search, err := parseSTACSearchValues(r.URL.Query())
+			if err != nil {
+				prettier(w, err.Error(), nil, http.StatusBadRequest)
+
+				return
+			}
+
+			search.Collections = []string{imgType.Name}
+			writeJSON(w, geoJSONContentType, api.itemCollection(identity, search, api.collectionURL(imgType.Name)+"/items", http.MethodGet), http.StatusOK)
+		default:
+			img, found := mainCache.findImageByKey(parts[3])
+			if !found || img.Type == nil || img.Type.Name != imgType.Name {
+				prettier(w, "Item not found", nil, http.StatusNotFound)
+
+				return
+			}
+
+			writeJSON(w, geoJSONContentType, api.item(img), http.StatusOK)
+		}
+	default:
+		prettier(w, "Not found", nil, http.StatusNotFound)
+	}
+}
+
+func stacSearchHandler(w http.ResponseWriter, r *http.Request, api stacAPI, identity *Identity) {
+	var (
+		search stacSearch
+		err    error
+	)
+
+	if r.Method == http.MethodPost {
+		// the fields of the unsupported extensions are ignored
+		if err = json.NewDecoder(http.MaxBytesReader(w, r.Body, stacMaxRequestSize)).Decode(&search); err != nil {
+			prettier(w, "Invalid search: "+err.Error(), nil, http.StatusBadRequest)
+
+			return
+		}
+
+		err = search.validate()
+	} else {
+		search, err = parseSTACSearchValues(r.URL.Query())
+	}
+
+	if err != nil {
+		prettier(w, err.Error(), nil, http.StatusBadRequest)
+
+		return
+	}
+
+	writeJSON(w, geoJSONContentType, api.itemCollection(identity, search, api.root+"/search", r.Method), http.StatusOK)
+}
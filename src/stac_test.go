@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestParseSTACDatetime(t *testing.T) {
+	date1 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	date2 := time.Date(2024, 2, 1, 12, 30, 0, 0, time.FixedZone("", 2*60*60))
+
+	tests := []struct {
+		raw      string
+		from, to time.Time
+		err      bool
+	}{
+		{raw: "2024-01-01T00:00:00Z", from: date1, to: date1},
+		{raw: "2024-01-01T00:00:00Z/2024-02-01T12:30:00+02:00", from: date1, to: date2},
+		{raw: "2024-01-01T00:00:00Z/..", from: date1},
+		{raw: "2024-01-01T00:00:00Z/", from: date1},
+		{raw: "../2024-02-01T12:30:00+02:00", to: date2},
+		{raw: "/2024-02-01T12:30:00+02:00", to: date2},
+		{raw: "2024-01-01T00:00:00Z/2024-01-01T00:00:00Z", from: date1, to: date1},
+		{raw: "..", err: true},
+		{raw: "../..", err: true},
+		{raw: "/", err: true},
+		{raw: "2024-02-01T12:30:00+02:00/2024-01-01T00:00:00Z", err: true},
+		{raw: "2024-01-01", err: true},
+		{raw: "2024-01-01T00:00:00Z/yesterday", err: true},
+		{raw: "2024-01-01T00:00:00Z/2024-02-01T00:00:00Z/2024-03-01T00:00:00Z", err: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.raw, func(t *testing.T) {
+			from, to, err := parseSTACDatetime(test.raw)
+			if (err != nil) != test.err {
+				t.Fatalf("expected error %t, got %v", test.err, err)
+			}
+
+			if !from.Equal(test.from) || !to.Equal(test.to) {
+				t.Errorf("expected %v - %v, got %v - %v", test.from, test.to, from, to)
+			}
+		})
+	}
+}
+
+func TestParseSTACSearchValues(t *testing.T) {
+	tests := []struct {
+		query string
+		limit int
+		err   bool
+	}{
+		{query: "", limit: stacDefaultLimit},
+		{query: "limit=5&bbox=2,48,3,49&datetime=2024-01-01T00:00:00Z/..&collections=TYPE1,TYPE2", limit: 5},
+		{query: "limit=100000", limit: stacMaxLimit},
+		{query: "limit=0", err: true},
+		{query: "limit=abc", err: true},
+		{query: "bbox=2,48,3", err: true},
+		{query: "bbox=2,48,3,north", err: true},
+		{query: "bbox=2,49,3,48", err: true},
+		{query: "datetime=..", err: true},
+		{query: `intersects={"type":"Point","coordinates":[2,48]}`, err: true},
+		{query: "token=invalid", err: true},
+		{query: "token=" + imagesCursor{Sort: apiSortName, Order: apiOrderAsc}.encode(), err: true},
+		{query: "token=" + imagesCursor{Sort: stacOrder.sort, Order: stacOrder.order, Key: "key"}.encode(), limit: stacDefaultLimit},
+	}
+
+	for _, test := range tests {
+		t.Run(test.query, func(t *testing.T) {
+			values, _ := url.ParseQuery(test.query)
+
+			search, err := parseSTACSearchValues(values)
+			if (err != nil) != test.err {
+				t.Fatalf("expected error %t, got %v", test.err, err)
+			}
+
+			if err == nil && search.Limit != test.limit {
+				t.Errorf("expected the limit %d, got %d", test.limit, search.Limit)
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+const clientActionSubscribe = "subscribe"
+
+// subscription restricts the events sent to a client. An empty list matches everything.
+type subscription struct {
+	Groups []string `json:"groups"`
+	Types  []string `json:"types"`
+	Events []string `json:"events"`
+}
+
+// clientMessage is a message sent by a client through its websocket connection.
+type clientMessage struct {
+	Action string `json:"action"`
+	subscription
+}
+
+type subscriptionRequest struct {
+	client       *Client
+	subscription subscription
+}
+
+// parseSubscription reads the subscription from the 'group', 'type' and 'event' query parameters.
+func parseSubscription(values url.Values) subscription {
+	return subscription{
+		Groups: splitQueryValues(values, "group"),
+		Types:  splitQueryValues(values, "type"),
+		Events: splitQueryValues(values, "event"),
+	}.normalized()
+}
+
+func parseClientMessage(data []byte) (subscription, error) {
+	var msg clientMessage
+
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return subscription{}, fmt.Errorf("invalid message: %w", err)
+	}
+
+	if msg.Action != clientActionSubscribe {
+		return subscription{}, fmt.Errorf("unknown action %q", msg.Action)
+	}
+
+	return msg.subscription.normalized(), nil
+}
+
+func (sub subscription) normalized() subscription {
+	for i := range sub.Events {
+		sub.Events[i] = strings.ToUpper(sub.Events[i])
+	}
+
+	return sub
+}
+
+// matches returns whether the message must be sent to the subscriber. The reset events are always sent.
+func (sub subscription) matches(msg hubMessage) bool {
+	if msg.eventType == eventReset {
+		return true
+	}
+
+	if len(sub.Events) > 0 && !slices.Contains(sub.Events, msg.eventType) {
+		return false
+	}
+
+	if len(sub.Types) > 0 && (msg.imgType == nil || !slices.Contains(sub.Types, msg.imgType.Name)) {
+		return false
+	}
+
+	if len(sub.Groups) > 0 && (msg.imgType == nil || !slices.Contains(sub.Groups, msg.imgType.group)) {
+		return false
+	}
+
+	return true
+}
+
+// imageKey returns the key of the image the event is about, if any.
+func (evt event) imageKey() string {
+	switch obj := evt.EventObj.(type) {
+	case EventObject:
+		return obj.ImgKey
+	case EventGeonames:
+		return obj.ImgKey
+	case EventFeatures:
+		return obj.ImgKey
+	default:
+		return ""
+	}
+}
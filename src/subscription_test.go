@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/url"
+	"slices"
+	"testing"
+)
+
+func TestSubscriptionMatches(t *testing.T) {
+	type1 := &ImageType{Name: "TYPE1", group: "Group 1"}
+	type3 := &ImageType{Name: "TYPE3", group: "Group 2"}
+
+	add1 := hubMessage{eventType: eventAdd, imgType: type1}
+	remove3 := hubMessage{eventType: eventRemove, imgType: type3}
+	unknownType := hubMessage{eventType: eventAdd}
+	reset := hubMessage{eventType: eventReset}
+
+	tests := []struct {
+		name         string
+		subscription subscription
+		matched      []hubMessage
+		ignored      []hubMessage
+	}{
+		{
+			name:    "everything",
+			matched: []hubMessage{add1, remove3, unknownType, reset},
+		},
+		{
+			name:         "by event",
+			subscription: subscription{Events: []string{eventAdd}},
+			matched:      []hubMessage{add1, unknownType, reset},
+			ignored:      []hubMessage{remove3},
+		},
+		{
+			name:         "by type",
+			subscription: subscription{Types: []string{"TYPE3"}},
+			matched:      []hubMessage{remove3, reset},
+			ignored:      []hubMessage{add1, unknownType},
+		},
+		{
+			name:         "by group",
+			subscription: subscription{Groups: []string{"Group 1"}},
+			matched:      []hubMessage{add1, reset},
+			ignored:      []hubMessage{remove3, unknownType},
+		},
+		{
+			name:         "all the criteria",
+			subscription: subscription{Groups: []string{"Group 1", "Group 2"}, Types: []string{"TYPE1", "TYPE3"}, Events: []string{eventRemove}},
+			matched:      []hubMessage{remove3, reset},
+			ignored:      []hubMessage{add1, unknownType},
+		},
+		{
+			name:         "no common group and type",
+			subscription: subscription{Groups: []string{"Group 1"}, Types: []string{"TYPE3"}},
+			matched:      []hubMessage{reset},
+			ignored:      []hubMessage{add1, remove3, unknownType},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, msg := range test.matched {
+				if !test.subscription.matches(msg) {
+					t.Errorf("expected %+v to match", msg)
+				}
+			}
+
+			for _, msg := range test.ignored {
+				if test.subscription.matches(msg) {
+					t.Errorf("expected %+v to be ignored", msg)
+				}
+			}
+		})
+	}
+}
+
+func TestParseSubscription(t *testing.T) {
+	values, _ := url.ParseQuery("group=Group+1,Group+2&type=TYPE1&type=TYPE3&event=add,remove")
+	sub := parseSubscription(values)
+
+	if !slices.Equal(sub.Groups, []string{"Group 1", "Group 2"}) || !slices.Equal(sub.Types, []string{"TYPE1", "TYPE3"}) ||
+		!slices.Equal(sub.Events, []string{eventAdd, eventRemove}) {
+		t.Errorf("unexpected subscription %+v", sub)
+	}
+
+	tests := []struct {
+		message string
+		events  []string
+		err     bool
+	}{
+		{message: `{"action": "subscribe", "events": ["update"]}`, events: []string{eventUpdate}},
+		{message: `{"action": "subscribe"}`},
+		{message: `{"action": "unsubscribe"}`, err: true},
+		{message: `not json`, err: true},
+	}
+
+	for _, test := range tests {
+		sub, err := parseClientMessage([]byte(test.message))
+		if (err != nil) != test.err {
+			t.Errorf("%s: expected error %t, got %v", test.message, test.err, err)
+		} else if !slices.Equal(sub.Events, test.events) {
+			t.Errorf("%s: expected the events %v, got %v", test.message, test.events, sub.Events)
+		}
+	}
+}
@@ -1,9 +1,12 @@
 package main
 
 import (
+	"bytes"
 	_ "embed"
+	"encoding/xml"
 	"errors"
 	"html/template"
+	textTemplate "text/template"
 )
 
 //go:embed resources/html_body.tmpl
@@ -12,6 +15,12 @@ var htmlBodyTemplate string
 //go:embed resources/index_ws.tmpl
 var indexWSTemplate string
 
+//go:embed resources/wmts_capabilities.tmpl
+var wmtsCapabilitiesTemplate string
+
+//go:embed resources/kml_export.tmpl
+var kmlExportTemplate string
+
 func getIndexWsTemplate() (*template.Template, error) {
 	tmpl, err := template.New("index").Parse(indexWSTemplate)
 	if err != nil {
@@ -25,3 +34,31 @@ func getIndexWsTemplate() (*template.Template, error) {
 
 	return tmpl, nil
 }
+
+// xmlTemplateFuncs are the functions of the XML templates: xml escapes the texts and the attributes.
+var xmlTemplateFuncs = textTemplate.FuncMap{ //nolint:gochecknoglobals
+	"xml": func(text string) (string, error) {
+		var escaped bytes.Buffer
+		err := xml.EscapeText(&escaped, []byte(text))
+
+		return escaped.String(), err
+	},
+}
+
+func getWMTSCapabilitiesTemplate() (*textTemplate.Template, error) {
+	tmpl, err := textTemplate.New("wmts").Funcs(xmlTemplateFuncs).Parse(wmtsCapabilitiesTemplate)
+	if err != nil {
+		return nil, errors.New("Failed to parse WMTS capabilities template: " + err.Error())
+	}
+
+	return tmpl, nil
+}
+
+func getKMLExportTemplate() (*textTemplate.Template, error) {
+	tmpl, err := textTemplate.New("kml").Funcs(xmlTemplateFuncs).Parse(kmlExportTemplate)
+	if err != nil {
+		return nil, errors.New("Failed to parse KML export template: " + err.Error())
+	}
+
+	return tmpl, nil
+}
@@ -0,0 +1,679 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"image"
+	"image/png"
+	"math"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	tileSize    = 256
+	maxTileZoom = 22
+
+	// mosaicLayer is the layer of the tiles drawn from all the images
+	mosaicLayer = "mosaic"
+	// maxMosaicTileImages bounds the number of images drawn on a tile of the mosaic, the most recent ones being kept
+	maxMosaicTileImages = 32
+
+	wmtsCapabilitiesPath = "WMTSCapabilities.xml"
+
+	// maxTileSourceDimension bounds the size of the previews kept decoded to draw the tiles of an image,
+	// and mosaicTileSourceDimension the one of the previews drawn on the mosaic, which are many on a tile
+	maxTileSourceDimension    = 2048
+	mosaicTileSourceDimension = 512
+	// tileSourcesCapacity bounds the pixels of the decoded previews, that is 8 previews of an image layer,
+	// or a lot more previews of the mosaic than the ones drawn on a tile
+	tileSourcesCapacity = 8 * maxTileSourceDimension * maxTileSourceDimension
+
+	// webMercatorScaleDenominator is the scale denominator of the zoom level 0 of the GoogleMapsCompatible tile matrix set
+	webMercatorScaleDenominator = 559082264.0287178
+)
+
+var errInvalidTile = errors.New("invalid tile")
+
+//nolint:gochecknoglobals
+var (
+	tileSources = &tileSourceCache{}
+	// emptyTile is the transparent tile served where there is no image
+	emptyTile = sync.OnceValues(func() ([]byte, error) {
+		return encodeTile(image.NewRGBA(image.Rect(0, 0, tileSize, tileSize)))
+	})
+)
+
+// tileCoordinates are the zoom level, column and row of a tile of the web mercator grid, the row 0 being at the north.
+type tileCoordinates struct {
+	z, x, y int
+}
+
+// parseTilePath parses a path like {layer}/{z}/{x}/{y}.png.
+func parseTilePath(path string) (layer string, tile tileCoordinates, err error) {
+	parts := strings.Split(path, "/")
+	if len(parts) != 4 || parts[0] == "" || !strings.HasSuffix(parts[3], ".png") {
+		return "", tileCoordinates{}, fmt.Errorf("%w, expected {layer}/{z}/{x}/{y}.png", errInvalidTile)
+	}
+
+	values := make([]int, 3)
+
+	for i, part := range []string{parts[1], parts[2], strings.TrimSuffix(parts[3], ".png")} {
+		if values[i], err = strconv.Atoi(part); err != nil || values[i] < 0 {
+			return "", tileCoordinates{}, fmt.Errorf("%w, expected {layer}/{z}/{x}/{y}.png", errInvalidTile)
+		}
+	}
+
+	tile = tileCoordinates{z: values[0], x: values[1], y: values[2]}
+
+	if tile.z > maxTileZoom {
+		return "", tileCoordinates{}, fmt.Errorf("%w, the zoom level must be between 0 and %d", errInvalidTile, maxTileZoom)
+	}
+
+	if tile.x >= 1<<tile.z || tile.y >= 1<<tile.z {
+		return "", tileCoordinates{}, fmt.Errorf("%w, the column and the row must be lower than %d at zoom level %d",
+			errInvalidTile, 1<<tile.z, tile.z)
+	}
+
+	return parts[0], tile, nil
+}
+
+// lon returns the longitude of a position of the grid, given in tiles from the west.
+func (tile tileCoordinates) lon(x float64) float64 {
+	return x/math.Exp2(float64(tile.z))*360 - 180
+}
+
+// lat returns the latitude of a position of the grid, given in tiles from the north.
+func (tile tileCoordinates) lat(y float64) float64 {
+	return math.Atan(math.Sinh(math.Pi*(1-2*y/math.Exp2(float64(tile.z))))) * 180 / math.Pi
+}
+
+func (tile tileCoordinates) bbox() BBox {
+	return BBox{
+		MinLon: tile.lon(float64(tile.x)),
+		MinLat: tile.lat(float64(tile.y + 1)),
+		MaxLon: tile.lon(float64(tile.x + 1)),
+		MaxLat: tile.lat(float64(tile.y)),
+	}
+}
+
+// pixelPositions returns the longitudes of the columns and the latitudes of the rows of the pixels of the tile, at their center.
+func (tile tileCoordinates) pixelPositions() (lons, lats [tileSize]float64) {
+	for i := range tileSize {
+		offset := (float64(i) + 0.5) / tileSize
+		lons[i] = tile.lon(float64(tile.x) + offset)
+		lats[i] = tile.lat(float64(tile.y) + offset)
+	}
+
+	return lons, lats
+}
+
+// tileWarp maps the positions of the tiles to the pixels of a preview, whose corners are the ones of its localization file.
+// The positions between the corners are interpolated bilinearly.
+type tileWarp struct {
+	pixels *image.RGBA
+	// origin is the upper left corner, across and down the upper and left edges,
+	// and skew the difference between the quadrilateral and a parallelogram
+	origin, across, down, skew [2]float64
+	// crossing is set when the preview crosses the antimeridian, its western longitudes being moved beyond 180
+	crossing bool
+	// box bounds the corners, with the longitudes moved beyond 180 when crossing
+	box BBox
+}
+
+// newTileWarp returns the warp of the preview from the corners of its localization file, which must be valid (see footprintOf).
+func newTileWarp(img S3Image, pixels *image.RGBA) tileWarp {
+	corner := img.AssociatedLocalization.Corner
+	corners := [4][2]float64{}
+
+	for i, point := range []Point{corner.UpperLeft, corner.UpperRight, corner.LowerRight, corner.LowerLeft} {
+		corners[i] = [2]float64{point.Coordinates.Lon, point.Coordinates.Lat}
+	}
+
+	lons := []float64{corners[0][0], corners[1][0], corners[2][0], corners[3][0]}
+	warp := tileWarp{pixels: pixels, crossing: slices.Max(lons)-slices.Min(lons) > 180}
+
+	if warp.crossing {
+		for i := range corners {
+			if corners[i][0] < 0 {
+				corners[i][0] += 360
+			}
+		}
+	}
+
+	upperLeft, upperRight, lowerRight, lowerLeft := corners[0], corners[1], corners[2], corners[3]
+	warp.origin = upperLeft
+	warp.box = BBox{MinLon: upperLeft[0], MinLat: upperLeft[1], MaxLon: upperLeft[0], MaxLat: upperLeft[1]}
+
+	for c := range 2 {
+		warp.across[c] = upperRight[c] - upperLeft[c]
+		warp.down[c] = lowerLeft[c] - upperLeft[c]
+		warp.skew[c] = upperLeft[c] - upperRight[c] + lowerRight[c] - lowerLeft[c]
+	}
+
+	for _, position := range corners[1:] {
+		warp.box.MinLon, warp.box.MaxLon = min(warp.box.MinLon, position[0]), max(warp.box.MaxLon, position[0])
+		warp.box.MinLat, warp.box.MaxLat = min(warp.box.MinLat, position[1]), max(warp.box.MaxLat, position[1])
+	}
+
+	return warp
+}
+
+func cross(a, b [2]float64) float64 {
+	return a[0]*b[1] - a[1]*b[0]
+}
+
+// position returns the relative position of the point in the preview, s from its left edge and t from its upper edge,
+// by inverting the bilinear interpolation of the corners (the point is origin + s*across + t*down + s*t*skew).
+func (warp tileWarp) position(lon, lat float64) (s, t float64, inside bool) {
+	const epsilon = 1e-9
+
+	offset := [2]float64{lon - warp.origin[0], lat - warp.origin[1]}
+
+	// t is a root of k2*t² + k1*t + k0
+	k2 := cross(warp.skew, warp.down)
+	k1 := cross(warp.across, warp.down) + cross(offset, warp.skew)
+	k0 := cross(offset, warp.across)
+
+	var roots []float64
+
+	switch {
+	case k2 == 0 && k1 == 0:
+		return 0, 0, false
+	case k2 == 0:
+		roots = []float64{-k0 / k1}
+	default:
+		discriminant := k1*k1 - 4*k0*k2
+		if discriminant < 0 {
+			return 0, 0, false
+		}
+
+		// the roots are computed without cancellation, the quadrilaterals being close to parallelograms (k2 close to 0)
+		q := -(k1 + math.Copysign(math.Sqrt(discriminant), k1)) / 2
+		roots = []float64{q / k2}
+
+		if q != 0 {
+			roots = append(roots, k0/q)
+		}
+	}
+
+	for _, t := range roots {
+		if t < -epsilon || t > 1+epsilon {
+			continue
+		}
+
+		// s is computed along the axis where the edge at t is the longest, to avoid dividing by 0
+		denominatorLon, denominatorLat := warp.across[0]+warp.skew[0]*t, warp.across[1]+warp.skew[1]*t
+		if math.Abs(denominatorLon) >= math.Abs(denominatorLat) {
+			s = (offset[0] - warp.down[0]*t) / denominatorLon
+		} else {
+			s = (offset[1] - warp.down[1]*t) / denominatorLat
+		}
+
+		if s >= -epsilon && s <= 1+epsilon {
+			return s, t, true
+		}
+	}
+
+	return 0, 0, false
+}
+
+// sample returns the color of the preview at the relative position, interpolated bilinearly between its pixels.
+func (warp tileWarp) sample(s, t float64) [4]float64 {
+	bounds := warp.pixels.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	x := max(0, min(float64(width-1), s*float64(width)-0.5))
+	y := max(0, min(float64(height-1), t*float64(height)-0.5))
+	x0, y0 := int(x), int(y)
+	x1, y1 := min(x0+1, width-1), min(y0+1, height-1)
+	fx, fy := x-float64(x0), y-float64(y0)
+
+	var color [4]float64
+
+	for _, corner := range []struct {
+		x, y   int
+		weight float64
+	}{
+		{x0, y0, (1 - fx) * (1 - fy)}, {x1, y0, fx * (1 - fy)},
+		{x0, y1, (1 - fx) * fy}, {x1, y1, fx * fy},
+	} {
+		offset := corner.y*warp.pixels.Stride + corner.x*4
+
+		for c := range color {
+			color[c] += float64(warp.pixels.Pix[offset+c]) * corner.weight
+		}
+	}
+
+	return color
+}
+
+// draw draws the part of the preview covering the tile over its pixels.
+func (warp tileWarp) draw(dst *image.RGBA, lons, lats *[tileSize]float64) {
+	for py, lat := range lats {
+		if lat < warp.box.MinLat || lat > warp.box.MaxLat {
+			continue
+		}
+
+		row := dst.Pix[py*dst.Stride:]
+
+		for px, lon := range lons {
+			if warp.crossing && lon < 0 {
+				lon += 360
+			}
+
+			if lon < warp.box.MinLon || lon > warp.box.MaxLon {
+				continue
+			}
+
+			s, t, inside := warp.position(lon, lat)
+			if !inside {
+				continue
+			}
+
+			// the colors are alpha-premultiplied, the preview is drawn over the pixel
+			color := warp.sample(s, t)
+			transparency := 1 - color[3]/255
+
+			for c, value := range color {
+				row[px*4+c] = uint8(min(255, math.Round(value+float64(row[px*4+c])*transparency)))
+			}
+		}
+	}
+}
+
+// tileSource is a decoded preview, which stays valid as long as the image isn't modified.
+type tileSource struct {
+	key          string
+	dimension    int
+	etag         string
+	lastModified time.Time
+	pixels       *image.RGBA
+}
+
+// tileSourceCache keeps the last previews used to draw the tiles decoded,
+// a map view requesting the tiles of the same images at once.
+type tileSourceCache struct {
+	mutex sync.Mutex
+	// sources are ordered from the least recently used
+	sources []tileSource
+	// size is the number of pixels of the sources
+	size int
+}
+
+// get returns the decoded preview of the image, downscaled to the given dimension.
+func (cache *tileSourceCache) get(img S3Image, dimension int) (*image.RGBA, error) {
+	cache.mutex.Lock()
+
+	for i, source := range cache.sources {
+		if source.key == img.FormattedKey && source.dimension == dimension &&
+			source.etag == img.ETag && source.lastModified.Equal(img.LastModified) {
+			cache.sources = append(slices.Delete(cache.sources, i, i+1), source)
+			cache.mutex.Unlock()
+
+			return source.pixels, nil
+		}
+	}
+
+	cache.mutex.Unlock()
+
+	pixels, err := decodeTileSource(img, dimension)
+	if err != nil {
+		return nil, err
+	}
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	// the previous version of the preview, or the one decoded by a concurrent request, is replaced
+	cache.sources = slices.DeleteFunc(cache.sources, func(source tileSource) bool {
+		if source.key == img.FormattedKey && source.dimension == dimension {
+			cache.size -= sourceSize(source.pixels)
+
+			return true
+		}
+
+		return false
+	})
+
+	for len(cache.sources) > 0 && cache.size+sourceSize(pixels) > tileSourcesCapacity {
+		cache.size -= sourceSize(cache.sources[0].pixels)
+		cache.sources = slices.Delete(cache.sources, 0, 1)
+	}
+
+	cache.sources = append(cache.sources, tileSource{
+		key:          img.FormattedKey,
+		dimension:    dimension,
+		etag:         img.ETag,
+		lastModified: img.LastModified,
+		pixels:       pixels,
+	})
+	cache.size += sourceSize(pixels)
+
+	return pixels, nil
+}
+
+func sourceSize(pixels *image.RGBA) int {
+	return pixels.Bounds().Dx() * pixels.Bounds().Dy()
+}
+
+func decodeTileSource(img S3Image, dimension int) (*image.RGBA, error) {
+	resizeSemaphore <- struct{}{}
+	defer func() { <-resizeSemaphore }()
+
+	decoded, _, err := decodeCachedImage(img)
+	if err != nil {
+		return nil, err
+	}
+
+	bounds := decoded.Bounds()
+	scale := math.Min(1, float64(dimension)/float64(max(bounds.Dx(), bounds.Dy())))
+
+	return resizeImage(decoded, bounds,
+		max(1, int(math.Round(float64(bounds.Dx())*scale))), max(1, int(math.Round(float64(bounds.Dy())*scale)))), nil
+}
+
+func encodeTile(tile *image.RGBA) ([]byte, error) {
+	var buffer bytes.Buffer
+
+	encoder := png.Encoder{CompressionLevel: png.BestSpeed}
+	if err := encoder.Encode(&buffer, tile); err != nil {
+		return nil, fmt.Errorf("failed to encode tile: %w", err)
+	}
+
+	return buffer.Bytes(), nil
+}
+
+// etagMatches returns whether the If-None-Match header of the request matches the ETag.
+func etagMatches(r *http.Request, etag string) bool {
+	for _, candidate := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// serveTile serves the tile drawn by draw, which returns nil for a transparent tile.
+// The tile is only drawn when the client doesn't have it already.
+func serveTile(w http.ResponseWriter, r *http.Request, etag string, modTime time.Time, draw func() (*image.RGBA, error)) {
+	setHeaders := func() {
+		w.Header().Set("Content-Type", "image/png")
+		// the images may be updated in the bucket, so the clients have to revalidate the tiles
+		w.Header().Set("Cache-Control", "no-cache")
+
+		if etag != "" {
+			w.Header().Set("ETag", etag)
+		}
+	}
+
+	if etag != "" {
+		etag = `"` + strings.Trim(etag, `"`) + `"`
+
+		if etagMatches(r, etag) {
+			setHeaders()
+			w.WriteHeader(http.StatusNotModified)
+
+			return
+		}
+	}
+
+	tile, err := draw()
+
+	var encoded []byte
+	if err == nil {
+		if tile == nil {
+			encoded, err = emptyTile()
+		} else {
+			encoded, err = encodeTile(tile)
+		}
+	}
+
+	switch {
+	case errors.Is(err, image.ErrFormat):
+		prettier(w, "Unsupported image format, only JPEG, PNG and GIF images can be warped", nil, http.StatusUnsupportedMediaType)
+	case errors.Is(err, errImageTooLarge):
+		prettier(w, err.Error(), nil, http.StatusUnprocessableEntity)
+	case err != nil:
+		printError(fmt.Errorf("failed to draw tile %q: %w", r.URL.Path, err), false)
+		prettier(w, "Failed to draw tile: "+err.Error(), nil, http.StatusInternalServerError)
+	default:
+		setHeaders()
+		http.ServeContent(w, r, "", modTime, bytes.NewReader(encoded))
+	}
+}
+
+// serveImageTile serves a tile of the preview of an image.
+func serveImageTile(w http.ResponseWriter, r *http.Request, key string, tile tileCoordinates) {
+	img, found := mainCache.findImageByKey(key)
+	if !found || !identityFromRequest(r).canViewKey(key) {
+		prettier(w, "Image not found !", nil, http.StatusNotFound)
+
+		return
+	}
+
+	footprint, located := footprintOf(img)
+	if !located {
+		prettier(w, "Image without localization, it can't be warped", nil, http.StatusNotFound)
+
+		return
+	}
+
+	var etag string
+	if img.ETag != "" {
+		etag = fmt.Sprintf("%s-%d-%d-%d", strings.Trim(img.ETag, `"`), tile.z, tile.x, tile.y)
+	}
+
+	serveTile(w, r, etag, img.LastModified, func() (*image.RGBA, error) {
+		if !footprint.intersects(tile.bbox()) {
+			return nil, nil //nolint:nilnil
+		}
+
+		pixels, err := tileSources.get(img, maxTileSourceDimension)
+		if err != nil {
+			return nil, err
+		}
+
+		dst := image.NewRGBA(image.Rect(0, 0, tileSize, tileSize))
+		lons, lats := tile.pixelPositions()
+		newTileWarp(img, pixels).draw(dst, &lons, &lats)
+
+		return dst, nil
+	})
+}
+
+// serveMosaicTile serves a tile of the mosaic of the images visible to the identity and matching the query,
+// the most recent ones being drawn on top.
+func serveMosaicTile(w http.ResponseWriter, r *http.Request, tile tileCoordinates) {
+	query, err := parseFootprintsQuery(r.URL.Query())
+	if err == nil && (query.bbox != nil || query.point != nil || query.near != nil) {
+		err = errors.New("only the type, group, from and to filters can be applied to the mosaic")
+	}
+
+	if err != nil {
+		prettier(w, err.Error(), nil, http.StatusBadRequest)
+
+		return
+	}
+
+	identity := identityFromRequest(r)
+	images := make([]S3Image, 0)
+
+	for _, key := range spatialIndex.intersecting(tile.bbox()) {
+		if img, found := mainCache.findImageByKey(key); found && identity.canViewType(img.Type) && query.matches(img) {
+			images = append(images, img)
+		}
+	}
+
+	slices.SortFunc(images, func(a, b S3Image) int {
+		return cmp.Or(b.LastModified.Compare(a.LastModified), cmp.Compare(a.FormattedKey, b.FormattedKey))
+	})
+
+	images = images[:min(len(images), maxMosaicTileImages)]
+	slices.Reverse(images)
+
+	// the ETag of the tile changes along with the images drawn on it
+	hash := fnv.New64a()
+
+	var modTime time.Time
+
+	for _, img := range images {
+		fmt.Fprintf(hash, "%s\n%s\n%d\n", img.FormattedKey, img.ETag, img.LastModified.UnixNano())
+
+		if img.LastModified.After(modTime) {
+			modTime = img.LastModified
+		}
+	}
+
+	serveTile(w, r, fmt.Sprintf("mosaic-%x", hash.Sum64()), modTime, func() (*image.RGBA, error) {
+		if len(images) == 0 {
+			return nil, nil //nolint:nilnil
+		}
+
+		dst := image.NewRGBA(image.Rect(0, 0, tileSize, tileSize))
+		lons, lats := tile.pixelPositions()
+
+		for _, img := range images {
+			if _, located := footprintOf(img); !located {
+				continue
+			}
+
+			pixels, err := tileSources.get(img, mosaicTileSourceDimension)
+			if err != nil {
+				printWarn(fmt.Sprintf("Image %q left out of the mosaic: %v", img.FormattedKey, err))
+
+				continue
+			}
+
+			newTileWarp(img, pixels).draw(dst, &lons, &lats)
+		}
+
+		return dst, nil
+	})
+}
+
+// wmtsLayer is a layer of the WMTS capabilities document.
+type wmtsLayer struct {
+	Identifier string
+	Title      string
+	BBox       BBox
+	Template   string
+}
+
+// wmtsTileMatrix is a zoom level of the GoogleMapsCompatible tile matrix set.
+type wmtsTileMatrix struct {
+	Zoom             int
+	ScaleDenominator float64
+	Size             int
+}
+
+// wmtsCapabilitiesHandler returns the WMTS capabilities document, listing the mosaic and the images visible to the identity.
+func wmtsCapabilitiesHandler(w http.ResponseWriter, r *http.Request) {
+	tmpl, err := getWMTSCapabilitiesTemplate()
+	if err != nil {
+		printError(err, false)
+		prettier(w, err.Error(), nil, http.StatusInternalServerError)
+
+		return
+	}
+
+	tilesURL := requestOrigin(r) + config.BasePath + "/tiles/"
+	world := BBox{MinLon: -180, MinLat: -90, MaxLon: 180, MaxLat: 90}
+
+	layers := []wmtsLayer{{
+		Identifier: mosaicLayer,
+		Title:      "Mosaic of the images",
+		BBox:       world,
+		Template:   tilesURL + mosaicLayer + "/{TileMatrix}/{TileCol}/{TileRow}.png",
+	}}
+
+	images := identityFromRequest(r).visibleImages(mainCache.snapshot())
+	slices.SortFunc(images, func(a, b S3Image) int {
+		return cmp.Or(b.LastModified.Compare(a.LastModified), cmp.Compare(a.FormattedKey, b.FormattedKey))
+	})
+
+	for _, img := range images {
+		footprint, located := footprintOf(img)
+		if !located {
+			continue
+		}
+
+		// the bounding boxes of WMTS can't cross the antimeridian
+		box := footprint.BBox
+		if box.MinLon > box.MaxLon {
+			box.MinLon, box.MaxLon = -180, 180
+		}
+
+		layers = append(layers, wmtsLayer{
+			Identifier: img.FormattedKey,
+			Title:      img.FormattedKey,
+			BBox:       box,
+			Template:   tilesURL + url.PathEscape(img.FormattedKey) + "/{TileMatrix}/{TileCol}/{TileRow}.png",
+		})
+	}
+
+	matrices := make([]wmtsTileMatrix, 0, maxTileZoom+1)
+	for zoom := 0; zoom <= maxTileZoom; zoom++ {
+		matrices = append(matrices, wmtsTileMatrix{
+			Zoom:             zoom,
+			ScaleDenominator: webMercatorScaleDenominator / math.Exp2(float64(zoom)),
+			Size:             1 << zoom,
+		})
+	}
+
+	var document bytes.Buffer
+
+	err = tmpl.Execute(&document, map[string]any{
+		"Layers":       layers,
+		"TileMatrices": matrices,
+		"URL":          tilesURL + wmtsCapabilitiesPath,
+	})
+	if err != nil {
+		printError(fmt.Errorf("failed to execute WMTS capabilities template: %w", err), false)
+		prettier(w, "Failed to build the capabilities", nil, http.StatusInternalServerError)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	_, _ = w.Write(document.Bytes())
+}
+
+// tilesHandler serves the previews warped onto the tiles of the web mercator grid, from the corners of their localization file.
+// The tiles follow both the XYZ scheme of the web maps and the GoogleMapsCompatible tile matrix set of WMTS:
+//   - /tiles/{key}/{z}/{x}/{y}.png: the tiles of the preview of an image
+//   - /tiles/mosaic/{z}/{x}/{y}.png: the tiles of all the current images, the most recent ones on top.
+//     The type, group, from and to query parameters filter the images as for the footprints
+//   - /tiles/WMTSCapabilities.xml: the WMTS capabilities document listing these layers
+func tilesHandler(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/tiles/")
+
+	if path == wmtsCapabilitiesPath {
+		wmtsCapabilitiesHandler(w, r)
+
+		return
+	}
+
+	layer, tile, err := parseTilePath(path)
+	if err != nil {
+		prettier(w, err.Error(), nil, http.StatusBadRequest)
+
+		return
+	}
+
+	if layer == mosaicLayer {
+		serveMosaicTile(w, r, tile)
+	} else {
+		serveImageTile(w, r, layer, tile)
+	}
+}
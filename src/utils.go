@@ -12,8 +12,6 @@ import (
 	"reflect"
 	"strings"
 	"time"
-
-	"github.com/minio/minio-go/v7"
 )
 
 // formatFileName replaces all the '/' by a '@'.
@@ -21,8 +19,8 @@ func formatFileName(imgPath string) string {
 	return strings.ReplaceAll(imgPath, "/", "@")
 }
 
-func generateImagesCache(pathOnDisk string) ImageCache {
-	cache := ImageCache{pathOnDisk: pathOnDisk}
+func generateImagesCache(pathOnDisk string) *ImageCache {
+	cache := newImageCache(pathOnDisk)
 	err := filepath.WalkDir(pathOnDisk, func(imagePath string, file fs.DirEntry, err error) error {
 		if err != nil {
 			return err
@@ -32,19 +30,36 @@ func generateImagesCache(pathOnDisk string) ImageCache {
 			return nil
 		}
 
+		// the server stopped while the file was being downloaded
+		if isTempDownload(file.Name()) {
+			printDebug("Removing orphaned temporary file from cache: ", imagePath)
+
+			return os.Remove(imagePath) //nolint:wrapcheck
+		}
+
 		info, err := file.Info()
 		if err != nil {
 			return err //nolint:wrapcheck
 		}
 
-		if info.ModTime().Add(config.RetentionPeriod).Before(time.Now()) {
+		// the expiry of the indexed files is handled when the index is restored
+		if info.ModTime().Add(retentionPeriodOf(file.Name())).Before(time.Now()) && !cacheIndex.contains(cache.name, file.Name()) {
 			printDebug("Removing obsolete file from cache: ", imagePath)
 
 			return os.Remove(imagePath) //nolint:wrapcheck
 		}
 
+		diskQuota.fileAdded(pathOnDisk, file.Name(), info.Size(), info.ModTime())
+
+		if isResizedVariant(file.Name()) {
+			// the variants found at startup are the first ones evicted
+			registerResizedVariant(file.Name(), time.Time{})
+
+			return nil
+		}
+
 		if strings.HasSuffix(imagePath, config.PreviewFilename) {
-			cache.images = append(cache.images, newS3ImageFromCache(strings.TrimPrefix(imagePath, pathOnDisk), info))
+			cache.putImage(newS3ImageFromCache(strings.TrimPrefix(imagePath, pathOnDisk), info))
 		}
 
 		return nil
@@ -65,9 +80,9 @@ func getThumbnailsCacheFileLink(img string) string {
 	return config.BasePath + "/thumbnails/" + img
 }
 
-func getFullProductImageLink(minioClient *minio.Client, objKey string) string {
+func getFullProductImageLink(store ObjectStore, objKey string) string {
 	if config.FullProductSignedURL {
-		signedURL, err := minioClient.PresignedGetObject(context.Background(), config.S3.BucketName, objKey, 7*24*time.Hour, url.Values{})
+		signedURL, err := store.PresignedGetObject(context.Background(), objKey, 7*24*time.Hour)
 		if err != nil {
 			printError(fmt.Errorf("failed to get a presigned object url: %w", err), false)
 
@@ -79,7 +94,7 @@ func getFullProductImageLink(minioClient *minio.Client, objKey string) string {
 		return config.FullProductProtocol + url.QueryEscape(config.FullProductRootURL+newSignedURL)
 	}
 
-	return config.FullProductProtocol + config.S3.BucketName + "/" + objKey
+	return config.FullProductProtocol + store.Name() + "/" + objKey
 }
 
 type ImageInfos struct {
@@ -111,6 +126,31 @@ func prettier(w http.ResponseWriter, message string, data interface{}, status in
 	}
 }
 
+// writeJSON writes the data as it is, without the envelope of prettier, for the formats defined by other specifications.
+func writeJSON(w http.ResponseWriter, contentType string, data any, status int) {
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		printError(fmt.Errorf("failed to marshal http response to json: %w", err), false)
+	}
+}
+
+// requestOrigin returns the scheme and host of the server the request was sent to, as seen by the client.
+func requestOrigin(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+
+	// the scheme seen by the client when the server is behind a reverse proxy
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto == "http" || proto == "https" {
+		scheme = proto
+	}
+
+	return scheme + "://" + r.Host
+}
+
 func joinStructs(structs interface{}, sep string, displayFieldsName bool) (joined string) {
 	vStructs := reflect.ValueOf(structs)
 	if vStructs.Kind() != reflect.Slice {
@@ -193,14 +233,14 @@ func clearDir(dir string) error {
 	return nil
 }
 
-func createCache(cachePath string) ImageCache {
+func createCache(cachePath string) *ImageCache {
 	if _, err := os.Stat(cachePath); os.IsNotExist(err) {
 		err = os.MkdirAll(cachePath, 0750)
 		if err != nil {
 			exitWithError(err)
 		}
 
-		return ImageCache{pathOnDisk: cachePath}
+		return newImageCache(cachePath)
 	}
 
 	return generateImagesCache(cachePath)
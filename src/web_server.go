@@ -1,16 +1,15 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"html/template"
-	"io"
+	"image"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
 	"time"
-
-	"github.com/minio/minio-go/v7"
 )
 
 type templateData struct {
@@ -29,8 +28,10 @@ type templateData struct {
 	ImageGroups            []ImageGroup
 	ImageTypes             []ImageType
 	MaxImagesDisplayCount  int
+	ThumbnailWidth         int
 	RetentionPeriod        float64
 	PollingPeriod          float64
+	LastEventID            uint64
 }
 
 func executeTemplate(w http.ResponseWriter, tmpl *template.Template, data interface{}) {
@@ -45,34 +46,85 @@ func executeTemplate(w http.ResponseWriter, tmpl *template.Template, data interf
 
 func imageHandler(w http.ResponseWriter, r *http.Request) {
 	imgName := strings.TrimPrefix(r.URL.Path, "/image/")
-	serveFile(w, filepath.Join(config.mainCacheDir, imgName))
+	if !identityFromRequest(r).canViewKey(imgName) {
+		prettier(w, "Image not found !", nil, http.StatusNotFound)
+
+		return
+	}
+
+	spec, resize, err := parseResizeSpec(r.URL.Query())
+	if err != nil {
+		prettier(w, err.Error(), nil, http.StatusBadRequest)
+
+		return
+	}
+
+	if resize {
+		img, found := mainCache.findImageByKey(imgName)
+		if !found {
+			prettier(w, "Image not found !", nil, http.StatusNotFound)
+
+			return
+		}
+
+		variant, err := resizedVariant(img, spec)
+
+		switch {
+		case errors.Is(err, image.ErrFormat):
+			prettier(w, "Unsupported image format, only JPEG, PNG and GIF images can be resized", nil, http.StatusUnsupportedMediaType)
+		case errors.Is(err, errImageTooLarge):
+			prettier(w, err.Error(), nil, http.StatusUnprocessableEntity)
+		case err != nil:
+			printError(fmt.Errorf("failed to resize image %q: %w", imgName, err), false)
+			prettier(w, "Failed to resize image: "+err.Error(), nil, http.StatusInternalServerError)
+		default:
+			diskQuota.served(config.mainCacheDir, variant)
+			serveFile(w, r, filepath.Join(config.mainCacheDir, variant), variantETag(img, spec))
+		}
+
+		return
+	}
+
+	var etag string
+	if img, found := mainCache.findImageByKey(imgName); found {
+		etag = img.ETag
+	}
+
+	diskQuota.served(config.mainCacheDir, imgName)
+	serveFile(w, r, filepath.Join(config.mainCacheDir, imgName), etag)
 }
 
-func imagesListHandler(w http.ResponseWriter, _ *http.Request) {
-	prettier(w, "Images list", mainCache.images, http.StatusOK)
+func imagesListHandler(w http.ResponseWriter, r *http.Request) {
+	prettier(w, "Images list", identityFromRequest(r).visibleImages(mainCache.snapshot()), http.StatusOK)
 }
 
-func infosHandler(w http.ResponseWriter, r *http.Request, minioClient *minio.Client) {
+func infosHandler(w http.ResponseWriter, r *http.Request) {
 	imgName := strings.TrimPrefix(r.URL.Path, "/infos/")
 
-	var strDate string
-
 	img, found := mainCache.findImageByKey(strings.ReplaceAll(imgName, "@", "/"))
-	if found {
-		strDate = img.LastModified.In(time.Local).Format("2006-01-02 15:04:05 MST") //nolint:gosmopolitan
-	} else {
-		strDate = "N/A"
+	if !found || img.Type == nil || !identityFromRequest(r).canViewType(img.Type) {
+		prettier(w, "Image not found !", nil, http.StatusNotFound)
+
+		return
 	}
 
+	strDate := img.LastModified.In(time.Local).Format("2006-01-02 15:04:05 MST") //nolint:gosmopolitan
+
 	imgDir := imgName[:strings.LastIndex(imgName, "@")+1]
 	imgFormattedName := strings.ReplaceAll(imgDir, "@", string(os.PathSeparator))
 
+	fullProductLinksCacheMutex.Lock()
 	links, found := fullProductLinksCache[strings.TrimSuffix(imgFormattedName, string(os.PathSeparator))]
+	fullProductLinksCacheMutex.Unlock()
+
 	if !found {
 		links = []string{}
 	}
 
+	geonamesCacheMutex.Lock()
 	geonames, found := geonamesCache[imgDir+config.GeonamesFilename]
+	geonamesCacheMutex.Unlock()
+
 	if !found {
 		geonames = Geonames{}
 	}
@@ -84,7 +136,7 @@ func infosHandler(w http.ResponseWriter, r *http.Request, minioClient *minio.Cli
 		features = &Features{}
 	}
 
-	thumbnails := fetchThumbnailsFrom(imgDir, img.S3Key, minioClient)
+	thumbnails := fetchThumbnailsFrom(imgDir, img.S3Key, img.Type.getBucket().store)
 
 	prettier(w, "Image infos", ImageInfos{
 		Date:         strDate,
@@ -111,14 +163,18 @@ func cacheHandler(w http.ResponseWriter, r *http.Request) {
 	imgNameWithSlashes := strings.ReplaceAll(imgName, "@", "/")
 	filename := parts[1]
 
+	fullProductLinksCacheMutex.Lock()
 	_, found := fullProductLinksCache[imgNameWithSlashes]
-	if !found {
+	fullProductLinksCacheMutex.Unlock()
+
+	if !found || !identityFromRequest(r).canViewKey(imgName) {
 		prettier(w, "Image not found !", nil, http.StatusNotFound)
 
 		return
 	}
 
-	serveFile(w, filepath.Join(config.mainCacheDir, imgName+"@"+filename))
+	diskQuota.served(config.mainCacheDir, imgName+"@"+filename)
+	serveFile(w, r, filepath.Join(config.mainCacheDir, imgName+"@"+filename), cacheIndex.fileETag(imgName+"@"+filename))
 }
 
 func thumbnailsHandler(w http.ResponseWriter, r *http.Request) {
@@ -129,14 +185,15 @@ func thumbnailsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, found := thumbnailsCache.findImageByKey(strings.ReplaceAll(wanted, "@", "/"))
-	if !found {
+	thumbnail, found := thumbnailsCache.findImageByKey(strings.ReplaceAll(wanted, "@", "/"))
+	if !found || !identityFromRequest(r).canViewKey(wanted) {
 		prettier(w, "Thumbnail not found !", nil, http.StatusNotFound)
 
 		return
 	}
 
-	serveFile(w, filepath.Join(config.thumbnailsCacheDir, wanted))
+	diskQuota.served(config.thumbnailsCacheDir, wanted)
+	serveFile(w, r, filepath.Join(config.thumbnailsCacheDir, wanted), thumbnail.ETag)
 }
 
 func vendorHandler(w http.ResponseWriter, r *http.Request) {
@@ -160,7 +217,9 @@ func vendorHandler(w http.ResponseWriter, r *http.Request) {
 	_, _ = w.Write(fileContent)
 }
 
-func serveFile(w http.ResponseWriter, filePath string) {
+// serveFile serves the given cache file, with the ETag of its S3 object if known and its modification date as Last-Modified.
+// The conditional and range requests are answered by http.ServeContent.
+func serveFile(w http.ResponseWriter, r *http.Request, filePath, etag string) {
 	file, err := os.Open(filePath)
 	if err != nil {
 		prettier(w, "Failed to open file: "+err.Error(), nil, http.StatusInternalServerError)
@@ -170,6 +229,13 @@ func serveFile(w http.ResponseWriter, filePath string) {
 
 	defer file.Close()
 
+	info, err := file.Stat()
+	if err != nil {
+		prettier(w, "Failed to stat file: "+err.Error(), nil, http.StatusInternalServerError)
+
+		return
+	}
+
 	contentType, err := getFileContentType(file)
 	if err != nil {
 		prettier(w, "Failed to detect file content-type: "+err.Error(), nil, http.StatusInternalServerError)
@@ -178,12 +244,14 @@ func serveFile(w http.ResponseWriter, filePath string) {
 	}
 
 	w.Header().Set("Content-Type", contentType)
-	w.WriteHeader(http.StatusOK)
+	// the files may be updated in the bucket, so the clients have to revalidate them
+	w.Header().Set("Cache-Control", "no-cache")
 
-	_, err = io.Copy(w, file)
-	if err != nil {
-		prettier(w, "Failed to read file: "+err.Error(), nil, http.StatusInternalServerError)
+	if etag != "" {
+		w.Header().Set("ETag", `"`+strings.Trim(etag, `"`)+`"`)
 	}
+
+	http.ServeContent(w, r, "", info.ModTime(), file)
 }
 
 func deleteCookies(w http.ResponseWriter, r *http.Request) {
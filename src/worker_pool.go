@@ -0,0 +1,54 @@
+package main
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// workerPool runs tasks on a bounded number of goroutines.
+// The tasks submitted with the same key are always run by the same worker,
+// so they are executed sequentially and in their submission order.
+type workerPool struct {
+	queues []chan func()
+	wg     sync.WaitGroup
+}
+
+func newWorkerPool(workers int) *workerPool {
+	if workers < 1 {
+		workers = 1
+	}
+
+	pool := &workerPool{queues: make([]chan func(), workers)}
+
+	for i := range pool.queues {
+		pool.queues[i] = make(chan func(), workers)
+		pool.wg.Add(1)
+
+		go func(queue chan func()) {
+			defer pool.wg.Done()
+
+			for task := range queue {
+				task()
+			}
+		}(pool.queues[i])
+	}
+
+	return pool
+}
+
+func (pool *workerPool) submit(key string, task func()) {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+
+	pool.queues[h.Sum32()%uint32(len(pool.queues))] <- task
+}
+
+// wait blocks until all the submitted tasks are done.
+// The pool can't be used anymore afterward.
+func (pool *workerPool) wait() {
+	for _, queue := range pool.queues {
+		close(queue)
+	}
+
+	pool.wg.Wait()
+}
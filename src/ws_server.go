@@ -1,13 +1,16 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
-	"github.com/minio/minio-go/v7"
 )
 
 const (
@@ -19,18 +22,64 @@ const (
 
 	// Send pings to client with this period. Must be less than pongWait.
 	pingPeriod = (pongWait * 9) / 10
+
+	// Maximum message size allowed from the client.
+	maxMessageSize = 4096
+
+	// Time allowed to read the headers of a request.
+	readHeaderTimeout = 10 * time.Second
 )
 
 var upgrader = websocket.Upgrader{ //nolint:gochecknoglobals
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
-	CheckOrigin: func(*http.Request) bool {
+	CheckOrigin:     checkOrigin,
+}
+
+// checkOrigin accepts the WebSocket requests of the pages served by the server, or by one of the allowed origins.
+// As the browsers send the credentials of the users along with the cross-site WebSocket requests,
+// any page could otherwise read the events of the users who visit it. The origin isn't checked
+// when the authentication is disabled, nor for the clients which aren't browsers and don't send one.
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if !config.Auth.Enabled || origin == "" {
+		return true
+	}
+
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
 		return true
-	},
+	}
+
+	for _, allowed := range config.Auth.AllowedOrigins {
+		if strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+
+	printDebug(fmt.Sprintf("Rejected WebSocket request from %s with origin %q", r.RemoteAddr, origin))
+
+	return false
 }
 
 var newline = []byte{'\n'} //nolint:gochecknoglobals
 
+// sendBufferSize is the number of messages that can be queued for a client.
+// A client that doesn't keep up is disconnected.
+const sendBufferSize = 256
+
+// eventIDEpochShift leaves room, in the event IDs, for 1024 events per millisecond since the server started.
+// The IDs stay below 2^53, so that they are exact as JavaScript numbers.
+const eventIDEpochShift = 10
+
+// hubMessage is an event as sent to the clients, along with its sequence number
+// and the information needed to filter it according to the subscriptions.
+type hubMessage struct {
+	id        uint64
+	data      []byte
+	eventType string
+	imgType   *ImageType
+}
+
 // Hub maintains the set of active clients and broadcasts messages to the
 // clients.
 type Hub struct {
@@ -42,50 +91,221 @@ type Hub struct {
 
 	// Unregister requests from clients.
 	unregister chan *Client
+
+	// Subscription changes requested by the clients.
+	subscribe chan subscriptionRequest
+
+	// lastID is the sequence number of the last broadcast event, starting from the boot epoch.
+	lastID atomic.Uint64
+
+	// history holds the last broadcast events, to resume the streams of the clients that reconnect.
+	history *eventRing
+
+	// quit asks the hub to disconnect all the clients and to stop, done is closed once it is stopped.
+	quit chan struct{}
+	done chan struct{}
+
+	// writers tracks the WebSocket writers, so that the close frames can be sent before the shutdown.
+	writers *activityTracker
 }
 
 func newHub() *Hub {
-	return &Hub{
+	hub := &Hub{
 		register:   make(chan *Client),
 		unregister: make(chan *Client),
+		subscribe:  make(chan subscriptionRequest),
 		clients:    make(map[*Client]bool),
+		history:    newEventRing(config.EventBufferSize),
+		quit:       make(chan struct{}),
+		done:       make(chan struct{}),
+		writers:    newActivityTracker(),
 	}
+
+	// The sequence starts from the boot time, so that the IDs received by the clients before a restart
+	// are older than the ones of this run, and are answered with a reset event instead of unrelated events.
+	hub.lastID.Store(uint64(time.Now().UnixMilli()) << eventIDEpochShift) //nolint:gosec
+
+	return hub
 }
 
 func (h *Hub) run(eventChan <-chan event) {
+	defer close(h.done)
+
 	for {
 		select {
+		case <-h.quit:
+			for client := range h.clients {
+				close(client.send)
+				delete(h.clients, client)
+				hubClients.WithLabelValues(client.transport()).Dec()
+			}
+
+			return
 		case client := <-h.register:
+			if client.resume {
+				h.replay(client)
+			}
+
 			h.clients[client] = true
+			hubClients.WithLabelValues(client.transport()).Inc()
 		case client := <-h.unregister:
 			if _, ok := h.clients[client]; ok {
 				delete(h.clients, client)
+				hubClients.WithLabelValues(client.transport()).Dec()
 				close(client.send)
 			}
+		case req := <-h.subscribe:
+			if _, ok := h.clients[req.client]; ok {
+				req.client.subscription = req.subscription
+			}
 		case evt := <-eventChan:
-			eventMsg := evt.JSON()
+			evt.ID = h.lastID.Add(1)
+			msg := hubMessage{id: evt.ID, data: evt.JSON(), eventType: evt.EventType}
+
+			if imgKey := evt.imageKey(); imgKey != "" {
+				msg.imgType = inferImageType(imgKey)
+			}
+
+			h.history.push(msg)
 
 			for client := range h.clients {
+				if !client.accepts(msg) {
+					continue
+				}
+
 				select {
-				case client.send <- eventMsg:
+				case client.send <- msg:
 				default:
 					close(client.send)
 					delete(h.clients, client)
+					hubClients.WithLabelValues(client.transport()).Dec()
+					hubDroppedClients.WithLabelValues(client.transport()).Inc()
 				}
 			}
 		}
 	}
 }
 
+// stop disconnects all the clients, and waits for the WebSocket ones to be sent a close frame.
+func (h *Hub) stop(timeout time.Duration) {
+	close(h.quit)
+	<-h.done
+
+	if !h.writers.drain(timeout) {
+		printWarn("Some WebSocket clients could not be closed in time")
+	}
+}
+
+// registerClient adds the client to the hub. It returns false if the hub is stopped.
+func (h *Hub) registerClient(client *Client) bool {
+	select {
+	case h.register <- client:
+		return true
+	case <-h.done:
+		return false
+	}
+}
+
+func (h *Hub) unregisterClient(client *Client) {
+	select {
+	case h.unregister <- client:
+	case <-h.done:
+	}
+}
+
+func (h *Hub) subscribeClient(req subscriptionRequest) {
+	select {
+	case h.subscribe <- req:
+	case <-h.done:
+	}
+}
+
+// replay sends to the client the events that followed the last one it received.
+// If some of them are not in the history anymore, if there are too many of them,
+// or if the event is unknown because the server restarted, a reset event is sent instead,
+// so that the client reloads its whole state.
+func (h *Hub) replay(client *Client) {
+	lastID := h.lastID.Load()
+	if client.lastEventID == lastID {
+		return
+	}
+
+	messages, ok := h.history.since(client.lastEventID)
+	if client.lastEventID > lastID || !ok || len(messages) > cap(client.send) {
+		printDebug(fmt.Sprintf("Can't replay the events following %d, resetting the client", client.lastEventID))
+
+		client.send <- hubMessage{id: lastID, data: event{ID: lastID, EventType: eventReset, EventDate: time.Now().String()}.JSON(), eventType: eventReset}
+
+		return
+	}
+
+	for _, msg := range messages {
+		if client.accepts(msg) {
+			client.send <- msg
+		}
+	}
+}
+
 // Client is a middleman between the websocket connection and the hub.
 type Client struct {
 	hub *Hub
 
-	// The websocket connection.
+	// The websocket connection, nil for the server-sent events clients.
 	conn *websocket.Conn
 
 	// Buffered channel of outbound messages.
-	send chan []byte
+	send chan hubMessage
+
+	// resume asks the hub to replay the events following lastEventID on registration.
+	resume      bool
+	lastEventID uint64
+
+	// subscription filters the events sent to the client. It is only accessed by the hub once registered.
+	subscription subscription
+
+	// identity is the authenticated user of the client, nil when the authentication is disabled.
+	identity *Identity
+}
+
+// accepts returns whether the message must be sent to the client,
+// according to its subscription and to the image groups its user can see.
+func (c *Client) accepts(msg hubMessage) bool {
+	if msg.eventType != eventReset && !c.identity.canViewType(msg.imgType) {
+		return false
+	}
+
+	return c.subscription.matches(msg)
+}
+
+// reader processes the messages of the client, until the connection is closed.
+func (c *Client) reader() {
+	defer func() {
+		c.hub.unregisterClient(c)
+
+		_ = c.conn.Close()
+	}()
+
+	c.conn.SetReadLimit(maxMessageSize)
+	_ = c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
+	for {
+		_, message, err := c.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		sub, err := parseClientMessage(message)
+		if err != nil {
+			printWarn(fmt.Sprintf("Ignoring message from WS client %s: %v", c.conn.RemoteAddr(), err))
+
+			continue
+		}
+
+		c.hub.subscribeClient(subscriptionRequest{client: c, subscription: sub})
+	}
 }
 
 func (c *Client) writer() {
@@ -94,6 +314,8 @@ func (c *Client) writer() {
 		ticker.Stop()
 
 		_ = c.conn.Close()
+
+		c.hub.writers.end()
 	}()
 
 	for {
@@ -102,7 +324,7 @@ func (c *Client) writer() {
 			_ = c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if !ok {
 				// The hub closed the channel.
-				_ = c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				_ = c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""))
 				return
 			}
 
@@ -111,13 +333,13 @@ func (c *Client) writer() {
 				return
 			}
 
-			_, _ = w.Write(message)
+			_, _ = w.Write(message.data)
 
 			// Add queued chat messages to the current websocket message.
 			n := len(c.send)
 			for i := 0; i < n; i++ {
 				_, _ = w.Write(newline)
-				_, _ = w.Write(<-c.send)
+				_, _ = w.Write((<-c.send).data)
 			}
 
 			if err := w.Close(); err != nil {
@@ -137,23 +359,56 @@ func (c *Client) writer() {
 }
 
 // serveWs handles websocket requests from the peer.
+// The events following the one given by the 'since' query parameter are replayed first.
+// The 'group', 'type' and 'event' query parameters set the initial subscription of the client,
+// which can then be changed by sending a subscribe message.
 func serveWs(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	client := &Client{hub: hub, send: make(chan hubMessage, sendBufferSize), subscription: parseSubscription(r.URL.Query()), identity: identityFromRequest(r)}
+
+	if since := r.URL.Query().Get("since"); since != "" {
+		id, err := strconv.ParseUint(since, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid 'since' parameter", http.StatusBadRequest)
+
+			return
+		}
+
+		client.resume = true
+		client.lastEventID = id
+	}
+
+	if !hub.writers.begin() {
+		http.Error(w, "The server is shutting down", http.StatusServiceUnavailable)
+
+		return
+	}
+
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		printError(fmt.Errorf("failed to upgrade WS connection: %w", err), false)
+		hub.writers.end()
 
 		return
 	}
 
-	client := &Client{hub: hub, conn: conn, send: make(chan []byte, 256)}
-	client.hub.register <- client
+	client.conn = conn
+
+	if !hub.registerClient(client) {
+		_ = conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""))
+		_ = conn.Close()
+
+		hub.writers.end()
+
+		return
+	}
 
 	// Allow collection of memory referenced by the caller by doing all work in
 	// new goroutines.
 	go client.writer()
+	go client.reader()
 }
 
-func websocketHandler(w http.ResponseWriter, r *http.Request) {
+func websocketHandler(hub *Hub, w http.ResponseWriter, r *http.Request) {
 	if r.URL.Path != "/" {
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 
@@ -162,6 +417,10 @@ func websocketHandler(w http.ResponseWriter, r *http.Request) {
 
 	deleteCookies(w, r)
 
+	// read before the previews are listed, so that the page doesn't miss the events that follow them
+	lastEventID := hub.lastID.Load()
+	identity := identityFromRequest(r)
+
 	tmpl, err := getIndexWsTemplate()
 	if err != nil {
 		prettier(w, err.Error(), nil, http.StatusInternalServerError)
@@ -169,24 +428,37 @@ func websocketHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	bucketNames := make([]string, len(config.Buckets))
+	for b := range config.Buckets {
+		bucketNames[b] = config.Buckets[b].name()
+	}
+
+	// the key prefix is only meaningful to the page when all the images come from the same bucket
+	var keyPrefix string
+	if len(config.Buckets) == 1 {
+		keyPrefix = strings.TrimSuffix(config.Buckets[0].KeyPrefix, "/")
+	}
+
 	executeTemplate(w, tmpl, templateData{
 		Version:                version,
 		BasePath:               config.BasePath,
 		TileServerURL:          config.TileServerURL,
 		WindowTitle:            config.WindowTitle,
 		ScaleInitialPercentage: config.ScaleInitialPercentage,
-		BucketName:             config.S3.BucketName,
-		PrefixName:             "config.S3.KeyPrefix",
-		Previews:               mainCache.toEventObjects(),
+		BucketName:             strings.Join(bucketNames, ", "),
+		PrefixName:             keyPrefix,
+		Previews:               mainCache.toEventObjects(identity),
 		// PreviewsWithTime:       mainCache, TODO: add time to EventObject ?
 		PreviewFilename:       config.PreviewFilename,
 		FullProductExtension:  config.FullProductExtension,
-		KeyPrefix:             "config.S3.KeyPrefix",
-		ImageGroups:           config.ImageGroups,
-		ImageTypes:            config.imageTypes,
+		KeyPrefix:             keyPrefix,
+		ImageGroups:           identity.visibleGroups(config.ImageGroups),
+		ImageTypes:            identity.visibleTypes(config.imageTypes),
 		MaxImagesDisplayCount: config.MaxImagesDisplayCount,
+		ThumbnailWidth:        galleryThumbnailWidth,
 		RetentionPeriod:       config.RetentionPeriod.Seconds(),
 		PollingPeriod:         config.PollingPeriod.Seconds(),
+		LastEventID:           lastEventID,
 	})
 }
 
@@ -195,19 +467,19 @@ func reloadHandler(w http.ResponseWriter, _ *http.Request, eventChan chan event)
 
 	pollMutex.Lock()
 	defer pollMutex.Unlock()
-	imagesCacheMutex.Lock()
-	defer imagesCacheMutex.Unlock()
-	timersMutex.Lock()
-	defer timersMutex.Unlock()
 	geonamesCacheMutex.Lock()
 	defer geonamesCacheMutex.Unlock()
+	localizationCacheMutex.Lock()
+	defer localizationCacheMutex.Unlock()
+	featuresCacheMutex.Lock()
+	defer featuresCacheMutex.Unlock()
 	fullProductLinksCacheMutex.Lock()
 	defer fullProductLinksCacheMutex.Unlock()
 	additionalProductFilesCacheMutex.Lock()
 	defer additionalProductFilesCacheMutex.Unlock()
 
 	// delete all caches in the filesystem
-	err := clearDir(config.BaseCacheDir)
+	err := errors.Join(clearDir(config.mainCacheDir), clearDir(config.thumbnailsCacheDir), cacheIndex.clear())
 	if err != nil {
 		printError(fmt.Errorf("failed to clear the cache on disk: %w", err), false)
 		w.WriteHeader(http.StatusInternalServerError)
@@ -217,15 +489,17 @@ func reloadHandler(w http.ResponseWriter, _ *http.Request, eventChan chan event)
 	}
 
 	// clear all caches in ram
-	mainCache = ImageCache{pathOnDisk: config.mainCacheDir}
-	thumbnailsCache = ImageCache{pathOnDisk: config.thumbnailsCacheDir}
+	mainCache.clear()
+	thumbnailsCache.clear()
 
-	for timerKey, timer := range timers {
-		timer.Stop()
-		delete(timers, timerKey)
-	}
+	expiryScheduler.clear()
+	diskQuota.clear()
+	clearResizedVariants()
+	spatialIndex.clear()
 
 	geonamesCache = make(map[string]Geonames)
+	localizationCache = make(map[string]Localization)
+	featuresCache = make(map[string]Features)
 	fullProductLinksCache = make(map[string][]string)
 	additionalProductFilesCache = make(map[string]time.Time)
 
@@ -240,30 +514,53 @@ func reloadHandler(w http.ResponseWriter, _ *http.Request, eventChan chan event)
 	fmt.Fprintln(w, "Reload done !")
 }
 
-func startWSServer(port uint16, eventChan chan event, minioClient *minio.Client) error {
+// newWebServer registers the routes of the web server, and starts the hub broadcasting the events.
+func newWebServer(port uint16, eventChan chan event, auth *Authenticator) (*http.Server, *Hub) {
 	hub := newHub()
 	go hub.run(eventChan)
 
-	http.HandleFunc("/", websocketHandler)
+	handleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		websocketHandler(hub, w, r)
+	})
 	http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
 		serveWs(hub, w, r)
 	})
-	http.HandleFunc("/image/", imageHandler)
-	http.HandleFunc("/images", imagesListHandler)
-	http.HandleFunc("/infos/", func(w http.ResponseWriter, r *http.Request) {
-		infosHandler(w, r, minioClient) //nolint:contextcheck
+	http.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		serveSSE(hub, w, r)
 	})
-	http.HandleFunc("/vendor/", vendorHandler)
-	http.HandleFunc("/cache/", cacheHandler)
-	http.HandleFunc("/thumbnails/", thumbnailsHandler)
-	http.HandleFunc("/reload", func(w http.ResponseWriter, r *http.Request) {
+	handleFunc("/image/", audited(auditImageDownload, pathTarget("/image/"), imageHandler))
+	handleFunc("/images", imagesListHandler)
+	handleFunc("/infos/", infosHandler)
+	handleFunc("/api/v1/images", apiImagesHandler)
+	handleFunc("/api/v1/footprints", footprintsHandler)
+	handleFunc("/stac", stacHandler)
+	handleFunc("/stac/", stacHandler)
+	handleFunc("/tiles/", tilesHandler)
+	handleFunc("/api/v1/export.kml", audited(auditExport, exportTarget, exportHandler))
+	handleFunc("/api/v1/export.kmz", audited(auditExport, exportTarget, exportHandler))
+	handleFunc("/api/v1/export.gpkg", audited(auditExport, exportTarget, exportHandler))
+	handleFunc("/api/v1/expirations", expirationsHandler)
+	handleFunc("/api/v1/cache", requireAdmin(cacheUsageHandler))
+	handleFunc("/api/v1/cache/pins/", pinsHandler)
+	handleFunc("/api/v1/audit", audited(auditQuery, queryTarget, requireAdmin(auditHandler)))
+	handleFunc("/vendor/", vendorHandler)
+	handleFunc("/cache/", audited(auditFileDownload, pathTarget("/cache/"), cacheHandler))
+	handleFunc("/thumbnails/", thumbnailsHandler)
+	handleFunc("/reload", audited(auditReload, func(*http.Request) string { return "" }, requireAdmin(func(w http.ResponseWriter, r *http.Request) {
 		reloadHandler(w, r, eventChan)
-	})
-	http.HandleFunc("/health", func(w http.ResponseWriter, _ *http.Request) {
+	})))
+	handleFunc("/metrics", requireAdmin(metricsHandler()))
+	handleFunc("/health", func(w http.ResponseWriter, _ *http.Request) {
 		w.WriteHeader(http.StatusNoContent) // for ping
 	})
+	handleFunc("/livez", livezHandler)
+	handleFunc("/readyz", readyzHandler)
 
-	printInfo("Starting web socket server on port ", port, " ...")
+	server := &http.Server{
+		Addr:              ":" + strconv.FormatUint(uint64(port), 10),
+		Handler:           auth.middleware(http.DefaultServeMux),
+		ReadHeaderTimeout: readHeaderTimeout,
+	}
 
-	return http.ListenAndServe(":"+strconv.FormatUint(uint64(port), 10), nil) //nolint:wrapcheck,gosec
+	return server, hub
 }
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// replayed returns the IDs and types of the events queued for the client.
+func replayed(t *testing.T, client *Client) (ids []uint64, types []string) {
+	t.Helper()
+
+	for len(client.send) > 0 {
+		msg := <-client.send
+
+		var evt event
+		if err := json.Unmarshal(msg.data, &evt); err != nil {
+			t.Fatalf("invalid event %q: %v", msg.data, err)
+		}
+
+		ids = append(ids, evt.ID)
+		types = append(types, evt.EventType)
+	}
+
+	return ids, types
+}
+
+func TestHubReplay(t *testing.T) {
+	const start = 1000
+
+	tests := []struct {
+		name        string
+		lastEventID uint64
+		sendSize    int
+		expected    []uint64
+		reset       bool
+	}{
+		{name: "up to date", lastEventID: start + 6, sendSize: 8},
+		{name: "missed some", lastEventID: start + 4, sendSize: 8, expected: []uint64{start + 5, start + 6}},
+		{name: "missed the oldest kept", lastEventID: start + 2, sendSize: 8, expected: []uint64{start + 3, start + 4, start + 5, start + 6}},
+		{name: "overwritten", lastEventID: start + 1, sendSize: 8, reset: true},
+		{name: "too many to be queued", lastEventID: start + 2, sendSize: 2, reset: true},
+		{name: "before a restart", lastEventID: 3, sendSize: 8, reset: true},
+		{name: "unknown", lastEventID: start + 100, sendSize: 8, reset: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// 6 events broadcast, the 4 last ones being kept
+			hub := &Hub{history: newEventRing(4)}
+			hub.lastID.Store(start)
+
+			for range 6 {
+				id := hub.lastID.Add(1)
+				hub.history.push(hubMessage{id: id, data: event{ID: id, EventType: eventAdd}.JSON()})
+			}
+
+			client := &Client{hub: hub, send: make(chan hubMessage, test.sendSize), resume: true, lastEventID: test.lastEventID}
+			hub.replay(client)
+
+			ids, types := replayed(t, client)
+
+			if test.reset {
+				if len(types) != 1 || types[0] != eventReset || ids[0] != start+6 {
+					t.Errorf("expected a single reset event with the last ID, got %v %v", ids, types)
+				}
+
+				return
+			}
+
+			if len(ids) != len(test.expected) {
+				t.Fatalf("expected the events %v, got %v", test.expected, ids)
+			}
+
+			for i, id := range ids {
+				if id != test.expected[i] || types[i] != eventAdd {
+					t.Errorf("expected the events %v, got %v %v", test.expected, ids, types)
+
+					break
+				}
+			}
+		})
+	}
+}
+
+// TestHubIDsAfterRestart checks that the IDs received before a restart are answered with a reset event.
+func TestHubIDsAfterRestart(t *testing.T) {
+	previous := newHub()
+
+	var lastID uint64
+	for range 100 {
+		lastID = previous.lastID.Add(1)
+	}
+
+	time.Sleep(2 * time.Millisecond)
+
+	hub := newHub()
+	if hub.lastID.Load() <= lastID {
+		t.Fatalf("the IDs of the new run start at %d, before the last one of the previous run %d", hub.lastID.Load(), lastID)
+	}
+
+	id := hub.lastID.Add(1)
+	hub.history.push(hubMessage{id: id, data: event{ID: id, EventType: eventAdd}.JSON()})
+
+	client := &Client{hub: hub, send: make(chan hubMessage, 8), resume: true, lastEventID: lastID}
+	hub.replay(client)
+
+	if _, types := replayed(t, client); len(types) != 1 || types[0] != eventReset {
+		t.Errorf("expected a reset event, got %v", types)
+	}
+
+	// the IDs stay exact as JavaScript numbers
+	if id >= 1<<53 {
+		t.Errorf("event ID %d can't be represented exactly in JavaScript", id)
+	}
+}